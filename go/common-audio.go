@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// channel mapping of receivers
+const (
+	channelsStereo = "stereo"
+	channelsLeft   = "left"
+	channelsRight  = "right"
+	channelsMono   = "mono"
+
+	// longest delay compensation in ms
+	maxDelay = 5000
+
+	// gain limits of equalizer-10bands in dB
+	minEqGain = -24
+	maxEqGain = 12
+
+	// volume in percent, above 100 amplifies
+	maxVolume = 150
+	// change of relative volume changes in percent
+	defaultVolumeStep = 5
+	// normalization gain of radios in dB
+	maxRadioGain = 20
+)
+
+// center frequencies of equalizer-10bands in Hz
+var eqBands = []int{29, 59, 119, 237, 474, 947, 1889, 3770, 7523, 15011}
+
+// gains in dB added to eq at volume 0, fading out towards volume 100
+var loudnessCurve = []float64{10, 8, 5, 2, 0, 0, 0, 2, 4, 5}
+
+func checkVolume(v, max int) error {
+	if v < 0 || v > max {
+		return fmt.Errorf("volume must be between 0 and %d: %d", max, v)
+	}
+	return nil
+}
+
+func checkRadioGain(g float64) error {
+	if g < -maxRadioGain || g > maxRadioGain {
+		return fmt.Errorf("gain must be between -%d and %d dB: %g", maxRadioGain, maxRadioGain, g)
+	}
+	return nil
+}
+
+// factor for the volume element: volume in percent, radio gain in dB
+func volumeFactor(volume int, muted bool, gain float64) float64 {
+	if muted {
+		return 0
+	}
+	v := float64(volume) / 100 * math.Pow(10, gain/20)
+	// limit of the volume element
+	if v > 10 {
+		return 10
+	}
+	return v
+}
+
+func checkChannels(channels string) error {
+	switch channels {
+	case "", channelsStereo, channelsLeft, channelsRight, channelsMono:
+		return nil
+	}
+	return fmt.Errorf("unknown channels '%s', use stereo, left, right or mono", channels)
+}
+
+func checkDelay(delay int) error {
+	if delay < 0 || delay > maxDelay {
+		return fmt.Errorf("delay must be between 0 and %d ms: %d", maxDelay, delay)
+	}
+	return nil
+}
+
+// parse comma separated gains in dB, one per band, "flat" resets all bands
+func parseEq(s string) ([]float64, error) {
+	if s == "flat" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != len(eqBands) {
+		return nil, fmt.Errorf("eq needs %d gains, got %d", len(eqBands), len(parts))
+	}
+	gains := make([]float64, len(parts))
+	for i, p := range parts {
+		g, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gain '%s' for %d Hz", p, eqBands[i])
+		}
+		if g < minEqGain || g > maxEqGain {
+			return nil, fmt.Errorf("gain for %d Hz must be between %d and %d dB: %g", eqBands[i], minEqGain, maxEqGain, g)
+		}
+		gains[i] = g
+	}
+	return gains, nil
+}
+
+// gains of all bands including loudness compensation for the given volume
+func eqGains(eq []float64, loudness bool, volume int) []float64 {
+	gains := make([]float64, len(eqBands))
+	f := 1 - float64(volume)/100
+	if f < 0 {
+		f = 0
+	}
+	for i := range gains {
+		if i < len(eq) {
+			gains[i] = eq[i]
+		}
+		if loudness {
+			gains[i] += loudnessCurve[i] * f
+		}
+		if gains[i] > maxEqGain {
+			gains[i] = maxEqGain
+		} else if gains[i] < minEqGain {
+			gains[i] = minEqGain
+		}
+	}
+	return gains
+}
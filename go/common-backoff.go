@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// how long to wait between retries and when to give up
+type BackoffPolicy struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// randomize delays by +/- this fraction to spread reconnects of many clients
+	Jitter float64
+	// give up after this many retries, 0 retries forever
+	MaxAttempts int
+}
+
+// retries done with a policy, reset after success
+// safe for concurrent use, retries are often scheduled and reset by different goroutines
+type Backoff struct {
+	policy  *BackoffPolicy
+	clock   Clock
+	random  func() float64
+	lock    sync.Mutex
+	attempt int
+}
+
+var (
+	// pipeline errors and unreachable servers
+	pipelineBackoff = BackoffPolicy{
+		Initial:     5 * time.Second,
+		Max:         5 * time.Minute,
+		Multiplier:  2,
+		Jitter:      0.1,
+		MaxAttempts: 10,
+	}
+)
+
+func (p *BackoffPolicy) validate() error {
+	if p.Initial <= 0 {
+		return fmt.Errorf("initial delay must be positive: %s", p.Initial)
+	}
+	if p.Max < p.Initial {
+		return fmt.Errorf("max delay must not be less than initial delay: %s < %s", p.Max, p.Initial)
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1: %g", p.Multiplier)
+	}
+	if p.Jitter < 0 || p.Jitter >= 1 {
+		return fmt.Errorf("jitter must be between 0 and 1: %g", p.Jitter)
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("attempts must not be negative: %d", p.MaxAttempts)
+	}
+	return nil
+}
+
+// register --${prefix}-initial, -max, -multiplier, -jitter and the given attempts flag
+func (p *BackoffPolicy) registerFlags(prefix, attemptsFlag, what string) {
+	flag.DurationVar(&p.Initial, prefix+"-initial", p.Initial, "First delay before retrying "+what)
+	flag.DurationVar(&p.Max, prefix+"-max", p.Max, "Maximum delay before retrying "+what)
+	flag.Float64Var(&p.Multiplier, prefix+"-multiplier", p.Multiplier, "Factor increasing the delay before retrying "+what)
+	flag.Float64Var(&p.Jitter, prefix+"-jitter", p.Jitter, "Randomize delays before retrying "+what+" by this fraction [0-1)")
+	flag.IntVar(&p.MaxAttempts, attemptsFlag, p.MaxAttempts, "Retries of "+what+" before giving up, 0 retries forever")
+}
+
+// the policy is read on every retry, it may be changed by flags after creating the backoff
+func (p *BackoffPolicy) NewBackoff(clock Clock) *Backoff {
+	return &Backoff{policy: p, clock: clock, random: rand.Float64}
+}
+
+// delay before the next retry, without jitter
+func (b *Backoff) delay(attempt int) time.Duration {
+	p := b.policy
+	d := float64(p.Initial) * math.Pow(p.Multiplier, float64(attempt))
+	if d > float64(p.Max) {
+		return p.Max
+	}
+	return time.Duration(d)
+}
+
+// delay before the next retry, false if retries are exhausted
+func (b *Backoff) Next() (time.Duration, bool) {
+	d, _, ok := b.next()
+	return d, ok
+}
+
+// delay and number of the next retry
+func (b *Backoff) next() (time.Duration, int, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	p := b.policy
+	if p.MaxAttempts > 0 && b.attempt >= p.MaxAttempts {
+		return 0, b.attempt, false
+	}
+	d := b.delay(b.attempt)
+	b.attempt += 1
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*b.random() - 1))
+	}
+	return d, b.attempt, true
+}
+
+// wait for the next retry, false if retries are exhausted
+func (b *Backoff) Wait() bool {
+	d, attempt, ok := b.next()
+	if !ok {
+		return false
+	}
+	log.Debug("retry %d in %s", attempt, d)
+	<-b.clock.After(d)
+	return true
+}
+
+// run retry after the next delay without blocking the caller, false if retries are exhausted
+func (b *Backoff) Schedule(retry func()) bool {
+	d, attempt, ok := b.next()
+	if !ok {
+		return false
+	}
+	log.Debug("retry %d in %s", attempt, d)
+	c := b.clock.After(d)
+	go func() {
+		<-c
+		retry()
+	}()
+	return true
+}
+
+func (b *Backoff) Reset() {
+	b.lock.Lock()
+	b.attempt = 0
+	b.lock.Unlock()
+}
+
+func (b *Backoff) Attempts() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.attempt
+}
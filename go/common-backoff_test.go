@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBackoff(p *BackoffPolicy, random float64) (*Backoff, *fakeClock) {
+	clock := newFakeClock(time.Unix(0, 0))
+	b := p.NewBackoff(clock)
+	b.random = func() float64 { return random }
+	return b, clock
+}
+
+func TestBackoffGrowth(t *testing.T) {
+	p := BackoffPolicy{Initial: time.Second, Max: time.Minute, Multiplier: 2}
+	b, _ := newTestBackoff(&p, 0.5)
+	for i, want := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second,
+		// capped
+		time.Minute, time.Minute,
+	} {
+		d, ok := b.Next()
+		if !ok {
+			t.Fatalf("retry %d: retries exhausted without limit", i)
+		}
+		if d != want {
+			t.Errorf("retry %d: delay %s, want %s", i, d, want)
+		}
+	}
+	if b.Attempts() != 8 {
+		t.Errorf("%d attempts, want 8", b.Attempts())
+	}
+
+	b.Reset()
+	if d, _ := b.Next(); d != time.Second {
+		t.Errorf("delay %s after reset, want %s", d, time.Second)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	p := BackoffPolicy{Initial: 10 * time.Second, Max: time.Minute, Multiplier: 1, Jitter: 0.1}
+	for _, tt := range []struct {
+		random float64
+		want   time.Duration
+	}{
+		{0, 9 * time.Second},
+		{0.5, 10 * time.Second},
+		{0.999999, 10*time.Second + 999998*time.Microsecond},
+	} {
+		b, _ := newTestBackoff(&p, tt.random)
+		if d, _ := b.Next(); d != tt.want {
+			t.Errorf("random %g: delay %s, want %s", tt.random, d, tt.want)
+		}
+	}
+
+	// real randomness stays within bounds, even when capped
+	p.Max = 10 * time.Second
+	b := p.NewBackoff(newFakeClock(time.Unix(0, 0)))
+	for i := 0; i < 1000; i++ {
+		d, _ := b.Next()
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("delay %s out of jitter bounds", d)
+		}
+	}
+}
+
+func TestBackoffExhausted(t *testing.T) {
+	p := BackoffPolicy{Initial: time.Second, Max: time.Minute, Multiplier: 2, MaxAttempts: 3}
+	b, clock := newTestBackoff(&p, 0.5)
+	done := make(chan bool)
+	go func() {
+		for b.Wait() {
+		}
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		clock.waitFor(t, 1)
+		clock.Advance(time.Minute)
+	}
+	<-done
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if len(clock.delays) != len(want) {
+		t.Fatalf("waited %v, want %v", clock.delays, want)
+	}
+	for i := range want {
+		if clock.delays[i] != want[i] {
+			t.Errorf("wait %d: %s, want %s", i, clock.delays[i], want[i])
+		}
+	}
+	if _, ok := b.Next(); ok {
+		t.Error("retries should stay exhausted")
+	}
+	if b.Schedule(func() { t.Error("exhausted retry must not run") }) {
+		t.Error("exhausted backoff should not schedule")
+	}
+}
+
+func TestBackoffSchedule(t *testing.T) {
+	p := BackoffPolicy{Initial: time.Second, Max: time.Minute, Multiplier: 2}
+	b, clock := newTestBackoff(&p, 0.5)
+	done := make(chan bool)
+	if !b.Schedule(func() { close(done) }) {
+		t.Fatal("unable to schedule retry")
+	}
+	// returned without waiting
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("retry ran early")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry didn't run")
+	}
+}
+
+func TestBackoffPolicyValidate(t *testing.T) {
+	valid := BackoffPolicy{Initial: time.Second, Max: time.Minute, Multiplier: 2, Jitter: 0.1}
+	if err := valid.validate(); err != nil {
+		t.Errorf("valid policy: %s", err)
+	}
+	for _, p := range []BackoffPolicy{
+		{Initial: 0, Max: time.Minute, Multiplier: 2},
+		{Initial: time.Minute, Max: time.Second, Multiplier: 2},
+		{Initial: time.Second, Max: time.Minute, Multiplier: 0.5},
+		{Initial: time.Second, Max: time.Minute, Multiplier: 2, Jitter: 1},
+		{Initial: time.Second, Max: time.Minute, Multiplier: 2, MaxAttempts: -1},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("invalid policy %+v accepted", p)
+		}
+	}
+}
+
+// scheduled from bus callbacks, reset by loops and read for status reports at once
+func TestBackoffConcurrent(t *testing.T) {
+	p := BackoffPolicy{Initial: time.Second, Max: time.Minute, Multiplier: 2, MaxAttempts: 1000}
+	b, _ := newTestBackoff(&p, 0.5)
+	done := make(chan bool)
+	for _, f := range []func(){
+		func() { b.Next() },
+		func() { b.Reset() },
+		func() { b.Attempts() },
+	} {
+		go func(f func()) {
+			for i := 0; i < 1000; i++ {
+				f()
+			}
+			done <- true
+		}(f)
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	if n := b.Attempts(); n < 0 || n > 1000 {
+		t.Errorf("%d attempts", n)
+	}
+}
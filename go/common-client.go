@@ -3,35 +3,71 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ziutek/gst"
 )
 
-const (
-	retryInterval = 5 * time.Second
-	maxRetry      = 24
+var (
+	pipelineTransitions = metrics.NewCounter("ub0r_pipeline_state_transitions_total", "Pipeline state transitions", "id", "state")
+	pipelineErrors      = metrics.NewCounter("ub0r_pipeline_errors_total", "Pipeline errors", "id")
+	pipelineRestarts    = metrics.NewCounter("ub0r_pipeline_restarts_total", "Pipeline restarts after end of stream or errors", "id")
+	configFailovers     = metrics.NewCounter("ub0r_config_failovers_total", "Switches to another config server")
 )
 
 // ------------ manager
 
 type Manager struct {
-	Pipeline   *gst.Pipeline
-	configSync chan *Config
-	ConfigUri  string
-	Complexity int
-	State      gst.State
-	Backend    Pinger
-	RetryCount int
-	running    bool
+	// replaced by the loop only, other goroutines use it holding pipelineLock
+	Pipeline       *gst.Pipeline
+	pipelineLock   sync.Mutex
+	configSync     chan *Config
+	ConfigUri      string
+	Complexity     int
+	statusLock     sync.Mutex // guards the status fields below, read by other goroutines
+	State          gst.State
+	Backend        Pinger
+	Connected      string
+	ConfigRevision int64
+	LastError      string
+	LastErrorTime  int64
+	ErrorCount     int
+	Failed         bool
+	// path for reporting status to the config server, empty for internal senders
+	StatusPath string
+	// config servers to fail over between, ConfigUri is the one in use
+	configUris []string
+	configLock sync.Mutex
+	retry      *Backoff
+	// restart after an error is scheduled
+	restarting    int32
+	volumeChanges chan volumeChange
+	// normalization of the current radio in dB
+	gain    float64
+	started int64
+	running bool
+}
+
+// new factor for the volume element, faded in steps if ramp is set
+type volumeChange struct {
+	volume float64
+	ramp   bool
 }
 
 func newManager() *Manager {
 	m := Manager{}
 	m.running = false
 	m.configSync = make(chan *Config, 2)
+	m.volumeChanges = make(chan volumeChange, 2)
+	m.retry = pipelineBackoff.NewBackoff(realClock{})
+	m.started = time.Now().Unix()
 	return &m
 }
 
@@ -64,23 +100,27 @@ func (m *Manager) onMessage(bus *gst.Bus, msg *gst.Message) {
 	t := msg.GetType()
 	switch t {
 	case gst.MESSAGE_STATE_CHANGED:
-		pl := m.Pipeline
-		if pl != nil {
+		m.withPipeline(func(pl *gst.Pipeline) {
 			s, _, _ := pl.GetState(100)
-			if s != m.State {
+			if m.setState(s) {
 				log.Info("pipeline state: %s", s)
-				m.State = s
+				pipelineTransitions.Inc(m.Backend.Id(), s.String())
+				if s == gst.STATE_PLAYING {
+					m.retry.Reset()
+				}
 			}
-		}
+		})
 	case gst.MESSAGE_EOS:
 		log.Info("pipeline: end of stream")
+		pipelineRestarts.Inc(m.Backend.Id())
 		m.NewConfig(nil)
 	case gst.MESSAGE_ERROR:
 		err, debug := msg.ParseError()
 		log.Error("pipeline error: %s (debug: %s)", err, debug)
-		// try to reconnect
-		time.Sleep(retryInterval)
-		m.NewConfig(nil)
+		m.setError(fmt.Sprintf("%s", err))
+		pipelineErrors.Inc(m.Backend.Id())
+		m.reportStatus()
+		m.scheduleRestart()
 	case gst.MESSAGE_BUFFERING:
 		// ignore
 	default:
@@ -88,8 +128,159 @@ func (m *Manager) onMessage(bus *gst.Bus, msg *gst.Message) {
 	}
 }
 
+// try to reconnect after a pipeline error, called on the bus which must not block
+func (m *Manager) scheduleRestart() {
+	// a failing pipeline may post several errors
+	if !atomic.CompareAndSwapInt32(&m.restarting, 0, 1) {
+		return
+	}
+	id := m.Backend.Id()
+	ok := m.retry.Schedule(func() {
+		atomic.StoreInt32(&m.restarting, 0)
+		pipelineRestarts.Inc(id)
+		m.NewConfig(nil)
+	})
+	if !ok {
+		atomic.StoreInt32(&m.restarting, 0)
+		m.setFailed()
+		m.reportStatus()
+	}
+}
+
+// new pipeline state, false if unchanged, errors are forgotten once playing
+func (m *Manager) setState(s gst.State) bool {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	if s == m.State {
+		return false
+	}
+	m.State = s
+	if s == gst.STATE_PLAYING {
+		m.ErrorCount = 0
+	}
+	return true
+}
+
+func (m *Manager) setError(err string) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.LastError = err
+	m.LastErrorTime = time.Now().Unix()
+	m.ErrorCount += 1
+}
+
+// give up retrying until a new config arrives
+func (m *Manager) setFailed() {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	log.Error("giving up after %d pipeline errors", m.ErrorCount)
+	m.Failed = true
+}
+
+// forget about past errors, e.g. when switching to another server or stream
+func (m *Manager) resetErrors() {
+	m.statusLock.Lock()
+	m.ErrorCount = 0
+	m.Failed = false
+	m.statusLock.Unlock()
+	m.retry.Reset()
+}
+
+// server or stream played, empty if none, errors are forgotten when it changes
+func (m *Manager) setConnected(connected string) {
+	m.statusLock.Lock()
+	changed := connected != m.Connected
+	m.Connected = connected
+	m.statusLock.Unlock()
+	if changed && connected != "" {
+		m.resetErrors()
+	}
+}
+
+func (m *Manager) setConfigRevision(revision int64) {
+	m.statusLock.Lock()
+	m.ConfigRevision = revision
+	m.statusLock.Unlock()
+}
+
+// attach status to backend and send it to the config server
+// internal senders share their backend with the config server, it polls their status holding its lock
+func (m *Manager) reportStatus() {
+	if m.StatusPath == "" {
+		return
+	}
+	m.Backend.SetStatus(m.Status())
+	go m.ping()
+}
+
+// send status to the config server, failing over to the next one if unreachable
+func (m *Manager) ping() {
+	uri := m.ConfigUri
+	if err := pingConfig(uri+m.StatusPath, m.Backend); err != nil {
+		log.Warning("unable to reach config server %s: %s", uri, err)
+		m.failover(uri)
+	}
+}
+
+// use the given comma separated config servers
+func (m *Manager) setConfigServers(list string) {
+	m.configUris, _ = parseUris(list)
+	if len(m.configUris) > 0 {
+		m.ConfigUri = m.configUris[0]
+	}
+}
+
+// switch to the next config server after failing to reach the given one
+func (m *Manager) failover(failed string) {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+	// others may have switched already
+	if len(m.configUris) < 2 || m.ConfigUri != failed {
+		return
+	}
+	for i, u := range m.configUris {
+		if u == failed {
+			m.ConfigUri = m.configUris[(i+1)%len(m.configUris)]
+			break
+		}
+	}
+	log.Info("switching to config server %s", m.ConfigUri)
+	configFailovers.Inc()
+}
+
+// ready if playing or intentionally not connected to any server, call holding statusLock
+func (m *Manager) ready(hasPipeline bool) bool {
+	if m.Failed {
+		return false
+	}
+	if !hasPipeline {
+		return m.Connected == ""
+	}
+	return m.State == gst.STATE_PLAYING
+}
+
+// snapshot of the status, safe to call from any goroutine
+func (m *Manager) Status() *Status {
+	// the pipeline lock is taken before the status lock by the bus
+	hasPipeline := m.withPipeline(func(*gst.Pipeline) {})
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	return &Status{
+		State:          m.State.String(),
+		Ready:          m.ready(hasPipeline),
+		Connected:      m.Connected,
+		ConfigRevision: m.ConfigRevision,
+		LastError:      m.LastError,
+		LastErrorTime:  m.LastErrorTime,
+		ErrorCount:     m.ErrorCount,
+		RetryCount:     m.retry.Attempts(),
+		Failed:         m.Failed,
+		Started:        m.started,
+	}
+}
+
 func (m *Manager) NewConfig(config *Config) {
-	m.configSync<-config
+	m.configSync <- config
 }
 
 func (m *Manager) WaitForNewConfig() *Config {
@@ -105,7 +296,27 @@ func (m *Manager) StartPipeline() {
 	}
 }
 
+// replace the pipeline, called by the loop
+func (m *Manager) setPipeline(pl *gst.Pipeline) {
+	m.pipelineLock.Lock()
+	m.Pipeline = pl
+	m.pipelineLock.Unlock()
+}
+
+// run f with the current pipeline, which is not stopped meanwhile, false if there is none
+func (m *Manager) withPipeline(f func(pl *gst.Pipeline)) bool {
+	m.pipelineLock.Lock()
+	defer m.pipelineLock.Unlock()
+	if m.Pipeline == nil {
+		return false
+	}
+	f(m.Pipeline)
+	return true
+}
+
 func (m *Manager) StopPipeline() {
+	m.pipelineLock.Lock()
+	defer m.pipelineLock.Unlock()
 	if m.Pipeline != nil {
 		log.Info("stop pipeline")
 		m.Pipeline.SetState(gst.STATE_NULL)
@@ -114,6 +325,33 @@ func (m *Manager) StopPipeline() {
 	}
 }
 
+// read numeric property of a named pipeline element
+func (m *Manager) elemProperty(name, prop string) (float64, bool) {
+	var value interface{}
+	m.withPipeline(func(pl *gst.Pipeline) {
+		if e := pl.GetByName(name); e != nil {
+			value = e.GetProperty(prop)
+		}
+	})
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
 // ------------ gst stuff
 
 func checkElem(e interface{}, name string) {
@@ -124,7 +362,12 @@ func checkElem(e interface{}, name string) {
 }
 
 func makeElem(name string) *gst.Element {
-	e := gst.ElementFactoryMake(name, name)
+	return makeNamedElem(name, name)
+}
+
+// names must be unique within a pipeline
+func makeNamedElem(factory, name string) *gst.Element {
+	e := gst.ElementFactoryMake(factory, name)
 	checkElem(e, name)
 	return e
 }
@@ -141,6 +384,12 @@ func linkElems(src, sink *gst.Element) bool {
 	return r
 }
 
+func linkFiltered(src, sink *gst.Element, caps string) bool {
+	r := src.LinkFiltered(sink, gst.CapsFromString(caps))
+	log.Debug("link %s -> %s (%s): %v", src.GetName(), sink.GetName(), caps, r)
+	return r
+}
+
 func onPadAdded(sinkPad, newPad *gst.Pad) {
 	log.Debug("pad-added: %s", newPad.GetName())
 	log.Debug("sink pad: %s", sinkPad.GetName())
@@ -155,6 +404,31 @@ func onPadAdded(sinkPad, newPad *gst.Pad) {
 
 // client stuff --------------------------------
 
+// split comma separated uris, dropping trailing slashes
+func parseUris(list string) ([]string, error) {
+	uris := make([]string, 0)
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSuffix(strings.TrimSpace(u), "/")
+		if u == "" {
+			continue
+		}
+		p, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		if (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return nil, fmt.Errorf("invalid uri '%s', use http://host:port", u)
+		}
+		uris = append(uris, u)
+	}
+	return uris, nil
+}
+
+func checkUris(list string) error {
+	_, err := parseUris(list)
+	return err
+}
+
 func pingConfig(uri string, obj Pinger) error {
 	log.Debug("register object at path: %s", uri)
 
@@ -165,3 +439,43 @@ func pingConfig(uri string, obj Pinger) error {
 	_, err := client.Do(req)
 	return err
 }
+
+// local http server for monitoring --------------------------------
+
+// GET /healthz
+func serveHealth(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// GET /readyz
+func (m *Manager) serveReady(w http.ResponseWriter, req *http.Request) {
+	if s := m.Status(); s.Ready {
+		w.Write([]byte("ok\n"))
+	} else {
+		http.Error(w, fmt.Sprintf("not ready: %s", s.State), http.StatusServiceUnavailable)
+	}
+}
+
+// GET /status
+func (m *Manager) serveStatus(w http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(m.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (m *Manager) serveLocal(port int) {
+	log.Info("starting local httpd on port %d", port)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealth)
+	mux.HandleFunc("/readyz", m.serveReady)
+	mux.HandleFunc("/status", m.serveStatus)
+	mux.HandleFunc("/metrics", serveMetrics)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	if err != nil {
+		log.Error("error starting local httpd: %v", err)
+	}
+}
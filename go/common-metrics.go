@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+var (
+	metrics       = NewRegistry()
+	latencyBucket = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// minimal registry exposing metrics in the prometheus text format
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// counter or gauge with optional labels
+type Value struct {
+	registry *Registry
+	name     string
+	help     string
+	kind     string
+	labels   []string
+	values   map[string]float64
+}
+
+// values collected on every scrape
+type Collector struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	collect func(emit func(v float64, labelValues ...string))
+}
+
+type Histogram struct {
+	registry *Registry
+	name     string
+	help     string
+	labels   []string
+	buckets  []float64
+	counts   map[string][]uint64
+	sums     map[string]float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make([]metric, 0)}
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	r.metrics = append(r.metrics, m)
+	r.lock.Unlock()
+}
+
+func (r *Registry) newValue(name, help, kind string, labels []string) *Value {
+	v := &Value{r, name, help, kind, labels, make(map[string]float64)}
+	r.register(v)
+	return v
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Value {
+	return r.newValue(name, help, kindCounter, labels)
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Value {
+	return r.newValue(name, help, kindGauge, labels)
+}
+
+func (r *Registry) NewCollector(name, help, kind string, labels []string, collect func(emit func(v float64, labelValues ...string))) *Collector {
+	c := &Collector{name, help, kind, labels, collect}
+	r.register(c)
+	return c
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{r, name, help, labels, buckets, make(map[string][]uint64), make(map[string]float64)}
+	r.register(h)
+	return h
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.lock.Lock()
+	l := make([]metric, len(r.metrics))
+	copy(l, r.metrics)
+	r.lock.Unlock()
+	for _, m := range l {
+		m.write(w)
+	}
+}
+
+// ----- values -------------------------------
+
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\x00")
+}
+
+func formatLabels(labels []string, key string, extra ...string) string {
+	pairs := make([]string, 0, len(labels)+1)
+	if len(labels) > 0 {
+		for i, v := range strings.Split(key, "\x00") {
+			if i < len(labels) {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], v))
+			}
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (v *Value) Add(d float64, labelValues ...string) {
+	v.registry.lock.Lock()
+	v.values[labelKey(labelValues)] += d
+	v.registry.lock.Unlock()
+}
+
+func (v *Value) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *Value) Dec(labelValues ...string) {
+	v.Add(-1, labelValues...)
+}
+
+func (v *Value) Set(d float64, labelValues ...string) {
+	v.registry.lock.Lock()
+	v.values[labelKey(labelValues)] = d
+	v.registry.lock.Unlock()
+}
+
+func (v *Value) write(w io.Writer) {
+	v.registry.lock.Lock()
+	defer v.registry.lock.Unlock()
+	writeHeader(w, v.name, v.help, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", v.name, formatLabels(v.labels, k), v.values[k])
+	}
+}
+
+func (c *Collector) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, c.kind)
+	c.collect(func(v float64, labelValues ...string) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, formatLabels(c.labels, labelKey(labelValues)), v)
+	})
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := labelKey(labelValues)
+	h.registry.lock.Lock()
+	defer h.registry.lock.Unlock()
+	counts, ok := h.counts[k]
+	if !ok {
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[k] = counts
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			counts[i] += 1
+		}
+	}
+	counts[len(h.buckets)] += 1
+	h.sums[k] += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.registry.lock.Lock()
+	defer h.registry.lock.Unlock()
+	writeHeader(w, h.name, h.help, kindHistogram)
+	keys := make([]string, 0, len(h.counts))
+	for k := range h.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		counts := h.counts[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", fmt.Sprintf("%g", b)), counts[i])
+		}
+		total := counts[len(h.buckets)]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), total)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, k), h.sums[k])
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), total)
+	}
+}
+
+// ----- http -------------------------------
+
+// GET /metrics
+func serveMetrics(w http.ResponseWriter, req *http.Request) {
+	var b bytes.Buffer
+	metrics.Write(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+// records the response code of a request
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// seconds since unix timestamp
+func age(ts int64) float64 {
+	return float64(time.Now().Unix() - ts)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// options are flags, they may be set in a config file or by environment variables as well
+// precedence: flags > environment > config file > defaults
+
+const envPrefix = "UB0R_"
+
+var (
+	optionsFile = flag.String("config-file", "", "TOML or YAML file with options, environment variables "+envPrefix+"<OPTION> and flags take precedence")
+	printConfig = flag.Bool("print-config", false, "Print effective options and exit")
+)
+
+// option read from a config file
+type fileOption struct {
+	Line  int
+	Key   string
+	Value string
+}
+
+// validation errors of options
+type OptionErrors []error
+
+func (e *OptionErrors) check(name string, err error) {
+	if err != nil {
+		*e = append(*e, fmt.Errorf("--%s: %s", name, err))
+	}
+}
+
+func checkRange(v, min, max int) error {
+	if v < min || v > max {
+		return fmt.Errorf("must be between %d and %d: %d", min, max, v)
+	}
+	return nil
+}
+
+func checkOneOf(v string, allowed ...string) error {
+	for _, a := range allowed {
+		if v == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s: %q", strings.Join(allowed, ", "), v)
+}
+
+func checkRequired(v string) error {
+	if v == "" {
+		return errors.New("is mandatory")
+	}
+	return nil
+}
+
+// parse flags, apply config file and environment, validate and handle --print-config
+func parseOptions(validate func(e *OptionErrors)) {
+	flag.Parse()
+	if err := applyOptions(flag.CommandLine, *optionsFile); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %s\n", err)
+		os.Exit(2)
+	}
+
+	var errs OptionErrors
+	if validate != nil {
+		validate(&errs)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, "invalid configuration:")
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "  %s\n", err)
+		}
+		os.Exit(2)
+	}
+
+	if *printConfig {
+		printOptions(os.Stdout, flag.CommandLine)
+		os.Exit(0)
+	}
+}
+
+func envName(option string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(option, "-", "_", -1))
+}
+
+// set options of fs not given as flags from the config file and the environment
+func applyOptions(fs *flag.FlagSet, file string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if file == "" {
+		file = os.Getenv(envName("config-file"))
+	}
+	if file != "" {
+		options, err := readOptionsFile(file)
+		if err != nil {
+			return err
+		}
+		for _, o := range options {
+			if explicit[o.Key] {
+				continue
+			}
+			if err := setOption(fs, o.Key, o.Value); err != nil {
+				return fmt.Errorf("%s:%d: %s", file, o.Line, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || err != nil {
+			return
+		}
+		if e := f.Value.Set(v); e != nil {
+			err = fmt.Errorf("%s: invalid value %q: %s", envName(f.Name), v, e)
+		}
+	})
+	return err
+}
+
+func setOption(fs *flag.FlagSet, key, value string) error {
+	f := fs.Lookup(key)
+	if f == nil {
+		return fmt.Errorf("unknown option %q", key)
+	}
+	if err := f.Value.Set(value); err != nil {
+		return fmt.Errorf("invalid value %q for %s: %s", value, key, err)
+	}
+	return nil
+}
+
+// passwords and the like are not printed
+func secretOption(name string) bool {
+	for _, s := range []string{"password", "secret", "token"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// print effective options in TOML
+func printOptions(w io.Writer, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config-file" || f.Name == "print-config" {
+			return
+		}
+		v := f.Value.String()
+		if secretOption(f.Name) && v != "" {
+			fmt.Fprintf(w, "%s = %s\n", f.Name, strconv.Quote("********"))
+			return
+		}
+		if g, ok := f.Value.(flag.Getter); ok {
+			switch g.Get().(type) {
+			case bool, int, int64, uint, uint64, float64:
+				fmt.Fprintf(w, "%s = %s\n", f.Name, v)
+				return
+			}
+		}
+		fmt.Fprintf(w, "%s = %s\n", f.Name, strconv.Quote(v))
+	})
+}
+
+// Config files ------------------------------------
+
+func readOptionsFile(file string) ([]fileOption, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".toml":
+		return readToml(f, file)
+	case ".yaml", ".yml":
+		return readYaml(f, file)
+	default:
+		return nil, fmt.Errorf("%s: unknown config file format, use .toml, .yaml or .yml", file)
+	}
+}
+
+// option names use dashes, files may use underscores
+func optionKey(section, key string) string {
+	key = strings.Replace(strings.TrimSpace(key), "_", "-", -1)
+	if section != "" {
+		return section + "-" + key
+	}
+	return key
+}
+
+// unquote a value and strip trailing comments
+func parseValue(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", errors.New("missing value")
+	}
+	switch s[0] {
+	case '"':
+		end := 1
+		for ; end < len(s); end++ {
+			if s[end] == '\\' {
+				end++
+			} else if s[end] == '"' {
+				break
+			}
+		}
+		if end >= len(s) {
+			return "", errors.New("unterminated string")
+		}
+		if rest := strings.TrimSpace(s[end+1:]); rest != "" && rest[0] != '#' {
+			return "", fmt.Errorf("unexpected %q after string", rest)
+		}
+		return strconv.Unquote(s[:end+1])
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		if rest := strings.TrimSpace(s[end+2:]); rest != "" && rest[0] != '#' {
+			return "", fmt.Errorf("unexpected %q after string", rest)
+		}
+		return s[1 : end+1], nil
+	case '[', '{':
+		return "", errors.New("lists and tables are not supported as values")
+	}
+	if i := strings.Index(s, "#"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s, nil
+}
+
+// subset of TOML: key = value pairs, optionally in [section] prefixing keys with "section-"
+func readToml(r io.Reader, file string) ([]fileOption, error) {
+	options := make([]fileOption, 0)
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%s:%d: unterminated section", file, n)
+			}
+			section = optionKey("", line[1:end])
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", file, n)
+		}
+		v, err := parseValue(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+		options = append(options, fileOption{n, optionKey(section, line[:i]), v})
+	}
+	return options, scanner.Err()
+}
+
+// subset of YAML: key: value pairs, optionally nested one level below a section key
+func readYaml(r io.Reader, file string) ([]fileOption, error) {
+	options := make([]fileOption, 0)
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || line[0] == '#' || line == "---" {
+			continue
+		}
+		indented := raw[0] == ' ' || raw[0] == '\t'
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected key: value", file, n)
+		}
+		key, rest := line[:i], strings.TrimSpace(line[i+1:])
+		if !indented {
+			section = ""
+		} else if section == "" {
+			return nil, fmt.Errorf("%s:%d: unexpected indentation", file, n)
+		}
+		if rest == "" || rest[0] == '#' {
+			if indented {
+				return nil, fmt.Errorf("%s:%d: only one level of nesting is supported", file, n)
+			}
+			section = optionKey("", key)
+			continue
+		}
+		v, err := parseValue(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+		options = append(options, fileOption{n, optionKey(section, key), v})
+	}
+	return options, scanner.Err()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseValue(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"value", "value", true},
+		{"  42  ", "42", true},
+		{"value # comment", "value", true},
+		{`"quoted # not a comment"`, "quoted # not a comment", true},
+		{`"escaped \" quote" # comment`, `escaped " quote`, true},
+		{`'single # quoted \n'`, `single # quoted \n`, true},
+		{`""`, "", true},
+		{"", "", false},
+		{`"unterminated`, "", false},
+		{`'unterminated`, "", false},
+		{`"value" trailing`, "", false},
+		{`'value' trailing`, "", false},
+		{"[1, 2]", "", false},
+		{"{a = 1}", "", false},
+	} {
+		v, err := parseValue(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseValue(%q): error %v, want ok %t", tt.in, err, tt.ok)
+		} else if tt.ok && v != tt.want {
+			t.Errorf("parseValue(%q) = %q, want %q", tt.in, v, tt.want)
+		}
+	}
+}
+
+func TestReadToml(t *testing.T) {
+	options, err := readToml(strings.NewReader(`
+# comment
+config_server = "http://config:8080" # comment
+volume-ramp = 2s
+
+[retry]
+initial = 1s
+max_delay = '1m'
+`), "test.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fileOption{
+		{3, "config-server", "http://config:8080"},
+		{4, "volume-ramp", "2s"},
+		{7, "retry-initial", "1s"},
+		{8, "retry-max-delay", "1m"},
+	}
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("got %v, want %v", options, want)
+	}
+
+	for _, tt := range []struct{ in, err string }{
+		{"a = 1\n[section", "test.toml:2: unterminated section"},
+		{"novalue", "test.toml:1: expected key = value"},
+		{"= 1", "test.toml:1: expected key = value"},
+		{"a =", "test.toml:1: missing value"},
+		{"a = [1, 2]", "test.toml:1: lists and tables are not supported as values"},
+	} {
+		if _, err := readToml(strings.NewReader(tt.in), "test.toml"); err == nil || err.Error() != tt.err {
+			t.Errorf("readToml(%q): error %v, want %s", tt.in, err, tt.err)
+		}
+	}
+}
+
+func TestReadYaml(t *testing.T) {
+	options, err := readYaml(strings.NewReader(`---
+# comment
+config_server: "http://config:8080"
+retry: # section
+  initial: 1s
+  max: 1m # comment
+volume-ramp: 2s
+`), "test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fileOption{
+		{3, "config-server", "http://config:8080"},
+		{5, "retry-initial", "1s"},
+		{6, "retry-max", "1m"},
+		{7, "volume-ramp", "2s"},
+	}
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("got %v, want %v", options, want)
+	}
+
+	for _, tt := range []struct{ in, err string }{
+		{"  a: 1", "test.yaml:1: unexpected indentation"},
+		{"a:\n  b:\n    c: 1", "test.yaml:2: only one level of nesting is supported"},
+		{"novalue", "test.yaml:1: expected key: value"},
+		{"a: [1, 2]", "test.yaml:1: lists and tables are not supported as values"},
+		{"a: 'open", "test.yaml:1: unterminated string"},
+	} {
+		if _, err := readYaml(strings.NewReader(tt.in), "test.yaml"); err == nil || err.Error() != tt.err {
+			t.Errorf("readYaml(%q): error %v, want %s", tt.in, err, tt.err)
+		}
+	}
+}
+
+type testOptions struct {
+	fs      *flag.FlagSet
+	server  *string
+	port    *int
+	delay   *time.Duration
+	verbose *bool
+}
+
+func newTestOptions(args ...string) *testOptions {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := &testOptions{
+		fs:      fs,
+		server:  fs.String("config-server", "default", ""),
+		port:    fs.Int("port", 80, ""),
+		delay:   fs.Duration("retry-initial", time.Second, ""),
+		verbose: fs.Bool("verbose", false, ""),
+	}
+	fs.String("mqtt-password", "", "")
+	fs.Parse(args)
+	return o
+}
+
+func writeOptionsFile(t *testing.T, name, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestApplyOptionsPrecedence(t *testing.T) {
+	file := writeOptionsFile(t, "options.toml", "config-server = \"file\"\nport = 8080\n[retry]\ninitial = 5s\n")
+	t.Setenv("UB0R_PORT", "9090")
+	t.Setenv("UB0R_RETRY_INITIAL", "7s")
+
+	o := newTestOptions("--retry-initial=3s")
+	if err := applyOptions(o.fs, file); err != nil {
+		t.Fatal(err)
+	}
+	// flag > environment > file > default
+	if *o.delay != 3*time.Second || *o.port != 9090 || *o.server != "file" || *o.verbose {
+		t.Errorf("delay %s, port %d, server %s, verbose %t", *o.delay, *o.port, *o.server, *o.verbose)
+	}
+
+	// file given by the environment
+	t.Setenv("UB0R_CONFIG_FILE", writeOptionsFile(t, "options.yaml", "verbose: true\n"))
+	o = newTestOptions()
+	if err := applyOptions(o.fs, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !*o.verbose || *o.server != "default" {
+		t.Errorf("verbose %t, server %s", *o.verbose, *o.server)
+	}
+}
+
+func TestApplyOptionsErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, content, env, err string
+	}{
+		{"options.toml", "port = 80\nunknown = 1\n", "", `options.toml:2: unknown option "unknown"`},
+		{"options.toml", "port = eighty\n", "", `options.toml:1: invalid value "eighty" for port`},
+		{"options.ini", "port = 80\n", "", "unknown config file format"},
+		{"options.toml", "", "abc", `UB0R_PORT: invalid value "abc"`},
+	} {
+		t.Setenv("UB0R_PORT", tt.env)
+		if tt.env == "" {
+			os.Unsetenv("UB0R_PORT")
+		}
+		o := newTestOptions()
+		err := applyOptions(o.fs, writeOptionsFile(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q: error %v, want %s", tt.name, tt.content, err, tt.err)
+		}
+	}
+	if err := applyOptions(newTestOptions().fs, "/nonexistent/options.toml"); err == nil {
+		t.Error("missing config file accepted")
+	}
+}
+
+func TestPrintOptions(t *testing.T) {
+	o := newTestOptions("--mqtt-password=secret", "--config-server=http://config:8080", "--verbose")
+	var b bytes.Buffer
+	printOptions(&b, o.fs)
+	out := b.String()
+	if strings.Contains(out, "secret") {
+		t.Errorf("password printed:\n%s", out)
+	}
+	for _, want := range []string{
+		"config-server = \"http://config:8080\"\n",
+		"mqtt-password = \"********\"\n",
+		"port = 80\n",
+		"retry-initial = \"1s\"\n",
+		"verbose = true\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+
+	// round trip
+	o = newTestOptions()
+	o.fs.Set("mqtt-password", "")
+	b.Reset()
+	printOptions(&b, o.fs)
+	read, err := readToml(&b, "printed.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range read {
+		if err := setOption(newTestOptions().fs, opt.Key, opt.Value); err != nil {
+			t.Errorf("printed option not readable: %s", err)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
@@ -25,7 +27,6 @@ func (m *Manager) buildSrc(uri string) *gst.Element {
 	} else if strings.HasPrefix(uri, "pulse") {
 		src = makeElem("pulsesrc")
 		m.setDevice(src, uri)
-		// TODO add filter for stereo
 	} else {
 		src = makeElem("uridecodebin")
 		src.SetProperty("uri", uri)
@@ -36,6 +37,26 @@ func (m *Manager) buildSrc(uri string) *gst.Element {
 	return src
 }
 
+// uri schemes handled by uridecodebin in buildSrc
+var radioUriSchemes = []string{"http", "https", "mms", "mmsh", "rtsp", "rtmp", "file"}
+
+// check if buildSrc is able to handle the given uri
+func checkRadioUri(uri string) error {
+	if uri == "test" || strings.HasPrefix(uri, "alsa") || strings.HasPrefix(uri, "pulse") {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid uri '%s': %s", uri, err)
+	}
+	for _, s := range radioUriSchemes {
+		if strings.ToLower(u.Scheme) == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported uri '%s'", uri)
+}
+
 func (m *Manager) buildPipeline(uri string) {
 	src := m.buildSrc(uri)
 	pipe1 := makeElem("audioconvert")
@@ -54,7 +75,7 @@ func (m *Manager) buildPipeline(uri string) {
 	sink.SetProperty("host", s.Host)
 	sink.SetProperty("port", s.Port)
 
-	m.Pipeline = gst.NewPipeline("pipeline")
+	m.setPipeline(gst.NewPipeline("pipeline"))
 	bus := m.Pipeline.GetBus()
 	bus.AddSignalWatch()
 	bus.Connect("message", m.onMessage, nil)
@@ -68,7 +89,8 @@ func (m *Manager) buildPipeline(uri string) {
 	addElem(m.Pipeline, pipe5)
 	addElem(m.Pipeline, sink)
 	linkElems(src, pipe1)
-	linkElems(pipe1, pipe2)
+	// always stream stereo, receivers map channels on their own
+	linkFiltered(pipe1, pipe2, "audio/x-raw,channels=2")
 	linkElems(pipe2, pipe3)
 	linkElems(pipe3, pipe4)
 	linkElems(pipe4, pipe5)
@@ -76,7 +98,8 @@ func (m *Manager) buildPipeline(uri string) {
 }
 
 func (m *Manager) playPipeline(uri string) {
-	m.Pipeline = nil
+	m.setPipeline(nil)
+	m.setConnected(uri)
 	m.buildPipeline(uri)
 	m.StartPipeline()
 }
@@ -99,8 +122,8 @@ func (m *Manager) loop(l *glib.MainLoop) {
 func (m *Manager) scheduleBackendTimeout(c <-chan time.Time) {
 	for m.running {
 		log.Debug("ping config server")
-		uri := m.ConfigUri + "/api/ping/server"
-		pingConfig(uri, m.Backend)
+		m.Backend.SetStatus(m.Status())
+		m.ping()
 		<-c
 	}
 }
@@ -111,6 +134,7 @@ func (m *Manager) startSender() {
 	l := glib.NewMainLoop(nil)
 	go m.loop(l)
 	if !m.Server().Internal {
+		m.StatusPath = "/api/ping/server"
 		go m.scheduleBackendTimeout(time.Tick(backendTimeout / 2))
 	}
 	log.Debug("start gst loop")
@@ -118,6 +142,31 @@ func (m *Manager) startSender() {
 	log.Debug("sender stopped")
 }
 
+// bytes streamed and buffer level of all given senders
+func registerSenderMetrics(senders func() []*Manager) {
+	metrics.NewCollector("ub0r_sender_bytes_served_total", "Bytes streamed to receivers", kindCounter, []string{"id"},
+		func(emit func(float64, ...string)) {
+			for _, m := range senders() {
+				if v, ok := m.elemProperty("tcpserversink", "bytes-served"); ok {
+					emit(v, m.Server().Id())
+				}
+			}
+		})
+	metrics.NewCollector("ub0r_sender_buffer_bytes", "Bytes buffered before streaming", kindGauge, []string{"id"},
+		func(emit func(float64, ...string)) {
+			for _, m := range senders() {
+				if v, ok := m.elemProperty("queue2", "current-level-bytes"); ok {
+					emit(v, m.Server().Id())
+				}
+			}
+		})
+}
+
+// restart the pipeline with the server's current radio uri
+func (m *Manager) restartSender() {
+	m.NewConfig(nil)
+}
+
 func (m *Manager) stopSender() {
 	log.Info("stopping sender: %s", m.Server().Id())
 	m.running = false
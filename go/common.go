@@ -1,22 +1,51 @@
 package main
 
 import (
-	"crypto/sha1"
+	"crypto/rand"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/op/go-logging"
 )
 
+const (
+	outputAuto = "auto"
+	outputFake = "fake"
+)
+
 type Pinger interface {
 	Id() string
 	Ping()
+	SetStatus(s *Status)
 }
 
 type Radio struct {
-	Name string
-	Uri  string
+	Uid      string
+	Name     string
+	Uri      string
+	Logo     string
+	Tags     []string
+	Favorite bool
+	Order    int
+	// normalization in dB applied by receivers playing this radio
+	Gain float64
+}
+
+// state of a sender or receiver as reported by itself
+type Status struct {
+	State          string
+	Ready          bool
+	Connected      string
+	ConfigRevision int64
+	LastError      string
+	LastErrorTime  int64
+	ErrorCount     int
+	RetryCount     int
+	Failed         bool
+	Started        int64
 }
 
 type Server struct {
@@ -27,6 +56,35 @@ type Server struct {
 	LastPing int64
 	RadioId  string
 	RadioUri string
+	// agent running the sender, empty if not spawned on an agent
+	Agent string
+	// lifecycle of senders spawned by the config server and when it was entered
+	Lifecycle      string
+	LifecycleSince int64
+	// receivers tuned to the server
+	Listeners int
+	Status    *Status
+}
+
+// rtp-sender accepting senders spawned by the config server
+type Agent struct {
+	Name string
+	Host string
+	// base uri of the agent's api
+	Uri string
+	// location, e.g. a room or site, matched against receiver groups
+	Zone string
+	// maximum number of senders, 0 for no limit
+	Capacity int
+	// ids of the senders running on the agent
+	Senders  []string
+	LastPing int64
+}
+
+// radio to stream, sent to agents by the config server
+type SpawnRequest struct {
+	RadioId  string
+	RadioUri string
 }
 
 type Receiver struct {
@@ -34,22 +92,77 @@ type Receiver struct {
 	Host     string
 	LastPing int64
 	Volume   int
-	ServerId string
+	Muted    bool
+	// upper limit for volume, 0 for maxVolume
+	MaxVolume int
+	ServerId  string
+	// radio played before turning off
+	LastRadioId string
+	Group       string
+	// audio output uri, empty for the default output
+	Output string
+	// outputs available on the receiver's host
+	Outputs []string
+	// stereo, left, right or mono, empty for stereo
+	Channels string
+	// delay compensation in ms
+	Delay int
+	// equalizer gains in dB, empty for flat
+	Eq       []float64
+	Loudness bool
+	Status   *Status
+}
+
+type Schedule struct {
+	Uid         string
+	Name        string
+	Enabled     bool
+	Cron        string
+	At          int64
+	Action      string
+	RadioId     string
+	Volume      int
+	RampFrom    int
+	RampSeconds int
+	Receivers   []string
+	Group       string
+	LastRun     int64
 }
 
 type Config struct {
-	Radios        map[string]*Radio
-	Receivers     map[string]*Receiver
-	Servers       map[string]*Server
+	Revision  int64
+	Radios    map[string]*Radio
+	Receivers map[string]*Receiver
+	Servers   map[string]*Server
+	Schedules map[string]*Schedule
+	Agents    map[string]*Agent
+}
+
+// source of time, replaceable for testing
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
 }
 
+type realClock struct{}
+
 var (
 	log            = logging.MustGetLogger("main")
 	backendTimeout = 1 * time.Minute
+	// agents ping more often to get their senders re-placed quickly
+	agentHeartbeat = 5 * time.Second
 )
 
 // ----- interfaces -------------------------------
 
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
 func (e *Server) Ping() {
 	e.LastPing = time.Now().Unix()
 }
@@ -58,16 +171,100 @@ func (e *Receiver) Ping() {
 	e.LastPing = time.Now().Unix()
 }
 
+func (e *Agent) Ping() {
+	e.LastPing = time.Now().Unix()
+}
+
+func (e *Server) SetStatus(s *Status) {
+	e.Status = s
+}
+
+func (e *Receiver) SetStatus(s *Status) {
+	e.Status = s
+}
+
+// agents report their senders instead of a pipeline status
+func (e *Agent) SetStatus(s *Status) {
+}
+
+// check if the receiver is able to handle the given output uri:
+// auto, fake, alsa[:device], pulse[:sink] or file:path
+func checkOutputUri(uri string) error {
+	if uri == "" || uri == outputAuto || uri == outputFake {
+		return nil
+	}
+	parts := strings.SplitN(uri, ":", 2)
+	switch parts[0] {
+	case "alsa", "pulse":
+		return nil
+	case "file":
+		if len(parts) == 2 && strings.TrimPrefix(parts[1], "//") != "" {
+			return nil
+		}
+		return fmt.Errorf("missing path in output '%s'", uri)
+	}
+	return fmt.Errorf("unsupported output '%s'", uri)
+}
+
+func (r *Receiver) volumeLimit() int {
+	if r.MaxVolume > 0 && r.MaxVolume < maxVolume {
+		return r.MaxVolume
+	}
+	return maxVolume
+}
+
+func (r *Receiver) limitVolume(v int) int {
+	if l := r.volumeLimit(); v > l {
+		return l
+	}
+	return v
+}
+
+// settings requiring a new pipeline when changed
+func (r *Receiver) pipelineKey() string {
+	return fmt.Sprintf("%s|%s|%d", r.Output, r.Channels, r.Delay)
+}
+
+func (s *Server) failed() bool {
+	return s.Status != nil && s.Status.Failed
+}
+
 func (s *Server) Id() string {
 	return fmt.Sprintf("server-%s:%d", s.Host, s.Port)
 }
 
+// spawned by the config server for a radio, stopped when no receiver listens
+func (s *Server) managed() bool {
+	return s.Internal || s.Agent != ""
+}
+
+func (a *Agent) Id() string {
+	return fmt.Sprintf("agent-%s", a.Name)
+}
+
 func (r *Receiver) Id() string {
 	return fmt.Sprintf("receiver-%s", r.Name)
 }
 
 func (r *Radio) Id() string {
-	return fmt.Sprintf("radio-%x", sha1.Sum([]byte(r.Uri)))
+	return r.Uid
+}
+
+// nobody listening on the port
+func portFree(port int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// radio ids are independent of the uri to keep them stable while editing
+func newRadioId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("radio-%x", b)
 }
 
 // ----- logging -------------------------------
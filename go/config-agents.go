@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// sender agents are rtp-senders running senders spawned by the config server
+// new radio streams are placed on an agent chosen by the placement policy, internal senders are the fallback
+
+// placement policies
+const (
+	placementLocal       = "local"
+	placementLeastLoaded = "least-loaded"
+	placementClosest     = "closest"
+)
+
+var (
+	placement   *string
+	agentClient = &http.Client{Timeout: 10 * time.Second}
+	// agent considered gone when not pinging for this long
+	agentTimeout = 3 * agentHeartbeat
+)
+
+func checkPlacement(p string) error {
+	return checkOneOf(p, placementLocal, placementLeastLoaded, placementClosest)
+}
+
+func (c *Config) pingAgent(o *Agent) {
+	id := o.Id()
+	if _, ok := c.Agents[id]; !ok {
+		log.Info("new sender agent: %s", id)
+	}
+	c.Agents[id] = o
+	o.Ping()
+}
+
+// senders placed on the agent
+func (c *Config) agentLoad(agent_id string) int {
+	n := 0
+	for _, s := range c.Servers {
+		if s.Agent == agent_id {
+			n += 1
+		}
+	}
+	return n
+}
+
+// agents pinging recently and not running at capacity, by id
+func (c *Config) availableAgents() []*Agent {
+	threshold := time.Now().Unix() - int64(agentTimeout/time.Second)
+	l := make([]*Agent, 0, len(c.Agents))
+	for _, a := range c.Agents {
+		if a.LastPing < threshold {
+			continue
+		}
+		if a.Capacity > 0 && c.agentLoad(a.Id()) >= a.Capacity {
+			continue
+		}
+		l = append(l, a)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Id() < l[j].Id()
+	})
+	return l
+}
+
+func (c *Config) leastLoaded(agents []*Agent) *Agent {
+	var best *Agent
+	load := 0
+	for _, a := range agents {
+		if l := c.agentLoad(a.Id()); best == nil || l < load {
+			best, load = a, l
+		}
+	}
+	return best
+}
+
+// agent to place a new sender for the receiver on, nil for an internal sender
+func (c *Config) placeServer(near *Receiver) *Agent {
+	if *placement == placementLocal {
+		return nil
+	}
+	agents := c.availableAgents()
+	if *placement == placementClosest && near != nil {
+		// prefer the receiver's host, then its group's zone
+		for _, match := range []func(a *Agent) bool{
+			func(a *Agent) bool { return a.Host == near.Host },
+			func(a *Agent) bool { return near.Group != "" && a.Zone == near.Group },
+		} {
+			matched := make([]*Agent, 0)
+			for _, a := range agents {
+				if match(a) {
+					matched = append(matched, a)
+				}
+			}
+			if len(matched) > 0 {
+				return c.leastLoaded(matched)
+			}
+		}
+	}
+	return c.leastLoaded(agents)
+}
+
+func requestSender(uri string, radio *SpawnRequest) (*Server, error) {
+	b, _ := json.Marshal(radio)
+	resp, err := agentClient.Post(uri+"/api/senders", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var s Server
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func requestStop(uri, agent_id, server_id string) {
+	req, _ := http.NewRequest("DELETE", uri+"/api/senders?id="+url.QueryEscape(server_id), nil)
+	resp, err := agentClient.Do(req)
+	if err != nil {
+		log.Warning("unable to stop sender %s on agent %s: %s", server_id, agent_id, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// call with the config lock held, it is released while waiting for the agent
+func spawnOnAgent(a *Agent, radio_id string) (string, error) {
+	r, ok := config.Radios[radio_id]
+	if !ok {
+		return "", fmt.Errorf("radio not found: %s", radio_id)
+	}
+	agent_id, uri, radio_uri := a.Id(), a.Uri, r.Uri
+	log.Info("spawning new sender for radio %s on agent %s", radio_uri, agent_id)
+	configLock.Unlock()
+	s, err := requestSender(uri, &SpawnRequest{RadioId: radio_id, RadioUri: radio_uri})
+	configLock.Lock()
+	if err != nil {
+		return "", err
+	}
+	server_id := s.Id()
+
+	// the config may have changed meanwhile
+	if r, ok := config.Radios[radio_id]; !ok || r.Uri != radio_uri {
+		go requestStop(uri, agent_id, server_id)
+		return "", fmt.Errorf("radio removed or changed while spawning: %s", radio_id)
+	}
+	if other, ok := findServerWithRadio(radio_id); ok {
+		log.Info("radio %s spawned meanwhile on %s, stopping %s", radio_id, other, server_id)
+		go requestStop(uri, agent_id, server_id)
+		return other, nil
+	}
+
+	// pinging on its own from now on
+	s.Agent = agent_id
+	s.Ping()
+	s.Lifecycle = senderStarting
+	s.LifecycleSince = s.LastPing
+	config.Servers[server_id] = s
+	return server_id, nil
+}
+
+// the agent is asked without holding the config lock
+func stopOnAgent(s *Server) {
+	a, ok := config.Agents[s.Agent]
+	if !ok {
+		return
+	}
+	log.Info("stopping sender %s on agent %s", s.Id(), a.Id())
+	go requestStop(a.Uri, a.Id(), s.Id())
+}
+
+// spawn a new sender for the receivers of a lost or replaced one
+func replaceServer(server_id string) {
+	s, ok := config.Servers[server_id]
+	if !ok {
+		return
+	}
+	delete(config.Servers, server_id)
+	replaceReceivers(server_id, s.RadioId)
+}
+
+// move receivers of a removed sender to a new one for the radio
+func replaceReceivers(server_id, radio_id string) {
+	for _, r := range config.Receivers {
+		if r.ServerId == server_id {
+			log.Info("re-placing %s for receiver %s", server_id, r.Id())
+			id, err := findOrSpawnServer(radio_id, r)
+			if err != nil {
+				id = "off"
+			}
+			r.ServerId = id
+		}
+	}
+}
+
+// re-place senders of agents gone or restarted without them
+func checkAgents() {
+	threshold := time.Now().Unix() - int64(agentTimeout/time.Second)
+	changed := false
+	for k, a := range config.Agents {
+		if a.LastPing < threshold {
+			log.Info("remove possibly dead agent: %s", k)
+			delete(config.Agents, k)
+			changed = true
+		}
+	}
+	lost := make([]string, 0)
+	for k, s := range config.Servers {
+		if s.Agent == "" {
+			continue
+		}
+		a, ok := config.Agents[s.Agent]
+		if !ok {
+			lost = append(lost, k)
+			continue
+		}
+		running := false
+		for _, id := range a.Senders {
+			running = running || id == k
+		}
+		// senders spawned since the agent's last ping are missing in its list
+		if !running && s.LastPing < a.LastPing {
+			lost = append(lost, k)
+		}
+	}
+	for _, k := range lost {
+		replaceServer(k)
+	}
+	if changed || len(lost) > 0 {
+		notifyNewConfig()
+	}
+}
+
+func scheduleAgentTimeout(c <-chan time.Time) {
+	for range c {
+		if isLeader() {
+			configLock.Lock()
+			checkAgents()
+			configLock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// agent spawning senders on consecutive ports, recording whether the config lock was held meanwhile
+type fakeAgent struct {
+	*httptest.Server
+	lock    sync.Mutex
+	port    int
+	spawned []string
+	stopped []string
+	locked  bool
+}
+
+func newFakeAgent() *fakeAgent {
+	f := &fakeAgent{port: 48200}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeAgent) serve(w http.ResponseWriter, req *http.Request) {
+	released := make(chan bool)
+	go func() {
+		configLock.Lock()
+		configLock.Unlock()
+		close(released)
+	}()
+	locked := false
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		locked = true
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.locked = f.locked || locked
+	switch req.Method {
+	case "POST":
+		var r SpawnRequest
+		json.NewDecoder(req.Body).Decode(&r)
+		s := &Server{Name: "agent-host", Host: "agent-host", Port: f.port, RadioId: r.RadioId, RadioUri: r.RadioUri}
+		f.port += 1
+		f.spawned = append(f.spawned, s.Id())
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	case "DELETE":
+		f.stopped = append(f.stopped, req.URL.Query().Get("id"))
+	}
+}
+
+func (f *fakeAgent) requests() ([]string, []string, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.spawned, f.stopped, f.locked
+}
+
+func setPlacement(t *testing.T, p string) {
+	old := placement
+	placement = &p
+	t.Cleanup(func() { placement = old })
+}
+
+func addAgent(name, uri string) *Agent {
+	a := &Agent{Name: name, Host: "agent-host", Uri: uri}
+	a.Ping()
+	config.Agents[a.Id()] = a
+	return a
+}
+
+func TestPlaceServer(t *testing.T) {
+	config = NewConfig()
+	now := time.Now().Unix()
+	for _, a := range []*Agent{
+		{Name: "a", Host: "h1", Zone: "upstairs", LastPing: now},
+		{Name: "b", Host: "h2", Zone: "downstairs", LastPing: now},
+		{Name: "c", Host: "h3", LastPing: now - int64(agentTimeout/time.Second) - 1},
+		{Name: "d", Host: "h4", Capacity: 1, LastPing: now},
+		{Name: "e", Host: "h5", LastPing: now},
+	} {
+		config.Agents[a.Id()] = a
+	}
+	for i, agent := range []string{"agent-a", "agent-a", "agent-b", "agent-d", "agent-e"} {
+		s := &Server{Agent: agent, Host: "host", Port: 48100 + i}
+		config.Servers[s.Id()] = s
+	}
+
+	for _, tt := range []struct {
+		policy string
+		near   *Receiver
+		want   string
+	}{
+		{placementLocal, &Receiver{Host: "h1"}, ""},
+		// lowest id wins equal loads, stale and full agents are skipped
+		{placementLeastLoaded, nil, "agent-b"},
+		{placementLeastLoaded, &Receiver{Host: "h1"}, "agent-b"},
+		{placementClosest, &Receiver{Host: "h1"}, "agent-a"},
+		{placementClosest, &Receiver{Host: "hx", Group: "upstairs"}, "agent-a"},
+		{placementClosest, &Receiver{Host: "h5", Group: "upstairs"}, "agent-e"},
+		{placementClosest, &Receiver{Host: "hx", Group: "garden"}, "agent-b"},
+		{placementClosest, &Receiver{Host: "h3"}, "agent-b"},
+		{placementClosest, &Receiver{Host: "h4"}, "agent-b"},
+		{placementClosest, nil, "agent-b"},
+	} {
+		setPlacement(t, tt.policy)
+		got := ""
+		if a := config.placeServer(tt.near); a != nil {
+			got = a.Id()
+		}
+		if got != tt.want {
+			t.Errorf("%s near %+v: placed on %q, want %q", tt.policy, tt.near, got, tt.want)
+		}
+	}
+
+	// no agent available
+	setPlacement(t, placementLeastLoaded)
+	config.Agents = map[string]*Agent{"agent-c": {Name: "c", LastPing: 0}}
+	if a := config.placeServer(nil); a != nil {
+		t.Errorf("placed on stale agent %s", a.Id())
+	}
+}
+
+func TestReplaceLostServer(t *testing.T) {
+	setPlacement(t, placementLeastLoaded)
+	config = NewConfig()
+	agent := newFakeAgent()
+	defer agent.Close()
+	addAgent("a", agent.URL)
+	config.Radios["radio-1"] = &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one"}
+	lost := &Server{Agent: "agent-gone", Host: "gone", Port: 48100, RadioId: "radio-1"}
+	config.Servers[lost.Id()] = lost
+	r := &Receiver{Name: "kitchen", ServerId: lost.Id()}
+	config.Receivers[r.Id()] = r
+
+	configLock.Lock()
+	checkAgents()
+	configLock.Unlock()
+
+	spawned, _, locked := agent.requests()
+	if len(spawned) != 1 || r.ServerId != spawned[0] {
+		t.Fatalf("receiver on %s, spawned %v", r.ServerId, spawned)
+	}
+	if locked {
+		t.Error("config locked while spawning on the agent")
+	}
+	if config.hasServer(lost.Id()) {
+		t.Error("lost server still configured")
+	}
+	if s := config.Servers[r.ServerId]; s.Agent != "agent-a" || s.Lifecycle != senderStarting {
+		t.Errorf("re-placed server on %q, %s", s.Agent, s.Lifecycle)
+	}
+}
+
+func TestRestartServersOnAgents(t *testing.T) {
+	setPlacement(t, placementLeastLoaded)
+	config = NewConfig()
+	agent := newFakeAgent()
+	defer agent.Close()
+	addAgent("a", agent.URL)
+	radio := &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one"}
+	config.Radios[radio.Id()] = radio
+	// a failed one is stopped when spawning for the other
+	ok := &Server{Agent: "agent-a", Host: "agent-host", Port: 48100, RadioId: "radio-1"}
+	failed := &Server{Agent: "agent-a", Host: "agent-host", Port: 48101, RadioId: "radio-1", Status: &Status{Failed: true}}
+	config.Servers[ok.Id()] = ok
+	config.Servers[failed.Id()] = failed
+	r1 := &Receiver{Name: "kitchen", ServerId: ok.Id()}
+	r2 := &Receiver{Name: "hall", ServerId: failed.Id()}
+	config.Receivers[r1.Id()] = r1
+	config.Receivers[r2.Id()] = r2
+
+	configLock.Lock()
+	radio.Uri = "http://example.com/one-new"
+	restartServersWithRadio(radio)
+	configLock.Unlock()
+
+	spawned, _, _ := agent.requests()
+	if len(spawned) != 1 || r1.ServerId != spawned[0] || r2.ServerId != spawned[0] {
+		t.Fatalf("receivers on %s and %s, spawned %v", r1.ServerId, r2.ServerId, spawned)
+	}
+	if s := config.Servers[spawned[0]]; s.RadioUri != radio.Uri {
+		t.Errorf("spawned with %s, want %s", s.RadioUri, radio.Uri)
+	}
+	if len(config.Servers) != 1 {
+		t.Errorf("%d servers, want 1", len(config.Servers))
+	}
+	// stopped asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, stopped, _ := agent.requests()
+		if len(stopped) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stopped %v, want both old servers", stopped)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSpawnOnAgentRadioRemoved(t *testing.T) {
+	config = NewConfig()
+	agent := newFakeAgent()
+	defer agent.Close()
+	a := addAgent("a", agent.URL)
+	config.Radios["radio-1"] = &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one"}
+
+	// removed while the agent spawns
+	removed := make(chan bool)
+	go func() {
+		configLock.Lock()
+		delete(config.Radios, "radio-1")
+		configLock.Unlock()
+		close(removed)
+	}()
+	configLock.Lock()
+	time.Sleep(10 * time.Millisecond)
+	_, err := spawnOnAgent(a, "radio-1")
+	configLock.Unlock()
+	<-removed
+	if err == nil {
+		t.Error("spawned sender for removed radio")
+	}
+	if len(config.Servers) != 0 {
+		t.Errorf("servers %v", config.Servers)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// several config servers replicating the config, primary/backup style
+// the leader owns internal senders and handles all changes, followers forward changes to it
+// the reachable node with the lowest uri becomes leader when the leader is gone, a higher term wins
+
+const (
+	clusterHeartbeat = 2 * time.Second
+	// leader considered gone when not seen for this long
+	electionTimeout = 3 * clusterHeartbeat
+)
+
+var (
+	clusterLeader = metrics.NewGauge("ub0r_cluster_leader", "1 if this config server is the cluster leader")
+	clusterTerm   = metrics.NewGauge("ub0r_cluster_term", "Current election term")
+)
+
+// nil when running as a single config server
+var cluster *Cluster
+
+// state of a config server as reported by GET /api/cluster
+type NodeState struct {
+	Uri      string
+	Leader   string
+	Term     int64
+	Revision int64
+	Alive    bool
+	LastSeen int64
+}
+
+type ClusterState struct {
+	NodeState
+	Peers []*NodeState
+}
+
+// config pushed from leader to followers
+type Replication struct {
+	Leader string
+	Term   int64
+	Config *Config
+}
+
+type Cluster struct {
+	Uri    string
+	Peers  map[string]*NodeState
+	Term   int64
+	Leader string
+	lock   sync.Mutex
+	client *http.Client
+	proxy  *httputil.ReverseProxy
+	// forwarding target of proxy
+	proxied string
+}
+
+func NewCluster(uri string, peers []string) *Cluster {
+	c := &Cluster{
+		Uri:    uri,
+		Peers:  make(map[string]*NodeState),
+		client: &http.Client{Timeout: clusterHeartbeat / 2},
+	}
+	for _, p := range peers {
+		c.Peers[p] = &NodeState{Uri: p}
+	}
+	return c
+}
+
+// true for single config servers
+func isLeader() bool {
+	return cluster == nil || cluster.isLeader()
+}
+
+func (c *Cluster) isLeader() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Leader == c.Uri
+}
+
+func (c *Cluster) leader() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Leader
+}
+
+// revision of the local config, read by callers holding the config lock
+func (c *Cluster) state(revision int64) *ClusterState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s := &ClusterState{NodeState{c.Uri, c.Leader, c.Term, revision, true, time.Now().Unix()}, nil}
+	s.Peers = make([]*NodeState, 0, len(c.Peers))
+	for _, p := range c.Peers {
+		peer := *p
+		s.Peers = append(s.Peers, &peer)
+	}
+	sort.Slice(s.Peers, func(i, j int) bool {
+		return s.Peers[i].Uri < s.Peers[j].Uri
+	})
+	return s
+}
+
+// Election ----------------------------------------
+
+func (c *Cluster) poll(p *NodeState) {
+	var s ClusterState
+	resp, err := c.client.Get(p.Uri + "/api/cluster")
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&s)
+		resp.Body.Close()
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err != nil {
+		if p.Alive {
+			log.Warning("config server %s unreachable: %s", p.Uri, err)
+		}
+		p.Alive = false
+		return
+	}
+	if !p.Alive {
+		log.Info("config server %s reachable", p.Uri)
+	}
+	p.Alive = true
+	p.LastSeen = time.Now().Unix()
+	p.Leader = s.Leader
+	p.Term = s.Term
+	p.Revision = s.Revision
+}
+
+func (c *Cluster) pollPeers() {
+	var wg sync.WaitGroup
+	for _, p := range c.Peers {
+		wg.Add(1)
+		go func(p *NodeState) {
+			c.poll(p)
+			wg.Done()
+		}(p)
+	}
+	wg.Wait()
+}
+
+// decide who leads, returns whether this node led before and leads now
+func (c *Cluster) elect() (bool, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	was := c.Leader == c.Uri
+	now := time.Now().Unix()
+
+	// follow peers leading with a higher term, equal terms are won by the lower uri
+	for _, p := range c.Peers {
+		if !p.Alive || p.Leader != p.Uri {
+			continue
+		}
+		if p.Term > c.Term || (p.Term == c.Term && p.Uri != c.Leader && (c.Leader == "" || p.Uri < c.Leader)) {
+			log.Info("following leader %s, term %d", p.Uri, p.Term)
+			c.Leader = p.Uri
+			c.Term = p.Term
+		}
+	}
+
+	if c.Leader != "" && c.Leader != c.Uri {
+		p, ok := c.Peers[c.Leader]
+		if !ok || !p.Alive || p.Leader != p.Uri || now-p.LastSeen > int64(electionTimeout/time.Second) {
+			log.Warning("leader %s gone", c.Leader)
+			c.Leader = ""
+		}
+	}
+
+	if c.Leader == "" {
+		// the reachable node with the lowest uri takes over
+		lowest := c.Uri
+		term := c.Term
+		for _, p := range c.Peers {
+			if p.Alive && p.Uri < lowest {
+				lowest = p.Uri
+			}
+			if p.Term > term {
+				term = p.Term
+			}
+		}
+		if lowest == c.Uri {
+			c.Term = term + 1
+			c.Leader = c.Uri
+			log.Info("leading the cluster, term %d", c.Term)
+		}
+	}
+	clusterTerm.Set(float64(c.Term))
+	return was, c.Leader == c.Uri
+}
+
+// leader if this node is behind the given revision of the local config
+func (c *Cluster) behind(revision int64) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p, ok := c.Peers[c.Leader]
+	return c.Leader, ok && p.Revision > revision
+}
+
+func (c *Cluster) loop() {
+	for range time.Tick(clusterHeartbeat) {
+		c.pollPeers()
+		was, now := c.elect()
+		if !was && now {
+			clusterLeader.Set(1)
+			// replicated to followers as any change
+			configLock.Lock()
+			takeOverInternalServers()
+			configLock.Unlock()
+		} else if was && !now {
+			clusterLeader.Set(0)
+			configLock.Lock()
+			stopInternalServers()
+			configLock.Unlock()
+		} else if !now {
+			configLock.Lock()
+			revision := config.Revision
+			configLock.Unlock()
+			if leader, ok := c.behind(revision); ok {
+				c.fetch(leader)
+			}
+		}
+	}
+}
+
+// Replication -------------------------------------
+
+// replace the config with the leader's, without bumping its revision
+func applyConfig(c *Config) {
+	if c.Schedules == nil {
+		c.Schedules = make(map[string]*Schedule)
+	}
+	if c.Agents == nil {
+		c.Agents = make(map[string]*Agent)
+	}
+	config = *c
+	configBroker.Publish()
+}
+
+// pull the config from the leader
+func (c *Cluster) fetch(leader string) {
+	var cfg Config
+	resp, err := c.client.Get(leader + "/api/config")
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&cfg)
+		resp.Body.Close()
+	}
+	if err != nil {
+		log.Error("error fetching config from leader %s: %s", leader, err)
+		return
+	}
+	log.Debug("replicated config revision %d from %s", cfg.Revision, leader)
+	configLock.Lock()
+	applyConfig(&cfg)
+	configLock.Unlock()
+}
+
+// push the config to all reachable followers
+func (c *Cluster) replicate() {
+	c.lock.Lock()
+	r := Replication{c.Leader, c.Term, &config}
+	peers := make([]string, 0, len(c.Peers))
+	for _, p := range c.Peers {
+		if p.Alive {
+			peers = append(peers, p.Uri)
+		}
+	}
+	c.lock.Unlock()
+	if r.Leader != c.Uri {
+		return
+	}
+	configLock.Lock()
+	b, err := json.Marshal(r)
+	configLock.Unlock()
+	if err != nil {
+		log.Error("error writing json: %v", err)
+		return
+	}
+	for _, p := range peers {
+		go func(p string) {
+			resp, err := c.client.Post(p+"/api/cluster/config", "application/json", bytes.NewReader(b))
+			if err != nil {
+				log.Debug("error replicating config to %s: %s", p, err)
+				return
+			}
+			resp.Body.Close()
+		}(p)
+	}
+}
+
+// push every change of the config while leading
+func (c *Cluster) watchConfig() {
+	changes := configBroker.Subscribe()
+	for range changes {
+		if c.isLeader() {
+			c.replicate()
+		}
+	}
+}
+
+func (c *Cluster) start() {
+	go c.loop()
+	go c.watchConfig()
+}
+
+// Internal servers --------------------------------
+
+// internal servers of the previous leader are gone with it, spawn own ones for their receivers
+// senders on agents keep running
+func takeOverInternalServers() {
+	for k, s := range config.Servers {
+		if !s.Internal {
+			continue
+		}
+		if _, ok := managers[k]; ok {
+			continue
+		}
+		delete(config.Servers, k)
+		for _, r := range config.Receivers {
+			if r.ServerId == k {
+				log.Info("taking over %s for receiver %s", k, r.Id())
+				id, err := findOrSpawnServer(s.RadioId, r)
+				if err != nil {
+					id = "off"
+				}
+				r.ServerId = id
+			}
+		}
+	}
+	notifyNewConfig()
+}
+
+// followers don't stream, the leader spawns its own internal servers
+func stopInternalServers() {
+	for k := range managers {
+		log.Info("stepping down, stopping internal server %s", k)
+		stopServer(k)
+	}
+}
+
+// Forwarding --------------------------------------
+
+// requests changing the config are handled by the leader
+func forwardToLeader(req *http.Request) bool {
+	if isLeader() || strings.HasPrefix(req.URL.Path, "/api/cluster") {
+		return false
+	}
+	if !strings.HasPrefix(req.URL.Path, "/api/") && !strings.HasPrefix(req.URL.Path, "/ui/") {
+		return false
+	}
+	// receiver api calls change the config with GET requests
+	return req.Method != "GET" || req.URL.Path == "/api/receiver"
+}
+
+func (c *Cluster) forward(w http.ResponseWriter, req *http.Request) {
+	leader := c.leader()
+	if leader == "" {
+		http.Error(w, "no leading config server", http.StatusServiceUnavailable)
+		return
+	}
+	c.lock.Lock()
+	if c.proxied != leader {
+		u, _ := url.Parse(leader)
+		c.proxy = httputil.NewSingleHostReverseProxy(u)
+		c.proxied = leader
+	}
+	proxy := c.proxy
+	c.lock.Unlock()
+	log.Debug("forwarding %s %s to leader %s", req.Method, req.URL.Path, leader)
+	proxy.ServeHTTP(w, req)
+}
+
+// GET /api/cluster
+// POST /api/cluster/config
+func serveApiCluster(w http.ResponseWriter, req *http.Request) *ServeError {
+	if cluster == nil {
+		return NewError("not running in a cluster", http.StatusNotFound)
+	}
+	if req.Method == "GET" && req.URL.Path == "/api/cluster" {
+		return serveJson(w, req, cluster.state(config.Revision))
+	} else if req.Method == "POST" && req.URL.Path == "/api/cluster/config" {
+		var r Replication
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil || r.Config == nil {
+			return NewError(fmt.Sprintf("invalid replication: %v", err), http.StatusBadRequest)
+		}
+		cluster.lock.Lock()
+		accept := r.Leader != cluster.Uri && r.Term >= cluster.Term && (r.Leader == cluster.Leader || r.Term > cluster.Term)
+		cluster.lock.Unlock()
+		if !accept {
+			return NewError(fmt.Sprintf("not following %s in term %d", r.Leader, r.Term), http.StatusConflict)
+		}
+		log.Debug("replicated config revision %d from %s", r.Config.Revision, r.Leader)
+		applyConfig(r.Config)
+		return nil
+	}
+	return NewError(fmt.Sprintf("unknown path: %s", req.URL.Path), http.StatusNotFound)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestElect(t *testing.T) {
+	now := time.Now().Unix()
+	stale := now - int64(electionTimeout/time.Second) - 1
+	for _, tt := range []struct {
+		name   string
+		leader string
+		term   int64
+		peers  []NodeState
+		was    bool
+		now    bool
+		want   string
+		term2  int64
+	}{
+		{"alone", "", 0, nil,
+			false, true, "http://b", 1},
+		{"lowest takes over", "", 2, []NodeState{
+			{Uri: "http://c", Alive: true, Term: 3},
+		}, false, true, "http://b", 4},
+		{"lower peer takes over", "", 2, []NodeState{
+			{Uri: "http://a", Alive: true, Term: 2},
+		}, false, false, "", 2},
+		{"unreachable lower peer", "", 2, []NodeState{
+			{Uri: "http://a", Term: 2},
+		}, false, true, "http://b", 3},
+		{"follow leader", "", 0, []NodeState{
+			{Uri: "http://c", Leader: "http://c", Alive: true, Term: 4, LastSeen: now},
+		}, false, false, "http://c", 4},
+		{"leader lost", "http://a", 3, []NodeState{
+			{Uri: "http://a", Leader: "http://a", Term: 3, LastSeen: now},
+			{Uri: "http://c", Leader: "http://a", Alive: true, Term: 3, LastSeen: now},
+		}, false, true, "http://b", 4},
+		{"leader not seen", "http://a", 3, []NodeState{
+			{Uri: "http://a", Leader: "http://a", Alive: true, Term: 3, LastSeen: stale},
+		}, false, false, "", 3},
+		{"leader stepped down", "http://a", 3, []NodeState{
+			{Uri: "http://a", Leader: "", Alive: true, Term: 3, LastSeen: now},
+		}, false, false, "", 3},
+		{"equal term lower uri wins", "http://b", 3, []NodeState{
+			{Uri: "http://a", Leader: "http://a", Alive: true, Term: 3, LastSeen: now},
+		}, true, false, "http://a", 3},
+		{"equal term higher uri loses", "http://b", 3, []NodeState{
+			{Uri: "http://c", Leader: "http://c", Alive: true, Term: 3, LastSeen: now},
+		}, true, true, "http://b", 3},
+		{"higher term wins", "http://b", 3, []NodeState{
+			{Uri: "http://c", Leader: "http://c", Alive: true, Term: 5, LastSeen: now},
+		}, true, false, "http://c", 5},
+		{"lower term loses", "http://b", 3, []NodeState{
+			{Uri: "http://a", Leader: "http://a", Alive: true, Term: 2, LastSeen: now},
+		}, true, true, "http://b", 3},
+		{"leader keeps leading", "http://b", 3, []NodeState{
+			{Uri: "http://a", Leader: "http://b", Alive: true, Term: 3, LastSeen: now},
+		}, true, true, "http://b", 3},
+	} {
+		c := NewCluster("http://b", nil)
+		c.Leader = tt.leader
+		c.Term = tt.term
+		for i := range tt.peers {
+			p := tt.peers[i]
+			c.Peers[p.Uri] = &p
+		}
+		was, now := c.elect()
+		if was != tt.was || now != tt.now {
+			t.Errorf("%s: led %t, leads %t, want %t, %t", tt.name, was, now, tt.was, tt.now)
+		}
+		if c.Leader != tt.want || c.Term != tt.term2 {
+			t.Errorf("%s: leader %q term %d, want %q term %d", tt.name, c.Leader, c.Term, tt.want, tt.term2)
+		}
+	}
+}
+
+func TestMqttCommandOnFollower(t *testing.T) {
+	r := newMqttTestConfig()
+	cluster = NewCluster("http://b", []string{"http://a"})
+	cluster.Leader = "http://a"
+	defer func() { cluster = nil }()
+
+	b := NewMqttBridge(&MqttClient{}, "ub0r")
+	b.onMessage("ub0r/receiver/receiver-kitchen/set/radio", []byte("radio-1"))
+	if r.ServerId != "off" || len(config.Servers) != 1 {
+		t.Errorf("follower handled command: receiver on %s, %d servers", r.ServerId, len(config.Servers))
+	}
+
+	cluster.Leader = "http://b"
+	b.onMessage("ub0r/receiver/receiver-kitchen/set/volume", []byte("30"))
+	if r.Volume != 30 {
+		t.Errorf("leader ignored command, volume %d", r.Volume)
+	}
+}
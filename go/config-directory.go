@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	directoryUserAgent = "ub0r-streaming"
+	directoryLimit     = 20
+)
+
+// station as returned by a Radio-Browser compatible directory
+type DirectoryStation struct {
+	StationUuid string `json:"stationuuid"`
+	Name        string `json:"name"`
+	Url         string `json:"url"`
+	UrlResolved string `json:"url_resolved"`
+	Homepage    string `json:"homepage"`
+	Favicon     string `json:"favicon"`
+	Tags        string `json:"tags"`
+	Country     string `json:"country"`
+	Codec       string `json:"codec"`
+	Bitrate     int    `json:"bitrate"`
+}
+
+// search result presented to the user
+type DirectoryCandidate struct {
+	Id       string
+	Name     string
+	Uri      string
+	Homepage string
+	Favicon  string
+	Tags     []string
+	Country  string
+	Codec    string
+	Bitrate  int
+}
+
+type DirectoryQuery struct {
+	Name    string
+	Tag     string
+	Country string
+	Limit   int
+}
+
+// Directory ---------------------------------------
+
+func (s *DirectoryStation) Uri() string {
+	if s.UrlResolved != "" {
+		return s.UrlResolved
+	}
+	return s.Url
+}
+
+// favicons are shown in the ui, only accept plain web links
+func (s *DirectoryStation) FaviconUri() string {
+	if strings.HasPrefix(s.Favicon, "http://") || strings.HasPrefix(s.Favicon, "https://") {
+		return s.Favicon
+	}
+	return ""
+}
+
+func (s *DirectoryStation) TagList() []string {
+	tags := make([]string, 0)
+	for _, t := range strings.Split(s.Tags, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+func (s *DirectoryStation) Candidate() *DirectoryCandidate {
+	return &DirectoryCandidate{
+		Id:       s.StationUuid,
+		Name:     strings.TrimSpace(s.Name),
+		Uri:      s.Uri(),
+		Homepage: s.Homepage,
+		Favicon:  s.FaviconUri(),
+		Tags:     s.TagList(),
+		Country:  s.Country,
+		Codec:    s.Codec,
+		Bitrate:  s.Bitrate,
+	}
+}
+
+func (s *DirectoryStation) Radio() *Radio {
+	return &Radio{
+		Name: strings.TrimSpace(s.Name),
+		Uri:  s.Uri(),
+		Logo: s.FaviconUri(),
+		Tags: s.TagList(),
+	}
+}
+
+func (s *DirectoryStation) matches(q *DirectoryQuery) bool {
+	if q.Name != "" && !strings.Contains(strings.ToLower(s.Name), strings.ToLower(q.Name)) {
+		return false
+	}
+	if q.Country != "" && !strings.EqualFold(s.Country, q.Country) {
+		return false
+	}
+	if q.Tag != "" {
+		found := false
+		for _, t := range s.TagList() {
+			if strings.EqualFold(t, q.Tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// a directory is either a Radio-Browser compatible http api or a local json file
+// holding a list of stations in the same format, e.g. for offline use or testing
+func isLocalDirectory(base string) bool {
+	return !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://")
+}
+
+func loadLocalDirectory(base string) ([]*DirectoryStation, error) {
+	d, err := ioutil.ReadFile(strings.TrimPrefix(base, "file://"))
+	if err != nil {
+		return nil, err
+	}
+	var stations []*DirectoryStation
+	err = json.Unmarshal(d, &stations)
+	return stations, err
+}
+
+func fetchDirectory(uri string) ([]*DirectoryStation, error) {
+	log.Debug("fetch directory: %s", uri)
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", directoryUserAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("directory returned %s", resp.Status)
+	}
+
+	var stations []*DirectoryStation
+	err = json.NewDecoder(resp.Body).Decode(&stations)
+	return stations, err
+}
+
+func searchDirectory(base string, q *DirectoryQuery) ([]*DirectoryStation, error) {
+	if isLocalDirectory(base) {
+		all, err := loadLocalDirectory(base)
+		if err != nil {
+			return nil, err
+		}
+		stations := make([]*DirectoryStation, 0)
+		for _, s := range all {
+			if len(stations) >= q.Limit {
+				break
+			}
+			if s.matches(q) {
+				stations = append(stations, s)
+			}
+		}
+		return stations, nil
+	}
+
+	v := url.Values{}
+	v.Set("name", q.Name)
+	v.Set("tag", q.Tag)
+	v.Set("country", q.Country)
+	v.Set("limit", strconv.Itoa(q.Limit))
+	v.Set("hidebroken", "true")
+	v.Set("order", "clickcount")
+	v.Set("reverse", "true")
+	return fetchDirectory(strings.TrimRight(base, "/") + "/json/stations/search?" + v.Encode())
+}
+
+func lookupDirectory(base string, ids []string) ([]*DirectoryStation, error) {
+	if isLocalDirectory(base) {
+		all, err := loadLocalDirectory(base)
+		if err != nil {
+			return nil, err
+		}
+		stations := make([]*DirectoryStation, 0)
+		for _, s := range all {
+			for _, id := range ids {
+				if s.StationUuid == id {
+					stations = append(stations, s)
+					break
+				}
+			}
+		}
+		return stations, nil
+	}
+
+	v := url.Values{}
+	v.Set("uuids", strings.Join(ids, ","))
+	return fetchDirectory(strings.TrimRight(base, "/") + "/json/stations/byuuid?" + v.Encode())
+}
+
+// HTTP --------------------------------------------
+
+// GET /api/directory?name=${name}&tag=${tag}&country=${country}&limit=${limit}
+func serveApiDirectorySearch(w http.ResponseWriter, req *http.Request) *ServeError {
+	q := DirectoryQuery{
+		Name:    req.URL.Query().Get("name"),
+		Tag:     req.URL.Query().Get("tag"),
+		Country: req.URL.Query().Get("country"),
+		Limit:   directoryLimit,
+	}
+	if limit := req.URL.Query().Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l <= 0 {
+			return NewError(fmt.Sprintf("invalid limit '%s'", limit), http.StatusBadRequest)
+		}
+		q.Limit = l
+	}
+	log.Debug("/api/directory query: %s", q)
+
+	stations, err := searchDirectory(*directoryUri, &q)
+	if err != nil {
+		return NewError(fmt.Sprintf("error searching directory: %s", err), http.StatusBadGateway)
+	}
+
+	candidates := make([]*DirectoryCandidate, 0)
+	for _, s := range stations {
+		if s.Uri() != "" {
+			candidates = append(candidates, s.Candidate())
+		}
+	}
+	return serveJson(w, req, candidates)
+}
+
+// POST /api/directory ["${station-id}", ...]
+func serveApiDirectoryImport(w http.ResponseWriter, req *http.Request) *ServeError {
+	var ids []string
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&ids); err != nil {
+		return NewError(fmt.Sprintf("somthing went wrong parsing body: %s", err), http.StatusBadRequest)
+	}
+	if len(ids) == 0 {
+		return NewError("no station selected", http.StatusBadRequest)
+	}
+	log.Debug("/api/directory import: %s", ids)
+
+	stations, err := lookupDirectory(*directoryUri, ids)
+	if err != nil {
+		return NewError(fmt.Sprintf("error reading directory: %s", err), http.StatusBadGateway)
+	}
+
+	// the directory is queried without holding the lock, adding radios needs it
+	configLock.Lock()
+	radios := make([]Radio, 0)
+	for _, s := range stations {
+		if err := checkRadioUri(s.Uri()); err != nil {
+			log.Warning("skipping station %s: %s", s.StationUuid, err)
+			continue
+		}
+		r := s.Radio()
+		log.Info("importing radio from directory: %s", r.Uri)
+		config.addRadio(r)
+		radios = append(radios, *r)
+	}
+	if len(radios) > 0 {
+		notifyNewConfig()
+	}
+	configLock.Unlock()
+	if len(radios) == 0 {
+		return NewError("station not found", http.StatusNotFound)
+	}
+	return serveJson(w, req, radios)
+}
+
+// GET  /api/directory?name=${name}
+// POST /api/directory
+func serveApiDirectory(w http.ResponseWriter, req *http.Request) *ServeError {
+	if req.Method == "GET" {
+		return serveApiDirectorySearch(w, req)
+	} else if req.Method == "POST" {
+		return serveApiDirectoryImport(w, req)
+	} else {
+		return NewError(fmt.Sprintf("method not allowed: %s", req.Method), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// keep idle streams from being closed by proxies and detect dead clients
+var heartbeatInterval = 30 * time.Second
+
+// config sections clients may subscribe to
+var configSections = []string{"radios", "receivers", "servers", "schedules", "agents"}
+
+// Broker ------------------------------------------
+
+// notifies subscribers about config changes
+type ConfigBroker struct {
+	lock        sync.Mutex
+	subscribers map[chan bool]bool
+}
+
+func NewConfigBroker() *ConfigBroker {
+	return &ConfigBroker{subscribers: make(map[chan bool]bool)}
+}
+
+// changes are signalled on the returned channel, unsubscribe when done
+func (b *ConfigBroker) Subscribe() chan bool {
+	c := make(chan bool, 1)
+	b.lock.Lock()
+	b.subscribers[c] = true
+	b.lock.Unlock()
+	return c
+}
+
+func (b *ConfigBroker) Unsubscribe(c chan bool) {
+	b.lock.Lock()
+	delete(b.subscribers, c)
+	b.lock.Unlock()
+}
+
+// signal all subscribers, a pending signal covers further changes of slow subscribers
+func (b *ConfigBroker) Publish() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for c := range b.subscribers {
+		select {
+		case c <- true:
+		default:
+		}
+	}
+}
+
+func (b *ConfigBroker) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.subscribers)
+}
+
+// Filtering ---------------------------------------
+
+// parts of the config a client is interested in
+type ConfigFilter struct {
+	// only this receiver and its server
+	Receiver string
+	// sections to send, all if empty
+	Sections map[string]bool
+}
+
+// ?receiver=${receiver-id}&only=${section},...
+func parseConfigFilter(req *http.Request) (*ConfigFilter, error) {
+	q := req.URL.Query()
+	f := &ConfigFilter{Receiver: q.Get("receiver"), Sections: make(map[string]bool)}
+	if only := q.Get("only"); only != "" {
+		for _, s := range strings.Split(only, ",") {
+			s = strings.ToLower(strings.TrimSpace(s))
+			if err := checkOneOf(s, configSections...); err != nil {
+				return nil, fmt.Errorf("invalid section: %s", err)
+			}
+			f.Sections[s] = true
+		}
+	}
+	return f, nil
+}
+
+func (f *ConfigFilter) wants(section string) bool {
+	return len(f.Sections) == 0 || f.Sections[section]
+}
+
+// filtered copy of the config, sections not subscribed to are left out
+func (f *ConfigFilter) apply(c *Config) map[string]interface{} {
+	view := map[string]interface{}{"Revision": c.Revision}
+	receivers, servers := c.Receivers, c.Servers
+	if f.Receiver != "" {
+		receivers = make(map[string]*Receiver)
+		servers = make(map[string]*Server)
+		if r, ok := c.Receivers[f.Receiver]; ok {
+			receivers[f.Receiver] = r
+			if s, ok := c.Servers[r.ServerId]; ok {
+				servers[r.ServerId] = s
+			}
+		}
+	}
+	if f.wants("radios") {
+		view["Radios"] = c.Radios
+	}
+	if f.wants("receivers") {
+		view["Receivers"] = receivers
+	}
+	if f.wants("servers") {
+		view["Servers"] = servers
+	}
+	if f.wants("schedules") {
+		view["Schedules"] = c.Schedules
+	}
+	if f.wants("agents") {
+		view["Agents"] = c.Agents
+	}
+	return view
+}
+
+// json of the filtered config without revision, to skip changes of other parts
+func (f *ConfigFilter) content(c *Config) (string, error) {
+	view := f.apply(c)
+	delete(view, "Revision")
+	b, err := json.Marshal(view)
+	return string(b), err
+}
+
+// Transports --------------------------------------
+
+// closed when the peer closes the connection, clients never send anything
+func closedByPeer(r io.Reader) <-chan bool {
+	closed := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		close(closed)
+	}()
+	return closed
+}
+
+// clients answer pings on their own, browsers and receivers alike
+func pingWs(ws *websocket.Conn) error {
+	ws.SetWriteDeadline(time.Now().Add(heartbeatInterval))
+	ws.PayloadType = websocket.PingFrame
+	_, err := ws.Write(nil)
+	ws.PayloadType = websocket.TextFrame
+	return err
+}
+
+// WebSocket /ws/config[?receiver=${receiver-id}][&only=${section},...]
+func serveWsConfig(ws *websocket.Conn) {
+	log.Debug("serve: /ws/config")
+	defer ws.Close()
+	filter, err := parseConfigFilter(ws.Request())
+	if err != nil {
+		log.Error("closing web socket: %s", err)
+		return
+	}
+	wsClients.Inc()
+	defer wsClients.Dec()
+
+	changes := configBroker.Subscribe()
+	defer configBroker.Unsubscribe(changes)
+	closed := closedByPeer(ws)
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	sent := ""
+	for {
+		select {
+		case <-closed:
+			log.Debug("web socket closed by client")
+			return
+		case <-heartbeat.C:
+			if err := pingWs(ws); err != nil {
+				log.Debug("closing web socket: %s", err)
+				return
+			}
+			continue
+		case <-changes:
+		}
+		configLock.Lock()
+		content, err := filter.content(&config)
+		b, _ := json.Marshal(filter.apply(&config))
+		configLock.Unlock()
+		if err != nil {
+			log.Error("error writing json: %v", err)
+			continue
+		}
+		if content == sent {
+			continue
+		}
+		ws.SetWriteDeadline(time.Now().Add(heartbeatInterval))
+		if _, err := ws.Write(b); err != nil {
+			log.Debug("closing web socket: %s", err)
+			return
+		}
+		sent = content
+	}
+}
+
+// GET /events/config[?receiver=${receiver-id}][&only=${section},...]
+// server-sent events with the current config and every change of it
+func serveEventsConfig(w http.ResponseWriter, req *http.Request) {
+	log.Debug("serve: /events/config")
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	filter, err := parseConfigFilter(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sseClients.Inc()
+	defer sseClients.Dec()
+
+	changes := configBroker.Subscribe()
+	defer configBroker.Unsubscribe(changes)
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	sent := ""
+	for {
+		configLock.Lock()
+		content, err := filter.content(&config)
+		b, _ := json.Marshal(filter.apply(&config))
+		revision := config.Revision
+		configLock.Unlock()
+		if err != nil {
+			log.Error("error writing json: %v", err)
+		} else if content != sent {
+			if _, err := fmt.Fprintf(w, "event: config\nid: %d\ndata: %s\n\n", revision, b); err != nil {
+				log.Debug("closing event stream: %s", err)
+				return
+			}
+			f.Flush()
+			sent = content
+		}
+
+		select {
+		case <-req.Context().Done():
+			log.Debug("event stream closed by client")
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				log.Debug("closing event stream: %s", err)
+				return
+			}
+			f.Flush()
+		case <-changes:
+		}
+	}
+}
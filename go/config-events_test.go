@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// fresh config and broker, restored when the test is done
+func newEventsTest() func() {
+	config = NewConfig()
+	config.Radios["radio-1"] = &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one"}
+	broker := configBroker
+	configBroker = NewConfigBroker()
+	return func() { configBroker = broker }
+}
+
+// wait until subscribers and goroutines are back at the baseline
+func waitForBaseline(t *testing.T, subscribers, goroutines int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, g := configBroker.Len(), runtime.NumGoroutine()
+		if n == subscribers && g <= goroutines {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d subscribers, %d goroutines, want %d, %d\n%s",
+				n, g, subscribers, goroutines, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitForSubscribers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for configBroker.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers, want %d", configBroker.Len(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func changeRadio(name string) {
+	configLock.Lock()
+	config.Radios["radio-1"].Name = name
+	notifyNewConfig()
+	configLock.Unlock()
+}
+
+func TestWsConfigLeaks(t *testing.T) {
+	defer newEventsTest()()
+	server := httptest.NewServer(websocket.Handler(serveWsConfig))
+	defer server.Close()
+	uri := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/config?only=radios"
+	subscribers, goroutines := configBroker.Len(), runtime.NumGoroutine()
+
+	const clients = 5
+	var conns []*websocket.Conn
+	for i := 0; i < clients; i++ {
+		ws, err := websocket.Dial(uri, "", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, ws)
+	}
+	waitForSubscribers(t, subscribers+clients)
+
+	changeRadio("Two")
+	for _, ws := range conns {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(msg, `"Name":"Two"`) || strings.Contains(msg, "Receivers") {
+			t.Errorf("unexpected message: %s", msg)
+		}
+	}
+
+	for _, ws := range conns {
+		ws.Close()
+	}
+	waitForBaseline(t, subscribers, goroutines)
+}
+
+func TestWsConfigHeartbeat(t *testing.T) {
+	defer newEventsTest()()
+	interval := heartbeatInterval
+	heartbeatInterval = 10 * time.Millisecond
+	defer func() { heartbeatInterval = interval }()
+	server := httptest.NewServer(websocket.Handler(serveWsConfig))
+	defer server.Close()
+
+	// raw client to see the control frames
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /ws/config HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nOrigin: %s\r\n\r\n",
+		server.Listener.Addr(), server.URL)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %s", resp.Status)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for pings := 0; pings < 2; {
+		header := make([]byte, 2)
+		if _, err := r.Read(header[:1]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Read(header[1:]); err != nil {
+			t.Fatal(err)
+		}
+		if header[0]&0x0f == websocket.PingFrame {
+			pings += 1
+		}
+		r.Discard(int(header[1] & 0x7f))
+	}
+}
+
+func TestEventsConfigLeaks(t *testing.T) {
+	defer newEventsTest()()
+	server := httptest.NewServer(http.HandlerFunc(serveEventsConfig))
+	defer server.Close()
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport}
+	subscribers, goroutines := configBroker.Len(), runtime.NumGoroutine()
+
+	const clients = 5
+	var cancels []context.CancelFunc
+	var streams []*bufio.Reader
+	for i := 0; i < clients; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		req, _ := http.NewRequest("GET", server.URL+"/events/config?only=radios", nil)
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("content type %s", ct)
+		}
+		streams = append(streams, bufio.NewReader(resp.Body))
+	}
+	waitForSubscribers(t, subscribers+clients)
+
+	// the current config first, then the change
+	for _, name := range []string{"One", "Two"} {
+		if name == "Two" {
+			changeRadio(name)
+		}
+		for _, s := range streams {
+			event := readEvent(t, s)
+			if !strings.Contains(event, `"Name":"`+name+`"`) {
+				t.Errorf("unexpected event: %s", event)
+			}
+		}
+	}
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+	transport.CloseIdleConnections()
+	waitForBaseline(t, subscribers, goroutines)
+}
+
+// data of the next config event
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	event := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" && event != "" {
+			return event
+		}
+		if strings.HasPrefix(line, "data: ") {
+			event = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
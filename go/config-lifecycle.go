@@ -0,0 +1,132 @@
+package main
+
+import (
+	"time"
+)
+
+// senders spawned by the config server go through
+//   starting -> running -> draining -> stopped
+// failed is reached from any state but stopped when the sender gives up
+// draining senders have no receivers left, they are stopped after the grace period
+// unless a receiver tunes in again, switching back and forth reuses the sender
+
+// sender lifecycle states
+const (
+	senderStarting = "starting"
+	senderRunning  = "running"
+	senderDraining = "draining"
+	senderStopped  = "stopped"
+	senderFailed   = "failed"
+)
+
+const lifecycleInterval = time.Second
+
+var (
+	senderGrace *time.Duration
+	// senders spawned before lifecycles were tracked start with an empty state
+	senderTransitions = map[string][]string{
+		"":             {senderStarting, senderRunning, senderDraining, senderFailed, senderStopped},
+		senderStarting: {senderRunning, senderDraining, senderFailed, senderStopped},
+		senderRunning:  {senderDraining, senderFailed, senderStopped},
+		senderDraining: {senderStarting, senderRunning, senderFailed, senderStopped},
+		senderFailed:   {senderStopped},
+	}
+	lifecycleTransitions = metrics.NewCounter("ub0r_sender_lifecycle_transitions_total", "Lifecycle transitions of senders spawned by the config server", "state")
+)
+
+// move the sender to the given state, returns false if it was there already or the transition is invalid
+func (s *Server) setLifecycle(to string) bool {
+	if s.Lifecycle == to {
+		return false
+	}
+	for _, t := range senderTransitions[s.Lifecycle] {
+		if t == to {
+			log.Info("sender %s: %s -> %s", s.Id(), s.Lifecycle, to)
+			s.Lifecycle = to
+			s.LifecycleSince = time.Now().Unix()
+			lifecycleTransitions.Inc(to)
+			return true
+		}
+	}
+	log.Warning("invalid lifecycle transition of sender %s: %s -> %s", s.Id(), s.Lifecycle, to)
+	return false
+}
+
+func (s *Server) ready() bool {
+	return s.Status != nil && s.Status.Ready
+}
+
+// count receivers tuned to each server
+func (c *Config) countListeners() {
+	for _, s := range c.Servers {
+		s.Listeners = 0
+	}
+	for _, r := range c.Receivers {
+		if s, ok := c.Servers[r.ServerId]; ok {
+			s.Listeners += 1
+		}
+	}
+}
+
+// advance the lifecycle of managed senders and stop those drained or failed without receivers
+// returns whether any sender changed its state
+func reconcileSenders(now time.Time) bool {
+	config.countListeners()
+	grace := int64(*senderGrace / time.Second)
+	changed := false
+	stop := make([]string, 0)
+	for k, s := range config.Servers {
+		if !s.managed() {
+			continue
+		}
+		// internal senders don't ping, ask them directly
+		if m, ok := managers[k]; ok {
+			s.Status = m.Status()
+		}
+		if s.Lifecycle == "" {
+			changed = s.setLifecycle(senderStarting) || changed
+		}
+
+		switch {
+		case s.failed():
+			changed = s.setLifecycle(senderFailed) || changed
+		case s.Listeners == 0 && (s.Lifecycle == senderStarting || s.Lifecycle == senderRunning):
+			changed = s.setLifecycle(senderDraining) || changed
+		case s.Listeners > 0 && s.Lifecycle == senderDraining && s.ready():
+			changed = s.setLifecycle(senderRunning) || changed
+		case s.Listeners > 0 && s.Lifecycle == senderDraining:
+			changed = s.setLifecycle(senderStarting) || changed
+		case s.Lifecycle == senderStarting && s.ready():
+			changed = s.setLifecycle(senderRunning) || changed
+		}
+
+		idle := s.Lifecycle == senderDraining || (s.Lifecycle == senderFailed && s.Listeners == 0)
+		if idle && now.Unix()-s.LifecycleSince >= grace {
+			stop = append(stop, k)
+		}
+	}
+	for _, k := range stop {
+		stopServer(k)
+		changed = true
+	}
+	return changed
+}
+
+// reconcile on every change of the config and when grace periods expire
+func scheduleSenderLifecycle(c <-chan time.Time) {
+	changes := configBroker.Subscribe()
+	for {
+		select {
+		case <-c:
+		case <-changes:
+		}
+		if !isLeader() {
+			continue
+		}
+		configLock.Lock()
+		if reconcileSenders(time.Now()) {
+			notifyNewConfig()
+		}
+		configLock.Unlock()
+	}
+}
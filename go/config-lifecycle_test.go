@@ -0,0 +1,219 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ziutek/gst"
+)
+
+// internal sender reporting a status set by the test
+type fakeSender struct {
+	server  *Server
+	status  *Status
+	stopped bool
+}
+
+func (f *fakeSender) Server() *Server  { return f.server }
+func (f *fakeSender) Status() *Status  { return f.status }
+func (f *fakeSender) startSender()     {}
+func (f *fakeSender) restartSender()   {}
+func (f *fakeSender) stopSender()      { f.stopped = true }
+func (f *fakeSender) ready(ready bool) { f.status = &Status{Ready: ready} }
+
+// config with one receiver and a managed sender for each radio, starting at now
+func newLifecycleTest(now time.Time, radios ...string) (*Receiver, map[string]*fakeSender) {
+	grace := 10 * time.Second
+	senderGrace = &grace
+	config = NewConfig()
+	managers = make(map[string]InternalSender)
+	senders := make(map[string]*fakeSender)
+	for i, radio := range radios {
+		config.Radios[radio] = &Radio{Uid: radio, Name: radio, Uri: "http://example.com/" + radio}
+		s := &Server{Internal: true, Lifecycle: senderStarting, LifecycleSince: now.Unix()}
+		s.Name = "localhost"
+		s.Host = "localhost"
+		s.Port = 48100 + i
+		s.RadioId = radio
+		config.Servers[s.Id()] = s
+		f := &fakeSender{server: s}
+		managers[s.Id()] = f
+		senders[radio] = f
+	}
+	r := &Receiver{Name: "kitchen", ServerId: "off"}
+	config.Receivers[r.Id()] = r
+	return r, senders
+}
+
+func lifecycleOf(radio string) string {
+	for _, s := range config.Servers {
+		if s.RadioId == radio {
+			return s.Lifecycle
+		}
+	}
+	return senderStopped
+}
+
+func TestSetLifecycle(t *testing.T) {
+	s := &Server{Host: "localhost", Port: 48100}
+	for _, tt := range []struct {
+		to string
+		ok bool
+	}{
+		{senderStarting, true},
+		{senderStarting, false},
+		{senderRunning, true},
+		{senderStarting, false},
+		{senderDraining, true},
+		{senderStarting, true},
+		{senderFailed, true},
+		{senderRunning, false},
+		{senderStopped, true},
+		{senderStarting, false},
+	} {
+		from := s.Lifecycle
+		if ok := s.setLifecycle(tt.to); ok != tt.ok {
+			t.Errorf("%q -> %q: %t, want %t", from, tt.to, ok, tt.ok)
+		}
+		if tt.ok && s.Lifecycle != tt.to {
+			t.Errorf("%q -> %q: in state %q", from, tt.to, s.Lifecycle)
+		}
+		if !tt.ok && s.Lifecycle != from {
+			t.Errorf("%q -> %q: moved to %q", from, tt.to, s.Lifecycle)
+		}
+	}
+}
+
+func TestReconcileSenders(t *testing.T) {
+	now := time.Now()
+	r, senders := newLifecycleTest(now, "radio-a")
+	a := senders["radio-a"]
+	r.ServerId = a.server.Id()
+
+	// starting until ready
+	if reconcileSenders(now) || lifecycleOf("radio-a") != senderStarting {
+		t.Fatalf("sender not ready left starting: %s", lifecycleOf("radio-a"))
+	}
+	a.ready(true)
+	if !reconcileSenders(now) || lifecycleOf("radio-a") != senderRunning {
+		t.Fatalf("ready sender %s, want running", lifecycleOf("radio-a"))
+	}
+
+	// draining without receivers, stopped after the grace period
+	r.ServerId = "off"
+	if !reconcileSenders(now) || lifecycleOf("radio-a") != senderDraining {
+		t.Fatalf("sender without receivers %s, want draining", lifecycleOf("radio-a"))
+	}
+	reconcileSenders(now.Add(9 * time.Second))
+	if lifecycleOf("radio-a") != senderDraining || a.stopped {
+		t.Fatal("sender stopped within grace period")
+	}
+	if !reconcileSenders(now.Add(11*time.Second)) || !a.stopped {
+		t.Fatal("sender not stopped after grace period")
+	}
+	if _, ok := config.Servers[a.server.Id()]; ok {
+		t.Error("stopped sender still configured")
+	}
+	if a.server.Lifecycle != senderStopped {
+		t.Errorf("stopped sender %s", a.server.Lifecycle)
+	}
+}
+
+func TestReconcileSendersSwitchBack(t *testing.T) {
+	now := time.Now()
+	r, senders := newLifecycleTest(now, "radio-a", "radio-b")
+	a, b := senders["radio-a"], senders["radio-b"]
+	a.ready(true)
+	b.ready(true)
+	r.ServerId = a.server.Id()
+	reconcileSenders(now)
+
+	// a -> b drains a
+	server_id, err := findOrSpawnServer("radio-b", r)
+	if err != nil || server_id != b.server.Id() {
+		t.Fatalf("switched to %s: %v", server_id, err)
+	}
+	r.ServerId = server_id
+	reconcileSenders(now)
+	if lifecycleOf("radio-a") != senderDraining || lifecycleOf("radio-b") != senderRunning {
+		t.Fatalf("after switching a: %s, b: %s", lifecycleOf("radio-a"), lifecycleOf("radio-b"))
+	}
+
+	// b -> a within the grace period reuses the draining sender
+	server_id, err = findOrSpawnServer("radio-a", r)
+	if err != nil || server_id != a.server.Id() {
+		t.Fatalf("switched back to %s, want draining %s: %v", server_id, a.server.Id(), err)
+	}
+	r.ServerId = server_id
+	reconcileSenders(now.Add(5 * time.Second))
+	if lifecycleOf("radio-a") != senderRunning || a.stopped {
+		t.Errorf("reused sender %s, stopped %t", lifecycleOf("radio-a"), a.stopped)
+	}
+	if lifecycleOf("radio-b") != senderDraining {
+		t.Errorf("left sender %s, want draining", lifecycleOf("radio-b"))
+	}
+	if len(config.Servers) != 2 {
+		t.Errorf("%d senders, want 2", len(config.Servers))
+	}
+
+	// a sender not ready yet goes back to starting
+	b.ready(false)
+	r.ServerId = b.server.Id()
+	reconcileSenders(now.Add(6 * time.Second))
+	if lifecycleOf("radio-b") != senderStarting {
+		t.Errorf("reused sender not ready %s, want starting", lifecycleOf("radio-b"))
+	}
+}
+
+func TestReconcileSendersFailed(t *testing.T) {
+	now := time.Now()
+	r, senders := newLifecycleTest(now, "radio-a")
+	a := senders["radio-a"]
+	r.ServerId = a.server.Id()
+	a.status = &Status{Failed: true}
+
+	// failed senders with receivers keep their error visible
+	if !reconcileSenders(now) || lifecycleOf("radio-a") != senderFailed {
+		t.Fatalf("failed sender %s, want failed", lifecycleOf("radio-a"))
+	}
+	reconcileSenders(now.Add(time.Hour))
+	if a.stopped || lifecycleOf("radio-a") != senderFailed {
+		t.Fatal("failed sender with receivers stopped")
+	}
+
+	// and are stopped once the receivers left
+	r.ServerId = "off"
+	reconcileSenders(now.Add(time.Hour))
+	if !a.stopped {
+		t.Error("failed sender without receivers not stopped")
+	}
+}
+
+func TestReconcileSendersConcurrentStatus(t *testing.T) {
+	now := time.Now()
+	r, senders := newLifecycleTest(now, "radio-a")
+	s := senders["radio-a"].server
+	r.ServerId = s.Id()
+	// an in-process sender updating its status from the bus meanwhile
+	m := NewServer(true)
+	m.Backend = s
+	managers[s.Id()] = m
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			m.setError("error")
+			m.setState(gst.STATE_PLAYING)
+			m.setConnected("http://example.com/a")
+			m.setFailed()
+			m.resetErrors()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		reconcileSenders(now)
+	}
+	<-done
+	if st := m.Status(); st.Failed || st.ErrorCount != 0 || st.State != gst.STATE_PLAYING.String() {
+		t.Errorf("status %+v", st)
+	}
+}
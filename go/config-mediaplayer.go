@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// receivers shaped like media players of home automation tools, e.g. Home Assistant
+// radios are the sources, the radio played is the current source
+
+// media player states
+const (
+	playerOff       = "off"
+	playerPlaying   = "playing"
+	playerBuffering = "buffering"
+)
+
+// Home Assistant's MediaPlayerEntityFeature flags
+const (
+	featureVolumeSet     = 4
+	featureVolumeMute    = 8
+	featurePreviousTrack = 16
+	featureNextTrack     = 32
+	featureTurnOn        = 128
+	featureTurnOff       = 256
+	featureVolumeStep    = 1024
+	featureSelectSource  = 2048
+	featureStop          = 4096
+	featurePlay          = 16384
+
+	playerFeatures = featureVolumeSet | featureVolumeMute | featurePreviousTrack | featureNextTrack |
+		featureTurnOn | featureTurnOff | featureVolumeStep | featureSelectSource | featureStop | featurePlay
+)
+
+var entityIdChars = regexp.MustCompile("[^a-z0-9]+")
+
+type MediaPlayer struct {
+	Id                string   `json:"id"`
+	EntityId          string   `json:"entity_id"`
+	Name              string   `json:"name"`
+	State             string   `json:"state"`
+	VolumeLevel       float64  `json:"volume_level"`
+	IsVolumeMuted     bool     `json:"is_volume_muted"`
+	Source            string   `json:"source,omitempty"`
+	SourceList        []string `json:"source_list"`
+	MediaTitle        string   `json:"media_title,omitempty"`
+	EntityPicture     string   `json:"entity_picture,omitempty"`
+	SupportedFeatures int      `json:"supported_features"`
+}
+
+// arguments of media player services
+type PlayerCall struct {
+	VolumeLevel   *float64 `json:"volume_level"`
+	IsVolumeMuted *bool    `json:"is_volume_muted"`
+	Source        string   `json:"source"`
+}
+
+func entityId(name string) string {
+	return "media_player." + strings.Trim(entityIdChars.ReplaceAllString(strings.ToLower(name), "_"), "_")
+}
+
+func (c *Config) mediaPlayer(r *Receiver) *MediaPlayer {
+	p := &MediaPlayer{
+		Id:                r.Id(),
+		EntityId:          entityId(r.Name),
+		Name:              r.Name,
+		State:             playerOff,
+		VolumeLevel:       float64(r.Volume) / float64(r.volumeLimit()),
+		IsVolumeMuted:     r.Muted,
+		SupportedFeatures: playerFeatures,
+	}
+	radios := sortedRadios(c.Radios)
+	p.SourceList = make([]string, len(radios))
+	for i, radio := range radios {
+		p.SourceList[i] = radio.Name
+	}
+	if s, ok := c.Servers[r.ServerId]; ok {
+		p.State = playerBuffering
+		if r.Status != nil && r.Status.Ready {
+			p.State = playerPlaying
+		}
+		if radio, ok := c.Radios[s.RadioId]; ok {
+			p.Source = radio.Name
+			p.MediaTitle = radio.Name
+			p.EntityPicture = radio.Logo
+		}
+	}
+	return p
+}
+
+func (c *Config) mediaPlayers() []*MediaPlayer {
+	players := make([]*MediaPlayer, 0, len(c.Receivers))
+	for _, r := range c.Receivers {
+		players = append(players, c.mediaPlayer(r))
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].Id < players[j].Id
+	})
+	return players
+}
+
+// radio by name or id
+func (c *Config) findSource(source string) (string, bool) {
+	if c.hasRadio(source) {
+		return source, true
+	}
+	for _, r := range sortedRadios(c.Radios) {
+		if r.Name == source {
+			return r.Id(), true
+		}
+	}
+	return "", false
+}
+
+// translate a service call to the parameter of /api/receiver
+func playerParam(r *Receiver, service string, call *PlayerCall) (string, string, *ServeError) {
+	playing := config.hasServer(r.ServerId)
+	switch service {
+	case "turn_on", "media_play":
+		if playing {
+			return "", "", nil
+		}
+		return "radio", "last", nil
+	case "turn_off", "media_stop", "media_pause":
+		return "radio", "off", nil
+	case "toggle", "media_play_pause":
+		if playing {
+			return "radio", "off", nil
+		}
+		return "radio", "last", nil
+	case "media_next_track":
+		return "radio", "next", nil
+	case "media_previous_track":
+		return "radio", "prev", nil
+	case "volume_up":
+		return "volume", "up", nil
+	case "volume_down":
+		return "volume", "down", nil
+	case "volume_set":
+		if call.VolumeLevel == nil || *call.VolumeLevel < 0 || *call.VolumeLevel > 1 {
+			return "", "", NewError("volume_set needs volume_level between 0 and 1", http.StatusBadRequest)
+		}
+		v := int(math.Floor(*call.VolumeLevel*float64(r.volumeLimit()) + 0.5))
+		return "volume", strconv.Itoa(v), nil
+	case "volume_mute":
+		if call.IsVolumeMuted == nil {
+			return "", "", NewError("volume_mute needs is_volume_muted", http.StatusBadRequest)
+		}
+		return "mute", strconv.FormatBool(*call.IsVolumeMuted), nil
+	case "select_source":
+		radio_id, ok := config.findSource(call.Source)
+		if !ok {
+			return "", "", NewError(fmt.Sprintf("source not found: %s", call.Source), http.StatusNotFound)
+		}
+		return "radio", radio_id, nil
+	}
+	return "", "", NewError(fmt.Sprintf("unknown service: %s", service), http.StatusBadRequest)
+}
+
+// GET /api/media_player
+// GET /api/media_player?id=${receiver-id}
+// POST /api/media_player/${service}?id=${receiver-id}
+func serveApiMediaPlayer(w http.ResponseWriter, req *http.Request) *ServeError {
+	id := req.URL.Query().Get("id")
+	if req.Method == "GET" && id == "" {
+		return serveJson(w, req, config.mediaPlayers())
+	}
+
+	r, ok := config.Receivers[id]
+	if !ok {
+		return NewError(fmt.Sprintf("receiver not found: %s", id), http.StatusNotFound)
+	}
+	if req.Method == "POST" {
+		service := strings.TrimPrefix(req.URL.Path, "/api/media_player/")
+		var call PlayerCall
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&call); err != nil {
+				return NewError(fmt.Sprintf("invalid service data: %s", err), http.StatusBadRequest)
+			}
+		}
+		log.Debug("/api/media_player receiver: %s, service: %s", id, service)
+		param, value, err := playerParam(r, service, &call)
+		if err != nil {
+			return err
+		}
+		if param != "" {
+			if err := receiverCommand(id, param, value); err != nil {
+				return err
+			}
+		}
+	}
+	return serveJson(w, req, config.mediaPlayer(r))
+}
+
+// GET /api/media_player/events[?id=${receiver-id}]
+// server-sent events with the state of changed media players
+func serveApiMediaPlayerEvents(w http.ResponseWriter, req *http.Request) *ServeError {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return NewInternalError("streaming not supported")
+	}
+	id := req.URL.Query().Get("id")
+	configLock.Lock()
+	_, found := config.Receivers[id]
+	configLock.Unlock()
+	if id != "" && !found {
+		return NewError(fmt.Sprintf("receiver not found: %s", id), http.StatusNotFound)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	changes := configBroker.Subscribe()
+	defer configBroker.Unsubscribe(changes)
+	sent := make(map[string]string)
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		current := make(map[string]bool)
+		configLock.Lock()
+		players := config.mediaPlayers()
+		configLock.Unlock()
+		for _, p := range players {
+			if id != "" && p.Id != id {
+				continue
+			}
+			current[p.Id] = true
+			b, err := json.Marshal(p)
+			if err != nil {
+				// headers are sent already
+				log.Error("error writing json: %v", err)
+				return nil
+			}
+			if sent[p.Id] == string(b) {
+				continue
+			}
+			sent[p.Id] = string(b)
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", b)
+		}
+		for k := range sent {
+			if !current[k] {
+				delete(sent, k)
+				b, _ := json.Marshal(map[string]string{"id": k})
+				fmt.Fprintf(w, "event: removed\ndata: %s\n\n", b)
+			}
+		}
+		f.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return nil
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			f.Flush()
+		case <-changes:
+		}
+	}
+}
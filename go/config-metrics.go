@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	apiLatency = metrics.NewHistogram("ub0r_http_request_duration_seconds", "Latency of http requests", latencyBucket, "method", "path", "code")
+	wsClients  = metrics.NewGauge("ub0r_websocket_clients", "Connected web socket clients")
+	sseClients = metrics.NewGauge("ub0r_event_stream_clients", "Connected server-sent event clients")
+)
+
+func registerConfigMetrics() {
+	metrics.NewCollector("ub0r_receivers", "Known receivers", kindGauge, nil,
+		func(emit func(float64, ...string)) {
+			configLock.Lock()
+			defer configLock.Unlock()
+			emit(float64(len(config.Receivers)))
+		})
+	metrics.NewCollector("ub0r_servers", "Known servers", kindGauge, []string{"internal"},
+		func(emit func(float64, ...string)) {
+			configLock.Lock()
+			defer configLock.Unlock()
+			internal := 0
+			for _, s := range config.Servers {
+				if s.Internal {
+					internal += 1
+				}
+			}
+			emit(float64(internal), "true")
+			emit(float64(len(config.Servers)-internal), "false")
+		})
+	metrics.NewCollector("ub0r_radios", "Configured radios", kindGauge, nil,
+		func(emit func(float64, ...string)) {
+			configLock.Lock()
+			defer configLock.Unlock()
+			emit(float64(len(config.Radios)))
+		})
+	metrics.NewCollector("ub0r_schedules", "Configured schedules", kindGauge, nil,
+		func(emit func(float64, ...string)) {
+			configLock.Lock()
+			defer configLock.Unlock()
+			emit(float64(len(config.Schedules)))
+		})
+	metrics.NewCollector("ub0r_ping_age_seconds", "Seconds since last ping of receivers and external servers", kindGauge, []string{"id"},
+		func(emit func(float64, ...string)) {
+			configLock.Lock()
+			defer configLock.Unlock()
+			for k, r := range config.Receivers {
+				emit(age(r.LastPing), k)
+			}
+			for k, s := range config.Servers {
+				if !s.Internal {
+					emit(age(s.LastPing), k)
+				}
+			}
+		})
+	registerSenderMetrics(func() []*Manager {
+		configLock.Lock()
+		defer configLock.Unlock()
+		// sender processes serve their own metrics
+		l := make([]*Manager, 0, len(managers))
+		for _, s := range managers {
+			if m, ok := s.(*Manager); ok {
+				l = append(l, m)
+			}
+		}
+		return l
+	})
+}
+
+// paths served by serve, labels of requests to others are collapsed to keep cardinality low
+var metricRoutes = map[string]bool{
+	"/": true, "/ui/receiver": true, "/ui/radio": true, "/ui/radio/delete": true,
+	"/api/ping/receiver": true, "/api/ping/server": true, "/api/ping/agent": true,
+	"/api/radio": true, "/api/radio/logo": true, "/api/radios": true, "/api/radios/order": true,
+	"/api/config": true, "/api/receiver": true, "/api/directory": true, "/api/schedule": true,
+	"/api/sleep": true, "/api/media_player": true, "/api/media_player/events": true,
+	"/api/server/logs": true, "/api/status": true, "/api/export": true, "/api/import": true,
+	"/api/cluster": true, "/api/cluster/config": true,
+}
+
+var metricMethods = map[string]bool{"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true}
+
+// route pattern of the request, services of the media player are taken from the path
+func routeLabel(path string) string {
+	if metricRoutes[path] {
+		return path
+	}
+	if strings.HasPrefix(path, "/api/media_player/") {
+		return "/api/media_player/*"
+	}
+	return "unknown"
+}
+
+// record latency of requests handled by h
+func instrument(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{w, http.StatusOK}
+		h(rec, req)
+		method := req.Method
+		if !metricMethods[method] {
+			method = "other"
+		}
+		apiLatency.Observe(time.Since(start).Seconds(), method, routeLabel(req.URL.Path), strconv.Itoa(rec.code))
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInstrumentLabels(t *testing.T) {
+	registry := NewRegistry()
+	latency := apiLatency
+	apiLatency = registry.NewHistogram("latency", "test", latencyBucket, "method", "path", "code")
+	defer func() { apiLatency = latency }()
+
+	h := instrument(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/api/media_player/") {
+			http.Error(w, "unknown service", http.StatusBadRequest)
+		} else if !metricRoutes[req.URL.Path] {
+			http.Error(w, "unknown path", http.StatusInternalServerError)
+		}
+	})
+	for _, r := range []struct{ method, path string }{
+		{"GET", "/api/config"},
+		{"POST", "/api/media_player/volume_set"},
+		{"POST", "/api/media_player/random-1"},
+		{"POST", "/api/media_player/random-2"},
+		{"POST", "/api/ping/random-3"},
+		{"GET", "/random-4"},
+		{"RANDOM", "/api/config"},
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(r.method, r.path, nil))
+	}
+
+	var b bytes.Buffer
+	registry.Write(&b)
+	out := b.String()
+	if strings.Contains(out, "random") || strings.Contains(out, "RANDOM") {
+		t.Errorf("request values used as labels:\n%s", out)
+	}
+	for _, want := range []string{
+		`latency_count{method="GET",path="/api/config",code="200"} 1`,
+		`latency_count{method="POST",path="/api/media_player/*",code="400"} 3`,
+		`latency_count{method="POST",path="unknown",code="500"} 1`,
+		`latency_count{method="GET",path="unknown",code="500"} 1`,
+		`latency_count{method="other",path="/api/config",code="200"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in:\n%s", want, out)
+		}
+	}
+}
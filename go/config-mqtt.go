@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bridge between config server and an MQTT broker
+// state of receivers, servers and radios is published retained to ${prefix}/${kind}/${id}
+// commands are read from ${prefix}/receiver/${id}/set/${command}
+
+var (
+	mqttMessages  = metrics.NewCounter("ub0r_mqtt_messages_total", "MQTT messages sent and received", "direction")
+	mqttConnected = metrics.NewGauge("ub0r_mqtt_connected", "Connection state of the MQTT bridge")
+)
+
+// broker connections
+var mqttBackoff = BackoffPolicy{
+	Initial:    time.Second,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jitter:     0.1,
+}
+
+// Protocol ----------------------------------------
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect      = 1
+	mqttConnack      = 2
+	mqttPublish      = 3
+	mqttPuback       = 4
+	mqttSubscribe    = 8
+	mqttSuback       = 9
+	mqttPingreq      = 12
+	mqttPingresp     = 13
+	mqttMaxRemaining = 268435455
+)
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// minimal MQTT 3.1.1 client: QoS 0 publish and subscribe, retained messages, last will
+type MqttClient struct {
+	Uri       *url.URL
+	ClientId  string
+	User      string
+	Password  string
+	KeepAlive time.Duration
+	// published by the broker when the connection is lost
+	WillTopic   string
+	WillPayload string
+	// called for received messages from the read loop
+	OnMessage func(topic string, payload []byte)
+
+	conn      net.Conn
+	writeLock sync.Mutex
+	packetId  uint16
+}
+
+func checkMqttUri(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts":
+	default:
+		return fmt.Errorf("unknown scheme '%s', use tcp://, mqtt://, ssl:// or mqtts://", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing broker host: %s", uri)
+	}
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("short string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("short string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// write a packet with fixed header
+func (c *MqttClient) writePacket(header byte, body []byte) error {
+	if len(body) > mqttMaxRemaining {
+		return fmt.Errorf("packet too large: %d bytes", len(body))
+	}
+	b := []byte{header}
+	// remaining length, 7 bits per byte
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			break
+		}
+	}
+	b = append(b, body...)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.conn == nil {
+		return errors.New("not connected")
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// read a packet, returns header and body
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		d, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(d&0x7f) * mult
+		if d&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		mult *= 128
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func (c *MqttClient) nextPacketId() uint16 {
+	c.packetId += 1
+	if c.packetId == 0 {
+		c.packetId = 1
+	}
+	return c.packetId
+}
+
+func (c *MqttClient) dial() (net.Conn, error) {
+	host := c.Uri.Host
+	secure := c.Uri.Scheme == "ssl" || c.Uri.Scheme == "tls" || c.Uri.Scheme == "mqtts"
+	if c.Uri.Port() == "" {
+		if secure {
+			host = net.JoinHostPort(host, "8883")
+		} else {
+			host = net.JoinHostPort(host, "1883")
+		}
+	}
+	if secure {
+		return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", host, &tls.Config{ServerName: c.Uri.Hostname()})
+	}
+	return net.DialTimeout("tcp", host, 10*time.Second)
+}
+
+// connect to the broker and wait for its acknowledgement
+func (c *MqttClient) Connect() (*bufio.Reader, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	// clean session, subscriptions are renewed on every connect
+	flags := byte(0x02)
+	if c.WillTopic != "" {
+		// will retained with QoS 0
+		flags |= 0x04 | 0x20
+	}
+	if c.User != "" {
+		flags |= 0x80
+		if c.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags, byte(c.KeepAlive/time.Second>>8), byte(c.KeepAlive/time.Second))
+	body = appendString(body, c.ClientId)
+	if c.WillTopic != "" {
+		body = appendString(body, c.WillTopic)
+		body = appendString(body, c.WillPayload)
+	}
+	if c.User != "" {
+		body = appendString(body, c.User)
+		if c.Password != "" {
+			body = appendString(body, c.Password)
+		}
+	}
+
+	c.writeLock.Lock()
+	c.conn = conn
+	c.writeLock.Unlock()
+	if err := c.writePacket(mqttConnect<<4, body); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	header, ack, err := readPacket(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if header>>4 != mqttConnack || len(ack) != 2 {
+		c.Close()
+		return nil, fmt.Errorf("expected connack, got packet type %d", header>>4)
+	}
+	if ack[1] != 0 {
+		c.Close()
+		if msg, ok := mqttConnackErrors[ack[1]]; ok {
+			return nil, fmt.Errorf("connection refused: %s", msg)
+		}
+		return nil, fmt.Errorf("connection refused: %d", ack[1])
+	}
+	return r, nil
+}
+
+func (c *MqttClient) Publish(topic string, payload []byte, retain bool) error {
+	header := byte(mqttPublish << 4)
+	if retain {
+		header |= 0x01
+	}
+	body := appendString(nil, topic)
+	body = append(body, payload...)
+	mqttMessages.Inc("out")
+	return c.writePacket(header, body)
+}
+
+func (c *MqttClient) Subscribe(filter string) error {
+	body := make([]byte, 2, 5+len(filter))
+	binary.BigEndian.PutUint16(body, c.nextPacketId())
+	body = appendString(body, filter)
+	body = append(body, 0)
+	return c.writePacket(mqttSubscribe<<4|0x02, body)
+}
+
+// handle incoming packets until the connection fails
+func (c *MqttClient) readLoop(r *bufio.Reader) error {
+	c.writeLock.Lock()
+	conn := c.conn
+	c.writeLock.Unlock()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+	for {
+		// the broker answers pings within the keep alive interval
+		conn.SetReadDeadline(time.Now().Add(c.KeepAlive * 3 / 2))
+		header, body, err := readPacket(r)
+		if err != nil {
+			return err
+		}
+		switch header >> 4 {
+		case mqttPublish:
+			topic, rest, err := readString(body)
+			if err != nil {
+				return err
+			}
+			if qos := (header >> 1) & 0x03; qos > 0 {
+				if len(rest) < 2 {
+					return errors.New("missing packet id")
+				}
+				if qos == 1 {
+					c.writePacket(mqttPuback<<4, rest[:2])
+				}
+				rest = rest[2:]
+			}
+			mqttMessages.Inc("in")
+			if c.OnMessage != nil {
+				c.OnMessage(topic, rest)
+			}
+		case mqttSuback:
+			if len(body) < 3 {
+				return errors.New("malformed suback")
+			}
+			for _, rc := range body[2:] {
+				if rc == 0x80 {
+					log.Error("mqtt subscription rejected by broker")
+				}
+			}
+		case mqttPingresp, mqttPuback:
+			// ignore
+		default:
+			log.Debug("mqtt: unexpected packet type %d", header>>4)
+		}
+	}
+}
+
+// send pings until done is closed
+func (c *MqttClient) keepAliveLoop(done <-chan bool) {
+	t := time.NewTicker(c.KeepAlive / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if err := c.writePacket(mqttPingreq<<4, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// run the connection until it fails, onConnect is called after connecting
+func (c *MqttClient) Run(onConnect func()) error {
+	r, err := c.Connect()
+	if err != nil {
+		return err
+	}
+	done := make(chan bool)
+	go c.keepAliveLoop(done)
+	onConnect()
+	err = c.readLoop(r)
+	close(done)
+	c.Close()
+	return err
+}
+
+func (c *MqttClient) Close() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Bridge ------------------------------------------
+
+// state of a receiver as published, flat for home automation
+type mqttReceiverState struct {
+	Id        string
+	Name      string
+	Power     string
+	RadioId   string
+	RadioName string
+	Volume    int
+	Muted     bool
+	MaxVolume int
+	Group     string
+	Ready     bool
+}
+
+type MqttBridge struct {
+	client *MqttClient
+	prefix string
+	// retained payloads by topic, republished after reconnects
+	published map[string]string
+	lock      sync.Mutex
+}
+
+func NewMqttBridge(client *MqttClient, prefix string) *MqttBridge {
+	b := &MqttBridge{
+		client:    client,
+		prefix:    strings.TrimSuffix(prefix, "/"),
+		published: make(map[string]string),
+	}
+	client.WillTopic = b.prefix + "/status"
+	client.WillPayload = "offline"
+	client.OnMessage = b.onMessage
+	return b
+}
+
+func (b *MqttBridge) receiverState(r *Receiver) *mqttReceiverState {
+	st := &mqttReceiverState{
+		Id:        r.Id(),
+		Name:      r.Name,
+		Power:     "off",
+		Volume:    r.Volume,
+		Muted:     r.Muted,
+		MaxVolume: r.volumeLimit(),
+		Group:     r.Group,
+		Ready:     r.Status != nil && r.Status.Ready,
+	}
+	if s, ok := config.Servers[r.ServerId]; ok {
+		st.Power = "on"
+		st.RadioId = s.RadioId
+		if radio, ok := config.Radios[s.RadioId]; ok {
+			st.RadioName = radio.Name
+		}
+	}
+	return st
+}
+
+// retained state of all devices, empty payloads clear removed devices
+func (b *MqttBridge) states() map[string]interface{} {
+	states := make(map[string]interface{})
+	for k, r := range config.Receivers {
+		states[b.prefix+"/receiver/"+k] = b.receiverState(r)
+	}
+	for k, s := range config.Servers {
+		states[b.prefix+"/server/"+k] = s
+	}
+	for k, r := range config.Radios {
+		states[b.prefix+"/radio/"+k] = r
+	}
+	return states
+}
+
+// publish changed state, everything if force is set
+func (b *MqttBridge) publishState(force bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if force {
+		b.published = make(map[string]string)
+	}
+	configLock.Lock()
+	states := make(map[string][]byte)
+	for topic, obj := range b.states() {
+		j, err := json.Marshal(obj)
+		if err != nil {
+			log.Error("error writing json: %v", err)
+			continue
+		}
+		states[topic] = j
+	}
+	configLock.Unlock()
+	for topic, j := range states {
+		if b.published[topic] == string(j) {
+			continue
+		}
+		if err := b.client.Publish(topic, j, true); err != nil {
+			log.Debug("mqtt: unable to publish %s: %s", topic, err)
+			return
+		}
+		b.published[topic] = string(j)
+	}
+	for topic := range b.published {
+		if _, ok := states[topic]; !ok {
+			if err := b.client.Publish(topic, nil, true); err != nil {
+				return
+			}
+			delete(b.published, topic)
+		}
+	}
+}
+
+// translate a command to the parameter of /api/receiver
+func (b *MqttBridge) commandParam(id, command, value string) (string, string, error) {
+	switch command {
+	case "radio":
+		return "radio", value, nil
+	case "volume":
+		return "volume", value, nil
+	case "mute":
+		switch strings.ToLower(value) {
+		case "on":
+			value = "true"
+		case "off":
+			value = "false"
+		}
+		return "mute", strings.ToLower(value), nil
+	case "power":
+		switch strings.ToLower(value) {
+		case "off":
+			return "radio", "off", nil
+		case "on":
+			if r, ok := config.Receivers[id]; ok && config.hasServer(r.ServerId) {
+				// already playing
+				return "", "", nil
+			}
+			return "radio", "last", nil
+		}
+		return "", "", fmt.Errorf("invalid power '%s', use on or off", value)
+	}
+	return "", "", fmt.Errorf("unknown command '%s', use radio, volume, mute or power", command)
+}
+
+// ${prefix}/receiver/${id}/set/${command}
+// only the leader of a cluster is connected, followers would spawn senders of their own
+func (b *MqttBridge) onMessage(topic string, payload []byte) {
+	rest := strings.TrimPrefix(topic, b.prefix+"/receiver/")
+	i := strings.LastIndex(rest, "/set/")
+	if rest == topic || i < 0 {
+		log.Debug("mqtt: ignoring message on %s", topic)
+		return
+	}
+	id, command, value := rest[:i], rest[i+len("/set/"):], strings.TrimSpace(string(payload))
+	log.Info("mqtt command for %s: %s %s", id, command, value)
+
+	if !isLeader() {
+		log.Warning("mqtt: ignoring command for %s, not leading the cluster", id)
+		return
+	}
+	configLock.Lock()
+	defer configLock.Unlock()
+	param, value, err := b.commandParam(id, command, value)
+	if err != nil {
+		log.Error("mqtt: %s", err)
+		return
+	}
+	if param == "" {
+		return
+	}
+	if err := receiverCommand(id, param, value); err != nil {
+		log.Error("mqtt: command %s for %s failed: %s", command, id, err)
+	}
+}
+
+func (b *MqttBridge) onConnect() {
+	log.Info("connected to mqtt broker %s", b.client.Uri.Host)
+	mqttConnected.Set(1)
+	if err := b.client.Publish(b.prefix+"/status", []byte("online"), true); err != nil {
+		return
+	}
+	if err := b.client.Subscribe(b.prefix + "/receiver/+/set/+"); err != nil {
+		return
+	}
+	b.publishState(true)
+}
+
+// keep connected to the broker while leading
+func (b *MqttBridge) run() {
+	retry := mqttBackoff.NewBackoff(realClock{})
+	for {
+		if !isLeader() {
+			time.Sleep(clusterHeartbeat)
+			continue
+		}
+		start := time.Now()
+		err := b.client.Run(b.onConnect)
+		mqttConnected.Set(0)
+		log.Error("mqtt connection to %s failed: %s", b.client.Uri.Host, err)
+		if time.Since(start) > b.client.KeepAlive {
+			// connection was established for a while
+			retry.Reset()
+		}
+		retry.Wait()
+	}
+}
+
+// publish state whenever config changes
+func (b *MqttBridge) watchConfig() {
+	changes := configBroker.Subscribe()
+	for range changes {
+		b.publishState(false)
+	}
+}
+
+// disconnect when stepping down, the new leader connects instead
+func (b *MqttBridge) followLeader() {
+	for range time.Tick(clusterHeartbeat) {
+		if !isLeader() {
+			b.client.Close()
+		}
+	}
+}
+
+func (b *MqttBridge) start() {
+	go b.run()
+	go b.watchConfig()
+	if cluster != nil {
+		go b.followLeader()
+	}
+}
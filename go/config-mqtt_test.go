@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// broker on the loopback interface accepting a single client
+type fakeBroker struct {
+	ln net.Listener
+	// writes packets to the connected client
+	out     *MqttClient
+	packets chan fakePacket
+	// pings received, answered unless silent is set
+	pings  int32
+	silent int32
+}
+
+type fakePacket struct {
+	header byte
+	body   []byte
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, out: &MqttClient{}, packets: make(chan fakePacket, 100)}
+	go b.accept()
+	return b
+}
+
+func (b *fakeBroker) uri() *url.URL {
+	u, _ := url.Parse("tcp://" + b.ln.Addr().String())
+	return u
+}
+
+func (b *fakeBroker) accept() {
+	conn, err := b.ln.Accept()
+	if err != nil {
+		close(b.packets)
+		return
+	}
+	b.out.writeLock.Lock()
+	b.out.conn = conn
+	b.out.writeLock.Unlock()
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			close(b.packets)
+			return
+		}
+		if header>>4 == mqttPingreq {
+			atomic.AddInt32(&b.pings, 1)
+			if atomic.LoadInt32(&b.silent) == 0 {
+				b.out.writePacket(mqttPingresp<<4, nil)
+			}
+			continue
+		}
+		b.packets <- fakePacket{header, body}
+	}
+}
+
+func (b *fakeBroker) close() {
+	b.ln.Close()
+	b.out.Close()
+}
+
+func (b *fakeBroker) next(t *testing.T, kind byte) fakePacket {
+	t.Helper()
+	select {
+	case p, ok := <-b.packets:
+		if !ok {
+			t.Fatal("client disconnected")
+		}
+		if p.header>>4 != kind {
+			t.Fatalf("got packet type %d, want %d", p.header>>4, kind)
+		}
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for packet type %d", kind)
+	}
+	return fakePacket{}
+}
+
+// next publish on the topic, skipping others
+func (b *fakeBroker) nextPublish(t *testing.T, topic string) (string, bool) {
+	t.Helper()
+	for {
+		p := b.next(t, mqttPublish)
+		tp, payload, err := readString(p.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tp == topic {
+			return string(payload), p.header&0x01 != 0
+		}
+	}
+}
+
+func (b *fakeBroker) publish(t *testing.T, topic, payload string) {
+	t.Helper()
+	body := appendString(nil, topic)
+	if err := b.out.writePacket(mqttPublish<<4, append(body, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newMqttTestConfig() *Receiver {
+	config = NewConfig()
+	config.Radios["radio-1"] = &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one"}
+	s := &Server{Name: "sender", Host: "example.com", Port: 48100, RadioId: "radio-1"}
+	config.Servers[s.Id()] = s
+	r := &Receiver{Name: "kitchen", Volume: 50, ServerId: "off"}
+	config.Receivers[r.Id()] = r
+	return r
+}
+
+// wait for the receiver to match after a command
+func waitForReceiver(t *testing.T, r *Receiver, what string, ok func(r *Receiver) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		configLock.Lock()
+		done := ok(r)
+		configLock.Unlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMqttBridge(t *testing.T) {
+	r := newMqttTestConfig()
+	broker := newFakeBroker(t)
+	defer broker.close()
+
+	client := &MqttClient{Uri: broker.uri(), ClientId: "test", KeepAlive: 200 * time.Millisecond}
+	bridge := NewMqttBridge(client, "ub0r/")
+	result := make(chan error, 1)
+	go func() {
+		result <- client.Run(bridge.onConnect)
+	}()
+
+	// CONNECT with clean session and retained last will
+	p := broker.next(t, mqttConnect)
+	proto, rest, _ := readString(p.body)
+	if proto != "MQTT" || rest[0] != 4 {
+		t.Fatalf("unexpected protocol %s %d", proto, rest[0])
+	}
+	if flags := rest[1]; flags != 0x02|0x04|0x20 {
+		t.Errorf("connect flags %#x", flags)
+	}
+	id, rest, _ := readString(rest[4:])
+	will, rest, _ := readString(rest)
+	payload, _, _ := readString(rest)
+	if id != "test" || will != "ub0r/status" || payload != "offline" {
+		t.Errorf("client id %s, will %s: %s", id, will, payload)
+	}
+	broker.out.writePacket(mqttConnack<<4, []byte{0, 0})
+
+	if status, retained := broker.nextPublish(t, "ub0r/status"); status != "online" || !retained {
+		t.Errorf("status %s retained %t, want online retained", status, retained)
+	}
+	p = broker.next(t, mqttSubscribe)
+	if filter, _, _ := readString(p.body[2:]); filter != "ub0r/receiver/+/set/+" {
+		t.Errorf("subscribed to %s", filter)
+	}
+	broker.out.writePacket(mqttSuback<<4, append(p.body[:2:2], 0))
+
+	// retained state of every device
+	seen := make(map[string]bool)
+	for len(seen) < 3 {
+		p := broker.next(t, mqttPublish)
+		topic, _, _ := readString(p.body)
+		if p.header&0x01 == 0 {
+			t.Errorf("state of %s not retained", topic)
+		}
+		seen[topic] = true
+	}
+	for _, topic := range []string{"ub0r/receiver/receiver-kitchen", "ub0r/server/server-example.com:48100", "ub0r/radio/radio-1"} {
+		if !seen[topic] {
+			t.Errorf("missing state %s, got %v", topic, seen)
+		}
+	}
+
+	// changes are published, the bridge keeps watching a broker of its own
+	configBroker = NewConfigBroker()
+	defer func() { configBroker = NewConfigBroker() }()
+	go bridge.watchConfig()
+	for configBroker.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	configLock.Lock()
+	r.Volume = 70
+	notifyNewConfig()
+	configLock.Unlock()
+	state, retained := broker.nextPublish(t, "ub0r/receiver/receiver-kitchen")
+	var st mqttReceiverState
+	if err := json.Unmarshal([]byte(state), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Volume != 70 || !retained {
+		t.Errorf("published volume %d retained %t, want 70 retained", st.Volume, retained)
+	}
+
+	// commands
+	broker.publish(t, "ub0r/receiver/receiver-kitchen/set/volume", "30")
+	waitForReceiver(t, r, "volume", func(r *Receiver) bool { return r.Volume == 30 })
+	broker.publish(t, "ub0r/receiver/receiver-kitchen/set/radio", "radio-1")
+	waitForReceiver(t, r, "radio", func(r *Receiver) bool { return r.ServerId == "server-example.com:48100" })
+	broker.publish(t, "ub0r/receiver/receiver-kitchen/set/power", "off")
+	waitForReceiver(t, r, "power off", func(r *Receiver) bool { return r.ServerId == "off" })
+	broker.publish(t, "ub0r/receiver/receiver-kitchen/set/power", "on")
+	waitForReceiver(t, r, "power on", func(r *Receiver) bool { return r.ServerId == "server-example.com:48100" })
+
+	// pings keep the connection alive
+	time.Sleep(3 * client.KeepAlive)
+	if n := atomic.LoadInt32(&broker.pings); n < 2 {
+		t.Errorf("%d pings, want at least 2", n)
+	}
+	select {
+	case err := <-result:
+		t.Fatalf("connection failed while answering pings: %s", err)
+	default:
+	}
+
+	// a silent broker is detected
+	atomic.StoreInt32(&broker.silent, 1)
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("connection to silent broker ended without error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent broker not detected")
+	}
+}
+
+func TestMqttConnectRefused(t *testing.T) {
+	broker := newFakeBroker(t)
+	defer broker.close()
+	client := &MqttClient{Uri: broker.uri(), ClientId: "test", KeepAlive: time.Second}
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.Connect()
+		result <- err
+	}()
+	broker.next(t, mqttConnect)
+	broker.out.writePacket(mqttConnack<<4, []byte{0, 5})
+	if err := <-result; err == nil || err.Error() != "connection refused: not authorized" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// reads exactly the given bytes from the client
+func expectBytes(t *testing.T, conn net.Conn, what string, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("%s: %s", what, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: got % x, want % x", what, got, want)
+	}
+}
+
+// packets on the wire, checked without the client's own encoding
+func TestMqttWireFormat(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	u, _ := url.Parse("tcp://" + ln.Addr().String())
+	messages := make(chan string, 2)
+	client := &MqttClient{Uri: u, ClientId: "c1", User: "u", Password: "p", KeepAlive: time.Minute,
+		WillTopic: "w", WillPayload: "off",
+		OnMessage: func(topic string, payload []byte) { messages <- topic + " " + string(payload) }}
+	long := bytes.Repeat([]byte("x"), 200)
+	result := make(chan error, 1)
+	go func() {
+		result <- client.Run(func() {
+			client.Subscribe("a/+")
+			client.Publish("t", long, true)
+		})
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expectBytes(t, conn, "connect", []byte{
+		0x10, 28,
+		0, 4, 'M', 'Q', 'T', 'T', 4,
+		// user, password, will retained, will, clean session
+		0xe6,
+		// keep alive 60s
+		0, 60,
+		0, 2, 'c', '1',
+		0, 1, 'w',
+		0, 3, 'o', 'f', 'f',
+		0, 1, 'u',
+		0, 1, 'p',
+	})
+	conn.Write([]byte{0x20, 2, 0, 0})
+	expectBytes(t, conn, "subscribe", []byte{0x82, 8, 0, 1, 0, 3, 'a', '/', '+', 0})
+	// retained, remaining length 203 in two bytes
+	expectBytes(t, conn, "publish", append([]byte{0x31, 0xcb, 0x01, 0, 1, 't'}, long...))
+
+	// incoming publish with remaining length 305, QoS 1 acknowledged
+	in := bytes.Repeat([]byte("y"), 298)
+	conn.Write(append([]byte{0x32, 0xb1, 0x02, 0, 3, 'a', '/', 'b', 0x12, 0x34}, in...))
+	expectBytes(t, conn, "puback", []byte{0x40, 2, 0x12, 0x34})
+	select {
+	case m := <-messages:
+		if m != "a/b "+string(in) {
+			t.Errorf("received %q", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	conn.Close()
+	if err := <-result; err == nil {
+		t.Error("closed connection ended without error")
+	}
+}
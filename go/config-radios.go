@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	maxLogoSize = 1 << 20
+	logoPath    = "/static/logos/"
+)
+
+// raster images only, svg may carry scripts
+var logoTypes = map[string]string{
+	"image/png":    ".png",
+	"image/jpeg":   ".jpg",
+	"image/gif":    ".gif",
+	"image/x-icon": ".ico",
+}
+
+// Sorting -----------------------------------------
+
+// favorites first, then user defined order, then name
+type radiosByPreference []*Radio
+
+func (a radiosByPreference) Len() int      { return len(a) }
+func (a radiosByPreference) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a radiosByPreference) Less(i, j int) bool {
+	if a[i].Favorite != a[j].Favorite {
+		return a[i].Favorite
+	}
+	// radios without order go last
+	if a[i].Order != a[j].Order {
+		return a[j].Order == 0 || (a[i].Order != 0 && a[i].Order < a[j].Order)
+	}
+	return strings.ToLower(a[i].Name) < strings.ToLower(a[j].Name)
+}
+
+func sortedRadios(radios map[string]*Radio) []*Radio {
+	l := make([]*Radio, 0, len(radios))
+	for _, r := range radios {
+		l = append(l, r)
+	}
+	sort.Sort(radiosByPreference(l))
+	return l
+}
+
+// Filtering ---------------------------------------
+
+func (r *Radio) hasTag(tag string) bool {
+	for _, t := range r.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterRadios(radios []*Radio, tag string, favorite bool) []*Radio {
+	l := make([]*Radio, 0, len(radios))
+	for _, r := range radios {
+		if (tag == "" || r.hasTag(tag)) && (!favorite || r.Favorite) {
+			l = append(l, r)
+		}
+	}
+	return l
+}
+
+// Ordering ----------------------------------------
+
+// set order of the given radios, radios not listed keep their order behind them
+func (c *Config) orderRadios(ids []string) error {
+	for _, id := range ids {
+		if !c.hasRadio(id) {
+			return fmt.Errorf("radio not found: %s", id)
+		}
+	}
+	listed := make(map[string]bool)
+	for i, id := range ids {
+		c.Radios[id].Order = i + 1
+		listed[id] = true
+	}
+	next := len(ids) + 1
+	for _, r := range sortedRadios(c.Radios) {
+		if !listed[r.Id()] && r.Order != 0 {
+			r.Order = next
+			next += 1
+		}
+	}
+	return nil
+}
+
+// Logos -------------------------------------------
+
+// uploaded logos are named after their radio
+func ownLogo(id, logo string) bool {
+	name := strings.TrimPrefix(logo, logoPath)
+	return name != logo && strings.TrimSuffix(name, filepath.Ext(name)) == id
+}
+
+// uploaded logo of the radio, never the file of another one
+func logoFile(r *Radio) string {
+	if !ownLogo(r.Id(), r.Logo) {
+		return ""
+	}
+	return filepath.Join(*logoDir, strings.TrimPrefix(r.Logo, logoPath))
+}
+
+// logos are uris or the radio's own upload
+func checkLogo(r *Radio, logo string) error {
+	if strings.HasPrefix(logo, logoPath) && !ownLogo(r.Id(), logo) {
+		return fmt.Errorf("logo of another radio: %s", logo)
+	}
+	return nil
+}
+
+func removeLogoFile(f string) {
+	if f == "" {
+		return
+	}
+	if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+		log.Error("error removing logo: %s", err)
+	}
+}
+
+func removeLogo(r *Radio) {
+	removeLogoFile(logoFile(r))
+}
+
+// write the logo of the radio with the given id, returns its file
+func writeLogo(id, mimeType string, body io.Reader) (string, error) {
+	ext, ok := logoTypes[mimeType]
+	if !ok {
+		return "", fmt.Errorf("unsupported image type '%s'", mimeType)
+	}
+	if err := os.MkdirAll(*logoDir, 0755); err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(filepath.Join(*logoDir, id+ext))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, io.LimitReader(body, maxLogoSize+1))
+	if err != nil {
+		return "", err
+	}
+	if n > maxLogoSize {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("image exceeds %d bytes", maxLogoSize)
+	}
+	return f.Name(), nil
+}
+
+// HTTP --------------------------------------------
+
+// GET /api/radios?tag=${tag}&favorite=[true,false]
+func serveApiRadios(w http.ResponseWriter, req *http.Request) *ServeError {
+	tag := req.URL.Query().Get("tag")
+	favorite := req.URL.Query().Get("favorite") == "true"
+	log.Debug("/api/radios tag: %s, favorite: %v", tag, favorite)
+	return serveJson(w, req, filterRadios(sortedRadios(config.Radios), tag, favorite))
+}
+
+// POST /api/radios/order ["${radio-id}", ...]
+func serveApiRadiosOrder(w http.ResponseWriter, req *http.Request) *ServeError {
+	var ids []string
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&ids); err != nil {
+		return NewError(fmt.Sprintf("somthing went wrong parsing body: %s", err), http.StatusBadRequest)
+	}
+	log.Debug("/api/radios/order ids: %s", ids)
+
+	if err := config.orderRadios(ids); err != nil {
+		return NewError(err.Error(), http.StatusNotFound)
+	}
+	notifyNewConfig()
+	return serveJson(w, req, sortedRadios(config.Radios))
+}
+
+// POST /api/radio/logo?id=${radio-id}
+// DELETE /api/radio/logo?id=${radio-id}
+func serveApiRadioLogo(w http.ResponseWriter, req *http.Request) *ServeError {
+	id := req.URL.Query().Get("id")
+	log.Debug("/api/radio/logo id: %s", id)
+	configLock.Lock()
+	_, ok := config.Radios[id]
+	configLock.Unlock()
+	if !ok {
+		return NewError("radio not found", http.StatusNotFound)
+	}
+
+	// uploads are written without holding the lock
+	file := ""
+	if req.Method == "POST" {
+		mimeType := strings.TrimSpace(strings.Split(req.Header.Get("Content-Type"), ";")[0])
+		var err error
+		if file, err = writeLogo(id, mimeType, req.Body); err != nil {
+			return NewError(fmt.Sprintf("error saving logo: %s", err), http.StatusBadRequest)
+		}
+	} else if req.Method != "DELETE" {
+		return NewError(fmt.Sprintf("method not allowed: %s", req.Method), http.StatusMethodNotAllowed)
+	}
+
+	configLock.Lock()
+	r, ok := config.Radios[id]
+	if !ok {
+		// removed while uploading
+		configLock.Unlock()
+		removeLogoFile(file)
+		return NewError("radio not found", http.StatusNotFound)
+	}
+	old := logoFile(r)
+	r.Logo = ""
+	if file != "" {
+		r.Logo = logoPath + filepath.Base(file)
+	}
+	notifyNewConfig()
+	radio := *r
+	configLock.Unlock()
+
+	if old != file {
+		removeLogoFile(old)
+	}
+	return serveJson(w, req, &radio)
+}
+
+// GET /static/logos/${file}
+// uploaded files are never rendered as documents, even logos uploaded by older versions
+func serveLogos() http.Handler {
+	files := http.StripPrefix(logoPath, http.FileServer(http.Dir(*logoDir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, req)
+	})
+}
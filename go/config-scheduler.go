@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	actionRadio = "radio"
+	actionOff   = "off"
+
+	rampStep = 2 * time.Second
+)
+
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@weekdays": "0 0 * * 1-5",
+	"@weekends": "0 0 * * 0,6",
+}
+
+// Cron --------------------------------------------
+
+// parsed cron expression: minute hour day-of-month month day-of-week
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+			step = s
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value '%s'", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range [%d,%d]: '%s'", min, max, part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression '%s': expected 5 fields", expr)
+	}
+
+	var c cronSpec
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// sunday is 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+	return &c, nil
+}
+
+func (c *cronSpec) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 ||
+		c.hour&(1<<uint(t.Hour())) == 0 ||
+		c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	// like cron: restricting both days matches either of them
+	if !c.domStar && !c.dowStar {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// Schedules ---------------------------------------
+
+func (s *Schedule) Id() string {
+	return s.Uid
+}
+
+func (s *Schedule) isOneShot() bool {
+	return s.Cron == ""
+}
+
+func (s *Schedule) check(c *Config) error {
+	if s.isOneShot() {
+		if s.At <= 0 {
+			return fmt.Errorf("either cron or at is mandatory")
+		}
+	} else if _, err := parseCron(s.Cron); err != nil {
+		return err
+	}
+	if s.Action == actionRadio {
+		if !c.hasRadio(s.RadioId) {
+			return fmt.Errorf("radio not found: %s", s.RadioId)
+		}
+	} else if s.Action != actionOff {
+		return fmt.Errorf("unknown action '%s'", s.Action)
+	}
+	if err := checkVolume(s.Volume, maxVolume); err != nil {
+		return err
+	}
+	if err := checkVolume(s.RampFrom, maxVolume); err != nil {
+		return fmt.Errorf("ramp: %s", err)
+	}
+	if s.RampSeconds < 0 {
+		return fmt.Errorf("invalid ramp duration")
+	}
+	if len(s.Receivers) == 0 && s.Group == "" {
+		return fmt.Errorf("receivers or group is mandatory")
+	}
+	return nil
+}
+
+func (s *Schedule) isDue(t time.Time) bool {
+	if !s.Enabled {
+		return false
+	}
+	if s.isOneShot() {
+		return s.At <= t.Unix()
+	}
+	// run at most once per minute
+	if s.LastRun >= t.Truncate(time.Minute).Unix() {
+		return false
+	}
+	c, err := parseCron(s.Cron)
+	if err != nil {
+		log.Error("invalid schedule %s: %s", s.Id(), err)
+		return false
+	}
+	return c.matches(t)
+}
+
+// receivers targeted by a schedule
+func (s *Schedule) targets(c *Config) []*Receiver {
+	receivers := make([]*Receiver, 0)
+	for k, r := range c.Receivers {
+		if s.Group != "" && r.Group == s.Group {
+			receivers = append(receivers, r)
+			continue
+		}
+		for _, id := range s.Receivers {
+			if id == k {
+				receivers = append(receivers, r)
+				break
+			}
+		}
+	}
+	return receivers
+}
+
+func (c *Config) addSchedule(s *Schedule) {
+	if s.Uid == "" {
+		s.Uid = newScheduleId()
+	}
+	c.Schedules[s.Id()] = s
+}
+
+func (c *Config) rmSchedule(id string) bool {
+	if _, ok := c.Schedules[id]; ok {
+		delete(c.Schedules, id)
+		return true
+	}
+	return false
+}
+
+// schedules tuning to a removed radio stay around disabled for the user to fix
+func (c *Config) disableSchedulesWithRadio(radio_id string) {
+	for k, s := range c.Schedules {
+		if s.Action == actionRadio && s.RadioId == radio_id && s.Enabled {
+			log.Info("disabling schedule %s of removed radio %s", k, radio_id)
+			s.Enabled = false
+		}
+	}
+}
+
+func newScheduleId() string {
+	return strings.Replace(newRadioId(), "radio-", "schedule-", 1)
+}
+
+// Scheduler ---------------------------------------
+
+type Scheduler struct {
+	clock Clock
+	// volume last set by a ramp for each receiver
+	ramps     map[string]int
+	rampsLock sync.Mutex
+}
+
+func NewScheduler(clock Clock) *Scheduler {
+	return &Scheduler{clock: clock, ramps: make(map[string]int)}
+}
+
+func (s *Scheduler) setRamp(id string, v int) {
+	s.rampsLock.Lock()
+	s.ramps[id] = v
+	s.rampsLock.Unlock()
+}
+
+func (s *Scheduler) getRamp(id string) (int, bool) {
+	s.rampsLock.Lock()
+	defer s.rampsLock.Unlock()
+	v, ok := s.ramps[id]
+	return v, ok
+}
+
+// ramp volume of a receiver in steps, stops if somebody else changed the volume
+func (s *Scheduler) rampVolume(r *Receiver, from, to int, d time.Duration) {
+	id := r.Id()
+	steps := int(d / rampStep)
+	if steps < 1 {
+		steps = 1
+	}
+	for i := 1; i <= steps; i++ {
+		<-s.clock.After(rampStep)
+		configLock.Lock()
+		if v, ok := s.getRamp(id); !ok || r.Volume != v {
+			configLock.Unlock()
+			log.Info("stop volume ramp for %s: volume changed", id)
+			return
+		}
+		v := from + (to-from)*i/steps
+		s.setRamp(id, v)
+		r.Volume = v
+		notifyNewConfig()
+		configLock.Unlock()
+	}
+	s.rampsLock.Lock()
+	delete(s.ramps, id)
+	s.rampsLock.Unlock()
+}
+
+func (s *Scheduler) run(sc *Schedule) {
+	if sc.Action == actionRadio && !config.hasRadio(sc.RadioId) {
+		log.Warning("disabling schedule %s: radio not found: %s", sc.Id(), sc.RadioId)
+		sc.Enabled = false
+		return
+	}
+	log.Info("running schedule %s: %s", sc.Id(), sc.Name)
+	for _, r := range sc.targets(&config) {
+		if sc.Action == actionOff {
+			log.Debug("schedule %s: turning off %s", sc.Id(), r.Id())
+			r.ServerId = "off"
+			continue
+		}
+
+		log.Debug("schedule %s: tuning %s to %s", sc.Id(), r.Id(), sc.RadioId)
+		server_id, err := findOrSpawnServer(sc.RadioId, r)
+		if err != nil {
+			log.Error("schedule %s: unable to tune %s: %s", sc.Id(), r.Id(), err)
+			continue
+		}
+		r.ServerId = server_id
+		r.LastRadioId = sc.RadioId
+		if sc.Volume > 0 {
+			// receivers enforce their own limit
+			from, to := r.limitVolume(sc.RampFrom), r.limitVolume(sc.Volume)
+			r.Muted = false
+			if sc.RampSeconds > 0 {
+				s.setRamp(r.Id(), from)
+				r.Volume = from
+				go s.rampVolume(r, from, to, time.Duration(sc.RampSeconds)*time.Second)
+			} else {
+				r.Volume = to
+			}
+		}
+	}
+}
+
+func (s *Scheduler) runDue(t time.Time) {
+	changed := false
+	for k, sc := range config.Schedules {
+		if !sc.isDue(t) {
+			continue
+		}
+		s.run(sc)
+		sc.LastRun = t.Unix()
+		changed = true
+		if sc.isOneShot() {
+			delete(config.Schedules, k)
+		}
+	}
+	if changed {
+		notifyNewConfig()
+	}
+}
+
+// check schedules at the start of every minute
+func (s *Scheduler) loop() {
+	for {
+		now := s.clock.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		t := <-s.clock.After(next.Sub(now))
+		// schedules run on the leading config server only
+		if isLeader() {
+			configLock.Lock()
+			s.runDue(t)
+			configLock.Unlock()
+		}
+	}
+}
+
+// HTTP --------------------------------------------
+
+// GET /api/schedule
+// POST /api/schedule
+// DELETE /api/schedule?id=${schedule-id}
+func serveApiSchedule(w http.ResponseWriter, req *http.Request) *ServeError {
+	id := req.URL.Query().Get("id")
+	log.Debug("/api/schedule id: %s", id)
+	if req.Method == "GET" {
+		return serveJson(w, req, config.Schedules)
+	} else if req.Method == "POST" {
+		var o Schedule
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&o); err != nil {
+			return NewError(fmt.Sprintf("somthing went wrong parsing body: %s", err), http.StatusBadRequest)
+		}
+		if err := o.check(&config); err != nil {
+			return NewError(fmt.Sprintf("invalid schedule: %s", err), http.StatusBadRequest)
+		}
+		config.addSchedule(&o)
+		notifyNewConfig()
+		return serveJson(w, req, o)
+	} else if req.Method == "DELETE" {
+		if !config.rmSchedule(id) {
+			return NewError("schedule not found", http.StatusNotFound)
+		}
+		notifyNewConfig()
+		return serveJson(w, req, nil)
+	} else {
+		return NewError(fmt.Sprintf("method not allowed: %s", req.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+// POST /api/sleep?id=${receiver-id}&minutes=${minutes}
+// DELETE /api/sleep?id=${receiver-id}
+func serveApiSleep(w http.ResponseWriter, req *http.Request) *ServeError {
+	receiver_id := req.URL.Query().Get("id")
+	minutes := req.URL.Query().Get("minutes")
+	log.Debug("/api/sleep receiver: %s, minutes: %s", receiver_id, minutes)
+
+	if _, ok := config.Receivers[receiver_id]; !ok {
+		return NewError(fmt.Sprintf("receiver not found: %s", receiver_id), http.StatusNotFound)
+	}
+
+	// a receiver has a single sleep timer
+	for k, sc := range config.Schedules {
+		if sc.isOneShot() && sc.Action == actionOff && len(sc.Receivers) == 1 && sc.Receivers[0] == receiver_id {
+			delete(config.Schedules, k)
+		}
+	}
+
+	if req.Method == "DELETE" {
+		notifyNewConfig()
+		return serveJson(w, req, nil)
+	}
+
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m <= 0 {
+		return NewError(fmt.Sprintf("invalid minutes '%s'", minutes), http.StatusBadRequest)
+	}
+	sc := &Schedule{
+		Name:      "sleep timer",
+		Enabled:   true,
+		At:        scheduler.clock.Now().Add(time.Duration(m) * time.Minute).Unix(),
+		Action:    actionOff,
+		Receivers: []string{receiver_id},
+	}
+	config.addSchedule(sc)
+	notifyNewConfig()
+	return serveJson(w, req, sc)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 2024-01-01 is a monday
+func date(month time.Month, day, hour, minute int) time.Time {
+	return time.Date(2024, month, day, hour, minute, 0, 0, time.Local)
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr  string
+		match []time.Time
+		miss  []time.Time
+	}{
+		{"*/15 * * * *",
+			[]time.Time{date(1, 1, 10, 0), date(1, 1, 10, 45)},
+			[]time.Time{date(1, 1, 10, 20)}},
+		{"5/20 * * * *",
+			[]time.Time{date(1, 1, 10, 5), date(1, 1, 10, 25), date(1, 1, 10, 45)},
+			[]time.Time{date(1, 1, 10, 0), date(1, 1, 10, 20)}},
+		{"0,30 6-8 * * *",
+			[]time.Time{date(1, 1, 6, 0), date(1, 1, 8, 30)},
+			[]time.Time{date(1, 1, 5, 30), date(1, 1, 9, 0), date(1, 1, 7, 15)}},
+		{"30 6 * * 1-5",
+			[]time.Time{date(1, 1, 6, 30), date(1, 5, 6, 30)},
+			[]time.Time{date(1, 6, 6, 30), date(1, 7, 6, 30), date(1, 1, 6, 31)}},
+		// sunday is 0 or 7
+		{"0 8 * * 7",
+			[]time.Time{date(1, 7, 8, 0)},
+			[]time.Time{date(1, 6, 8, 0)}},
+		{"@weekends",
+			[]time.Time{date(1, 6, 0, 0), date(1, 7, 0, 0)},
+			[]time.Time{date(1, 8, 0, 0)}},
+		{"0 0 * 2-6/2 *",
+			[]time.Time{date(2, 1, 0, 0), date(4, 1, 0, 0), date(6, 30, 0, 0)},
+			[]time.Time{date(3, 1, 0, 0), date(7, 1, 0, 0)}},
+		// restricting day of month and day of week matches either
+		{"0 12 1 * 1",
+			[]time.Time{date(1, 1, 12, 0), date(2, 1, 12, 0), date(1, 8, 12, 0)},
+			[]time.Time{date(1, 9, 12, 0)}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %s", tt.expr, err)
+			continue
+		}
+		for _, m := range tt.match {
+			if !c.matches(m) {
+				t.Errorf("%q should match %s", tt.expr, m)
+			}
+		}
+		for _, m := range tt.miss {
+			if c.matches(m) {
+				t.Errorf("%q should not match %s", tt.expr, m)
+			}
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) should fail", expr)
+		}
+	}
+}
+
+func TestScheduleIsDueOneShot(t *testing.T) {
+	now := date(1, 1, 6, 30)
+	s := &Schedule{Enabled: true, At: now.Unix()}
+	if !s.isDue(now) {
+		t.Error("one-shot schedule should be due at its time")
+	}
+	if !s.isDue(now.Add(time.Hour)) {
+		t.Error("one-shot schedule should be due after its time")
+	}
+	if s.isDue(now.Add(-time.Second)) {
+		t.Error("one-shot schedule should not be due before its time")
+	}
+	s.Enabled = false
+	if s.isDue(now) {
+		t.Error("disabled schedule should not be due")
+	}
+}
+
+func TestScheduleIsDueRepeating(t *testing.T) {
+	now := date(1, 1, 6, 30).Add(10 * time.Second)
+	s := &Schedule{Enabled: true, Cron: "30 6 * * *"}
+	if !s.isDue(now) {
+		t.Error("schedule should be due")
+	}
+	if s.isDue(now.Add(time.Minute)) {
+		t.Error("schedule should not be due in other minutes")
+	}
+
+	// at most once per minute
+	s.LastRun = now.Unix()
+	if s.isDue(now.Add(20 * time.Second)) {
+		t.Error("schedule should not run twice in a minute")
+	}
+	if !s.isDue(now.Add(24 * time.Hour)) {
+		t.Error("schedule should be due again the next day")
+	}
+
+	s.Cron = "invalid"
+	if s.isDue(now.Add(24 * time.Hour)) {
+		t.Error("invalid schedule should never be due")
+	}
+}
+
+func newRampTest(volume int) (*Scheduler, *fakeClock, *Receiver) {
+	clock := newFakeClock(date(1, 1, 6, 30))
+	s := NewScheduler(clock)
+	config = NewConfig()
+	r := &Receiver{Name: "kitchen", Volume: volume}
+	config.Receivers[r.Id()] = r
+	s.setRamp(r.Id(), volume)
+	return s, clock, r
+}
+
+func volumeOf(r *Receiver) int {
+	configLock.Lock()
+	defer configLock.Unlock()
+	return r.Volume
+}
+
+func TestRampVolume(t *testing.T) {
+	s, clock, r := newRampTest(10)
+	done := make(chan bool)
+	go func() {
+		s.rampVolume(r, 10, 50, 4*rampStep)
+		close(done)
+	}()
+
+	for i, want := range []int{20, 30, 40, 50} {
+		clock.waitFor(t, 1)
+		if v := volumeOf(r); v != want-10 {
+			t.Fatalf("step %d: volume %d before step, want %d", i, v, want-10)
+		}
+		clock.Advance(rampStep)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ramp didn't finish")
+	}
+	if v := volumeOf(r); v != 50 {
+		t.Errorf("volume %d after ramp, want 50", v)
+	}
+	if _, ok := s.getRamp(r.Id()); ok {
+		t.Error("finished ramp should be forgotten")
+	}
+}
+
+func TestRampVolumeStopsOnChange(t *testing.T) {
+	s, clock, r := newRampTest(10)
+	done := make(chan bool)
+	go func() {
+		s.rampVolume(r, 10, 50, 4*rampStep)
+		close(done)
+	}()
+
+	clock.waitFor(t, 1)
+	clock.Advance(rampStep)
+	clock.waitFor(t, 1)
+	if v := volumeOf(r); v != 20 {
+		t.Fatalf("volume %d after first step, want 20", v)
+	}
+
+	// somebody turned the volume down
+	configLock.Lock()
+	r.Volume = 5
+	configLock.Unlock()
+	clock.Advance(rampStep)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ramp didn't stop")
+	}
+	if v := volumeOf(r); v != 5 {
+		t.Errorf("volume %d after stopped ramp, want 5", v)
+	}
+}
+
+func TestRampVolumeShort(t *testing.T) {
+	s, clock, r := newRampTest(10)
+	done := make(chan bool)
+	go func() {
+		// shorter than a step, jumps in one
+		s.rampVolume(r, 10, 40, time.Second)
+		close(done)
+	}()
+	clock.waitFor(t, 1)
+	clock.Advance(rampStep)
+	<-done
+	if v := volumeOf(r); v != 40 {
+		t.Errorf("volume %d, want 40", v)
+	}
+}
+
+func TestRunDueRemovedRadio(t *testing.T) {
+	config = NewConfig()
+	managers = make(map[string]InternalSender)
+	r := &Receiver{Name: "kitchen", ServerId: "off"}
+	config.Receivers[r.Id()] = r
+	sc := &Schedule{Uid: "schedule-1", Enabled: true, Cron: "* * * * *", Action: actionRadio, RadioId: "radio-gone", Receivers: []string{r.Id()}}
+	config.Schedules[sc.Id()] = sc
+
+	// a radio gone without disabling the schedule, e.g. in a replicated config
+	NewScheduler(newFakeClock(date(1, 1, 6, 0))).runDue(date(1, 1, 6, 0))
+	if sc.Enabled || r.ServerId != "off" || len(config.Servers) != 0 {
+		t.Errorf("schedule enabled %t, receiver on %s, %d senders", sc.Enabled, r.ServerId, len(config.Servers))
+	}
+	if _, err := spawnInternalServer("radio-gone"); err == nil {
+		t.Error("spawned sender for unknown radio")
+	}
+}
+
+func TestRemovingRadioDisablesSchedules(t *testing.T) {
+	for _, remove := range []func(){
+		func() { config.rmRadio("radio-1") },
+		func() {
+			config.importRadios([]byte(`[{"Name": "Two", "Uri": "http://example.com/two"}]`), formatJson, importReplace)
+		},
+	} {
+		dir := t.TempDir()
+		logoDir = &dir
+		config = NewConfig()
+		config.Radios["radio-1"] = &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one"}
+		config.Radios["radio-2"] = &Radio{Uid: "radio-2", Name: "Two", Uri: "http://example.com/two"}
+		one := &Schedule{Uid: "schedule-1", Enabled: true, Action: actionRadio, RadioId: "radio-1"}
+		two := &Schedule{Uid: "schedule-2", Enabled: true, Action: actionRadio, RadioId: "radio-2"}
+		off := &Schedule{Uid: "schedule-3", Enabled: true, Action: actionOff}
+		for _, s := range []*Schedule{one, two, off} {
+			config.Schedules[s.Id()] = s
+		}
+		remove()
+		if one.Enabled || !two.Enabled || !off.Enabled {
+			t.Errorf("enabled after removing radio-1: %t, %t, %t", one.Enabled, two.Enabled, off.Enabled)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// vendored libraries carry their version in the file name
+	cacheControlLib     = "public, max-age=31536000"
+	cacheControlDefault = "no-cache"
+)
+
+// web ui next to the sources, vendored libraries are downloaded by make vendor
+//
+//go:embed static
+var embeddedFiles embed.FS
+
+// static web ui either embedded into the binary or read from disk
+type StaticFiles struct {
+	fs    fs.FS
+	etags map[string]string
+}
+
+func NewEmbeddedFiles() *StaticFiles {
+	sub, err := fs.Sub(embeddedFiles, "static")
+	if err != nil {
+		log.Fatal("unable to read embedded files: %s", err)
+	}
+	s := &StaticFiles{sub, make(map[string]string)}
+	s.hashFiles()
+	return s
+}
+
+// files on disk may change, they are served without etags
+func NewDiskFiles(dir string) *StaticFiles {
+	return &StaticFiles{os.DirFS(dir), nil}
+}
+
+func (s *StaticFiles) hashFiles() {
+	fs.WalkDir(s.fs, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(s.fs, name)
+		if err != nil {
+			return err
+		}
+		s.etags[name] = fmt.Sprintf("\"%x\"", sha1.Sum(b))
+		return nil
+	})
+	log.Debug("hashed %d embedded files", len(s.etags))
+}
+
+func (s *StaticFiles) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	f, err := s.fs.Open(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || st.IsDir() {
+		http.NotFound(w, req)
+		return
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rs = bytes.NewReader(b)
+	}
+
+	if etag, ok := s.etags[name]; ok {
+		w.Header().Set("ETag", etag)
+	}
+	if s.etags != nil && strings.HasPrefix(name, "lib/") {
+		w.Header().Set("Cache-Control", cacheControlLib)
+	} else {
+		w.Header().Set("Cache-Control", cacheControlDefault)
+	}
+	// handles If-None-Match and If-Modified-Since
+	http.ServeContent(w, req, name, st.ModTime(), rs)
+}
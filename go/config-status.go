@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// status of a single receiver or server as shown in the ui
+type DeviceStatus struct {
+	Id       string
+	Kind     string
+	Name     string
+	LastPing int64
+	Age      int64
+	Stale    bool
+	Status   *Status
+}
+
+type StatusReport struct {
+	Revision int64
+	Started  int64
+	Devices  []*DeviceStatus
+}
+
+var started = time.Now().Unix()
+
+func newDeviceStatus(id, kind, name string, lastPing int64, s *Status) *DeviceStatus {
+	d := &DeviceStatus{Id: id, Kind: kind, Name: name, LastPing: lastPing, Status: s}
+	d.Age = time.Now().Unix() - lastPing
+	d.Stale = d.Age > int64(backendTimeout/time.Second)
+	return d
+}
+
+func (c *Config) statusReport() *StatusReport {
+	r := &StatusReport{Revision: c.Revision, Started: started}
+	r.Devices = make([]*DeviceStatus, 0, len(c.Receivers)+len(c.Servers))
+	for k, o := range c.Receivers {
+		r.Devices = append(r.Devices, newDeviceStatus(k, "receiver", o.Name, o.LastPing, o.Status))
+	}
+	for k, o := range c.Servers {
+		if !o.Internal {
+			r.Devices = append(r.Devices, newDeviceStatus(k, "server", o.Name, o.LastPing, o.Status))
+			continue
+		}
+		// internal servers don't ping, ask their pipeline directly
+		var s *Status
+		if m, ok := managers[k]; ok {
+			s = m.Status()
+		}
+		d := newDeviceStatus(k, "server", o.Name, time.Now().Unix(), s)
+		r.Devices = append(r.Devices, d)
+	}
+	sort.Slice(r.Devices, func(i, j int) bool {
+		return r.Devices[i].Id < r.Devices[j].Id
+	})
+	return r
+}
+
+// GET /api/status
+func serveApiStatus(w http.ResponseWriter, req *http.Request) *ServeError {
+	b, err := json.Marshal(config.statusReport())
+	if err != nil {
+		return NewInternalError(fmt.Sprintf("error marshalling status: %s", err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// internal senders run as rtp-sender processes supervised by the config server
+// a crash in a pipeline takes down its process only, the supervisor restarts it with backoff
+
+// sender modes
+const (
+	senderModeProcess   = "process"
+	senderModeInProcess = "inprocess"
+)
+
+const (
+	healthInterval = 5 * time.Second
+	// failed health checks in a row before killing a sender process
+	maxHealthFailures = 3
+	// wait for sender processes to exit before killing them
+	stopTimeout = 5 * time.Second
+	// log lines kept per sender process
+	senderLogLines = 100
+)
+
+var (
+	senderMode   *string
+	senderBinary *string
+	// crashed sender processes
+	processBackoff = BackoffPolicy{
+		Initial:     time.Second,
+		Max:         time.Minute,
+		Multiplier:  2,
+		Jitter:      0.1,
+		MaxAttempts: 10,
+	}
+	processRestarts = metrics.NewCounter("ub0r_sender_process_restarts_total", "Restarts of crashed or unresponsive sender processes", "id")
+	healthClient    = &http.Client{Timeout: 2 * time.Second}
+)
+
+// internal sender running in the config server or in a supervised process
+type InternalSender interface {
+	Server() *Server
+	Status() *Status
+	// runs until stopped
+	startSender()
+	// pick up a new radio uri
+	restartSender()
+	stopSender()
+}
+
+func checkSenderMode(mode string) error {
+	return checkOneOf(mode, senderModeProcess, senderModeInProcess)
+}
+
+// rtp-sender next to the config server's binary, else from the path
+func defaultSenderBinary() string {
+	if exe, err := os.Executable(); err == nil {
+		bin := filepath.Join(filepath.Dir(exe), "rtp-sender")
+		if _, err := os.Stat(bin); err == nil {
+			return bin
+		}
+	}
+	return "rtp-sender"
+}
+
+func newInternalSender(s *Server) InternalSender {
+	if *senderMode == senderModeInProcess {
+		m := newManager()
+		m.Backend = s
+		m.ConfigUri = fmt.Sprintf("http://localhost:%d", *port)
+		m.Complexity = *complexity
+		return m
+	}
+	return NewSenderProcess(s)
+}
+
+// Sender processes ---------------------------------
+
+type SenderProcess struct {
+	server *Server
+	// rtp-sender to run
+	binary string
+	clock  Clock
+	lock   sync.Mutex
+	cmd    *exec.Cmd
+	// port of the process' health and status endpoints
+	httpPort int
+	running  bool
+	// restart requested, not counted as crash
+	restart bool
+	retry   *Backoff
+	// last status reported by the process
+	status        *Status
+	failed        bool
+	lastError     string
+	lastErrorTime int64
+	errorCount    int
+	started       int64
+	logs          []string
+}
+
+func NewSenderProcess(s *Server) *SenderProcess {
+	return newSenderProcess(s, *senderBinary, realClock{})
+}
+
+func newSenderProcess(s *Server, binary string, clock Clock) *SenderProcess {
+	return &SenderProcess{
+		server:  s,
+		binary:  binary,
+		clock:   clock,
+		retry:   processBackoff.NewBackoff(clock),
+		started: clock.Now().Unix(),
+	}
+}
+
+func (p *SenderProcess) Server() *Server {
+	return p.server
+}
+
+func (p *SenderProcess) Status() *Status {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s := Status{State: "starting"}
+	if p.status != nil {
+		s = *p.status
+	}
+	if p.lastErrorTime > s.LastErrorTime {
+		s.LastError = p.lastError
+		s.LastErrorTime = p.lastErrorTime
+	}
+	s.ErrorCount += p.errorCount
+	s.RetryCount = p.retry.Attempts()
+	s.Failed = s.Failed || p.failed
+	if p.failed {
+		s.Ready = false
+	}
+	s.Started = p.started
+	return &s
+}
+
+func (p *SenderProcess) isRunning() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.running
+}
+
+func (p *SenderProcess) setError(err string) {
+	p.lock.Lock()
+	p.lastError = err
+	p.lastErrorTime = time.Now().Unix()
+	p.errorCount += 1
+	p.lock.Unlock()
+	p.reportStatus()
+}
+
+// attach status to the server shared with the config, never hold the process' lock with the config's
+func (p *SenderProcess) reportStatus() {
+	s := p.Status()
+	configLock.Lock()
+	p.server.SetStatus(s)
+	configLock.Unlock()
+}
+
+// arguments of rtp-sender streaming the server's radio
+func (p *SenderProcess) args(httpPort int) []string {
+	s := p.server
+	b := &pipelineBackoff
+	return []string{
+		"--internal",
+		"--name", s.Name,
+		"--host", s.Host,
+		"--port", strconv.Itoa(s.Port),
+		"--uri", s.RadioUri,
+		"--complexity", strconv.Itoa(*complexity),
+		"--http", strconv.Itoa(httpPort),
+		"--retry-initial", b.Initial.String(),
+		"--retry-max", b.Max.String(),
+		"--retry-multiplier", strconv.FormatFloat(b.Multiplier, 'g', -1, 64),
+		"--retry-jitter", strconv.FormatFloat(b.Jitter, 'g', -1, 64),
+		"--max-errors", strconv.Itoa(b.MaxAttempts),
+	}
+}
+
+// environment without options of the config server
+func senderEnv() []string {
+	env := make([]string, 0)
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, envPrefix) {
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// run the process until it exits
+func (p *SenderProcess) run() error {
+	httpPort, err := freeLocalPort()
+	if err != nil {
+		return err
+	}
+	// the radio uri changes with the config
+	configLock.Lock()
+	args := p.args(httpPort)
+	configLock.Unlock()
+	cmd := exec.Command(p.binary, args...)
+	cmd.Env = senderEnv()
+	// don't outlive the config server
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+
+	p.lock.Lock()
+	if !p.running {
+		p.lock.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		p.lock.Unlock()
+		return err
+	}
+	log.Info("started sender process %d for %s", cmd.Process.Pid, p.server.Id())
+	p.cmd = cmd
+	p.httpPort = httpPort
+	p.status = nil
+	p.restart = false
+	p.lock.Unlock()
+
+	p.collectLogs(out)
+	err = cmd.Wait()
+	p.lock.Lock()
+	p.cmd = nil
+	p.lock.Unlock()
+	return err
+}
+
+// forward output of the process to the log and keep its last lines
+func (p *SenderProcess) collectLogs(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log.Info("%s: %s", p.server.Id(), line)
+		p.lock.Lock()
+		p.logs = append(p.logs, line)
+		if len(p.logs) > senderLogLines {
+			p.logs = p.logs[len(p.logs)-senderLogLines:]
+		}
+		p.lock.Unlock()
+	}
+}
+
+func (p *SenderProcess) logLines() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string{}, p.logs...)
+}
+
+// ask the process to exit, killing it if it doesn't, call with lock held
+func (p *SenderProcess) terminate() {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return
+	}
+	proc := p.cmd.Process
+	proc.Signal(syscall.SIGTERM)
+	time.AfterFunc(stopTimeout, func() {
+		proc.Kill()
+	})
+}
+
+// GET /status of the process
+func (p *SenderProcess) check() (*Status, error) {
+	p.lock.Lock()
+	uri := fmt.Sprintf("http://localhost:%d/status", p.httpPort)
+	p.lock.Unlock()
+	resp, err := healthClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var s Status
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (p *SenderProcess) healthLoop() {
+	failures := 0
+	for {
+		<-p.clock.After(healthInterval)
+		if !p.isRunning() {
+			return
+		}
+		s, err := p.check()
+		p.lock.Lock()
+		alive := p.cmd != nil
+		if err == nil {
+			failures = 0
+			p.status = s
+		}
+		p.lock.Unlock()
+		if err == nil {
+			p.reportStatus()
+			continue
+		}
+		if !alive {
+			continue
+		}
+		failures += 1
+		log.Debug("health check of sender process %s failed: %s", p.server.Id(), err)
+		if failures >= maxHealthFailures {
+			log.Warning("killing unresponsive sender process %s", p.server.Id())
+			p.lock.Lock()
+			p.terminate()
+			p.lock.Unlock()
+			failures = 0
+		}
+	}
+}
+
+func (p *SenderProcess) startSender() {
+	log.Debug("starting sender process for %s", p.server.Id())
+	p.lock.Lock()
+	p.running = true
+	p.lock.Unlock()
+	go p.healthLoop()
+
+	for p.isRunning() {
+		err := p.run()
+		p.lock.Lock()
+		running, restart := p.running, p.restart
+		ready := p.status != nil && p.status.Ready
+		p.restart = false
+		p.lock.Unlock()
+		if !running {
+			break
+		}
+		if restart {
+			log.Info("restarting sender process for %s", p.server.Id())
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		log.Warning("sender process for %s failed: %s", p.server.Id(), err)
+		p.setError(fmt.Sprintf("sender process failed: %s", err))
+		// crashes after streaming successfully start over with short delays
+		if ready {
+			p.retry.Reset()
+		}
+		if !p.retry.Wait() {
+			log.Error("giving up after %d restarts of sender process for %s", p.retry.Attempts(), p.server.Id())
+			p.lock.Lock()
+			p.failed = true
+			p.running = false
+			p.lock.Unlock()
+			p.reportStatus()
+			return
+		}
+		processRestarts.Inc(p.server.Id())
+	}
+	log.Debug("sender process for %s stopped", p.server.Id())
+}
+
+func (p *SenderProcess) restartSender() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.restart = true
+	p.terminate()
+}
+
+func (p *SenderProcess) stopSender() {
+	log.Info("stopping sender process: %s", p.server.Id())
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.running = false
+	p.terminate()
+}
+
+// GET /api/server/logs?id=${server-id}
+func serveApiServerLogs(w http.ResponseWriter, req *http.Request) *ServeError {
+	id := req.URL.Query().Get("id")
+	configLock.Lock()
+	sender, ok := managers[id]
+	configLock.Unlock()
+	if !ok {
+		return NewError(fmt.Sprintf("internal server not found: %s", id), http.StatusNotFound)
+	}
+	p, ok := sender.(*SenderProcess)
+	if !ok {
+		return NewError("logs are kept for sender processes only", http.StatusNotFound)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, l := range p.logLines() {
+		fmt.Fprintln(w, l)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sender process printing a line when started, crashing while the crash file exists
+// it never answers health checks
+func newSupervisorTest(t *testing.T, crashing bool) (*SenderProcess, *fakeClock, chan bool) {
+	dir := t.TempDir()
+	crash := filepath.Join(dir, "crash")
+	script := filepath.Join(dir, "rtp-sender")
+	err := os.WriteFile(script, []byte("#!/bin/sh\necho started\n[ -f "+crash+" ] && exit 1\nexec sleep 60\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crashing {
+		os.WriteFile(crash, nil, 0644)
+	}
+	c := 10
+	complexity = &c
+	config = NewConfig()
+	clock := newFakeClock(time.Now())
+	s := &Server{Internal: true, Host: "localhost", Port: 48100, RadioUri: "http://example.com/one"}
+	p := newSenderProcess(s, script, clock)
+	done := make(chan bool)
+	go func() {
+		p.startSender()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		p.stopSender()
+		// let pending retries return
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				clock.Advance(time.Hour)
+			}
+		}
+	})
+	return p, clock, done
+}
+
+func starts(p *SenderProcess) int {
+	n := 0
+	for _, l := range p.logLines() {
+		if l == "started" {
+			n += 1
+		}
+	}
+	return n
+}
+
+// wait for the process to print its nth start and to be known to the supervisor
+func waitForStart(t *testing.T, p *SenderProcess, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.lock.Lock()
+		alive := p.cmd != nil
+		p.lock.Unlock()
+		started := starts(p)
+		if started > n {
+			t.Fatalf("started %d times, want %d", started, n)
+		}
+		if started == n && alive {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for start %d, started %d times", n, started)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSenderProcessRestartNotCounted(t *testing.T) {
+	p, clock, _ := newSupervisorTest(t, false)
+	waitForStart(t, p, 1)
+
+	// restarting for a new uri is no crash
+	p.restartSender()
+	waitForStart(t, p, 2)
+	if s := p.Status(); s.ErrorCount != 0 || s.RetryCount != 0 {
+		t.Errorf("restart counted as crash: %d errors, %d retries", s.ErrorCount, s.RetryCount)
+	}
+
+	// crashes are counted and retried with backoff
+	p.lock.Lock()
+	p.cmd.Process.Kill()
+	p.lock.Unlock()
+	// health check and retry
+	clock.waitFor(t, 2)
+	s := p.Status()
+	if s.ErrorCount != 1 || s.RetryCount != 1 || s.Failed {
+		t.Errorf("after crash: %d errors, %d retries, failed %t", s.ErrorCount, s.RetryCount, s.Failed)
+	}
+	if !strings.Contains(s.LastError, "killed") {
+		t.Errorf("last error %q", s.LastError)
+	}
+	if starts(p) != 2 {
+		t.Errorf("restarted before the retry delay, %d starts", starts(p))
+	}
+}
+
+func TestSenderProcessGivesUp(t *testing.T) {
+	attempts := processBackoff.MaxAttempts
+	processBackoff.MaxAttempts = 2
+	defer func() { processBackoff.MaxAttempts = attempts }()
+	p, clock, done := newSupervisorTest(t, true)
+
+	for i := 0; i < 2; i++ {
+		clock.waitFor(t, 2)
+		clock.Advance(processBackoff.Max * 2)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("crashing sender process not given up")
+	}
+	if s := p.Status(); !s.Failed || s.ErrorCount != 3 || starts(p) != 3 {
+		t.Errorf("failed %t, %d errors, %d starts", s.Failed, s.ErrorCount, starts(p))
+	}
+	if p.server.Status == nil || !p.server.Status.Failed {
+		t.Error("failure not reported to the config")
+	}
+}
+
+func TestSenderProcessUnresponsiveKilled(t *testing.T) {
+	p, clock, _ := newSupervisorTest(t, false)
+	waitForStart(t, p, 1)
+
+	for i := 1; i < maxHealthFailures; i++ {
+		clock.waitFor(t, 1)
+		clock.Advance(healthInterval)
+	}
+	// the health loop waits for its next check
+	clock.waitFor(t, 1)
+	if s := p.Status(); s.ErrorCount != 0 {
+		t.Fatalf("killed after %d failed health checks, %s", maxHealthFailures-1, s.LastError)
+	}
+
+	clock.Advance(healthInterval)
+	// killed and waiting for the retry
+	clock.waitFor(t, 2)
+	if s := p.Status(); s.ErrorCount != 1 || !strings.Contains(s.LastError, "terminated") {
+		t.Errorf("after %d failed health checks: %d errors, %q", maxHealthFailures, s.ErrorCount, s.LastError)
+	}
+}
+
+func TestSenderProcessStopWhileRetrying(t *testing.T) {
+	p, clock, done := newSupervisorTest(t, true)
+	clock.waitFor(t, 2)
+
+	p.stopSender()
+	clock.Advance(processBackoff.Max * 2)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopped sender process still retrying")
+	}
+	if starts(p) != 1 {
+		t.Errorf("started %d times after stopping", starts(p))
+	}
+	if s := p.Status(); s.Failed {
+		t.Error("stopped sender process failed")
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	formatJson = "json"
+	formatM3u  = "m3u"
+	formatOpml = "opml"
+
+	scopeRadios = "radios"
+	scopeConfig = "config"
+
+	importMerge   = "merge"
+	importReplace = "replace"
+)
+
+var (
+	m3uAttrRegexp = regexp.MustCompile(`([a-zA-Z0-9-]+)="([^"]*)"`)
+)
+
+type ImportResult struct {
+	Added   int
+	Updated int
+	Removed int
+	Invalid []string
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	Url      string        `xml:"URL,attr,omitempty"`
+	XmlUrl   string        `xml:"xmlUrl,attr,omitempty"`
+	Image    string        `xml:"image,attr,omitempty"`
+	Category string        `xml:"category,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+type opmlDocument struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Title   string        `xml:"head>title"`
+	Body    []opmlOutline `xml:"body>outline"`
+}
+
+// Formats -----------------------------------------
+
+func checkFormat(format string) error {
+	if format == formatJson || format == formatM3u || format == formatOpml {
+		return nil
+	}
+	return fmt.Errorf("unknown format '%s'", format)
+}
+
+// guess format from file name, fall back to json
+func formatFromFile(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".m3u", ".m3u8":
+		return formatM3u
+	case ".opml", ".xml":
+		return formatOpml
+	default:
+		return formatJson
+	}
+}
+
+func contentType(format string) string {
+	switch format {
+	case formatM3u:
+		return "audio/x-mpegurl"
+	case formatOpml:
+		return "text/x-opml"
+	default:
+		return "application/json"
+	}
+}
+
+// m3u has no escaping, entries are single lines and attribute values can't hold quotes
+func m3uValue(v string, attr bool) string {
+	v = strings.Join(strings.Fields(v), " ")
+	if attr {
+		v = strings.Replace(v, "\"", "'", -1)
+	}
+	return v
+}
+
+func writeM3u(w io.Writer, radios []*Radio) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "#EXTM3U")
+	for _, r := range radios {
+		fmt.Fprint(b, "#EXTINF:-1")
+		if r.Logo != "" {
+			fmt.Fprintf(b, " tvg-logo=\"%s\"", m3uValue(r.Logo, true))
+		}
+		if len(r.Tags) > 0 {
+			fmt.Fprintf(b, " group-title=\"%s\"", m3uValue(strings.Join(r.Tags, ";"), true))
+		}
+		fmt.Fprintf(b, ",%s\n%s\n", m3uValue(r.Name, false), m3uValue(r.Uri, false))
+	}
+	return b.Flush()
+}
+
+// index of the comma separating attributes from the title, skipping quoted values
+func m3uTitleIndex(info string) int {
+	quoted := false
+	for i, c := range info {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ',' && !quoted {
+			return i
+		}
+	}
+	return -1
+}
+
+func readM3u(d []byte) ([]*Radio, error) {
+	radios := make([]*Radio, 0)
+	var next *Radio
+	scanner := bufio.NewScanner(bytes.NewReader(d))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line == "#EXTM3U" {
+			continue
+		} else if strings.HasPrefix(line, "#EXTINF:") {
+			next = &Radio{}
+			info := strings.TrimPrefix(line, "#EXTINF:")
+			if i := m3uTitleIndex(info); i >= 0 {
+				next.Name = strings.TrimSpace(info[i+1:])
+				info = info[:i]
+			}
+			for _, a := range m3uAttrRegexp.FindAllStringSubmatch(info, -1) {
+				if a[1] == "tvg-logo" {
+					next.Logo = a[2]
+				} else if a[1] == "group-title" && a[2] != "" {
+					next.Tags = strings.Split(a[2], ";")
+				}
+			}
+		} else if strings.HasPrefix(line, "#") {
+			continue
+		} else {
+			if next == nil {
+				next = &Radio{}
+			}
+			next.Uri = line
+			if next.Name == "" {
+				next.Name = line
+			}
+			radios = append(radios, next)
+			next = nil
+		}
+	}
+	return radios, scanner.Err()
+}
+
+func writeOpml(w io.Writer, radios []*Radio) error {
+	doc := opmlDocument{Version: "2.0", Title: "ub0r streaming radios"}
+	for _, r := range radios {
+		doc.Body = append(doc.Body, opmlOutline{
+			Text:     r.Name,
+			Type:     "audio",
+			Url:      r.Uri,
+			Image:    r.Logo,
+			Category: strings.Join(r.Tags, ","),
+		})
+	}
+	io.WriteString(w, xml.Header)
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	return e.Encode(doc)
+}
+
+func opmlRadios(outlines []opmlOutline, radios []*Radio) []*Radio {
+	for _, o := range outlines {
+		uri := o.Url
+		if uri == "" {
+			uri = o.XmlUrl
+		}
+		if uri != "" {
+			r := &Radio{Name: o.Text, Uri: uri, Logo: o.Image}
+			if r.Name == "" {
+				r.Name = o.Title
+			}
+			if o.Category != "" {
+				r.Tags = strings.Split(o.Category, ",")
+			}
+			radios = append(radios, r)
+		}
+		radios = opmlRadios(o.Outlines, radios)
+	}
+	return radios
+}
+
+func readOpml(d []byte) ([]*Radio, error) {
+	var doc opmlDocument
+	if err := xml.Unmarshal(d, &doc); err != nil {
+		return nil, err
+	}
+	return opmlRadios(doc.Body, make([]*Radio, 0)), nil
+}
+
+// json is either a list of radios or a full config
+func readJson(d []byte) ([]*Radio, *Config, error) {
+	d = bytes.TrimSpace(d)
+	if bytes.HasPrefix(d, []byte("[")) {
+		var radios []*Radio
+		err := json.Unmarshal(d, &radios)
+		return radios, nil, err
+	}
+
+	var c Config
+	if err := json.Unmarshal(d, &c); err != nil {
+		return nil, nil, err
+	}
+	c.migrateRadioIds()
+	return sortedRadios(c.Radios), &c, nil
+}
+
+// Export/Import -----------------------------------
+
+func (c *Config) exportRadios(w io.Writer, format, scope string) error {
+	if err := checkFormat(format); err != nil {
+		return err
+	}
+	if scope != scopeRadios && scope != scopeConfig {
+		return fmt.Errorf("unknown scope '%s'", scope)
+	}
+	if scope == scopeConfig && format != formatJson {
+		return fmt.Errorf("scope '%s' is only supported with format '%s'", scope, formatJson)
+	}
+
+	radios := sortedRadios(c.Radios)
+	switch format {
+	case formatM3u:
+		return writeM3u(w, radios)
+	case formatOpml:
+		return writeOpml(w, radios)
+	}
+
+	var b []byte
+	var err error
+	if scope == scopeConfig {
+		b, err = json.MarshalIndent(c, "", "  ")
+	} else {
+		b, err = json.MarshalIndent(radios, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// import radios into config
+// a full config restores the volume of known receivers, too
+func (c *Config) importRadios(d []byte, format, mode string) (*ImportResult, error) {
+	if err := checkFormat(format); err != nil {
+		return nil, err
+	}
+	if mode != importMerge && mode != importReplace {
+		return nil, fmt.Errorf("unknown import mode '%s'", mode)
+	}
+
+	var radios []*Radio
+	var imported *Config
+	var err error
+	switch format {
+	case formatM3u:
+		radios, err = readM3u(d)
+	case formatOpml:
+		radios, err = readOpml(d)
+	default:
+		radios, imported, err = readJson(d)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", format, err)
+	}
+
+	res := &ImportResult{Invalid: make([]string, 0)}
+	valid := make([]*Radio, 0, len(radios))
+	for _, r := range radios {
+		if r == nil {
+			continue
+		}
+		r.Name = strings.TrimSpace(r.Name)
+		r.Uri = strings.TrimSpace(r.Uri)
+		if err := checkRadioUri(r.Uri); err != nil || r.Name == "" {
+			log.Warning("skipping invalid radio: '%s' %s", r.Name, r.Uri)
+			res.Invalid = append(res.Invalid, r.Uri)
+			continue
+		}
+		valid = append(valid, r)
+	}
+
+	old := c.Radios
+	if mode == importReplace {
+		c.Radios = make(map[string]*Radio)
+	}
+	for _, r := range valid {
+		// keep ids of known radios, servers and receivers refer to them
+		if _, ok := old[r.Uid]; !ok {
+			r.Uid = ""
+			for k, o := range old {
+				if o.Uri == r.Uri {
+					r.Uid = k
+					break
+				}
+			}
+		}
+		if r.Uid != "" {
+			if _, ok := old[r.Uid]; ok {
+				res.Updated += 1
+			}
+		} else {
+			res.Added += 1
+		}
+		c.addRadio(r)
+	}
+	if mode == importReplace {
+		for k := range old {
+			if !c.hasRadio(k) {
+				// don't leave senders streaming radios that are gone
+				stopServersWithRadio(k)
+				c.disableSchedulesWithRadio(k)
+				removeLogo(old[k])
+				res.Removed += 1
+			}
+		}
+	}
+
+	if imported != nil {
+		for k, ir := range imported.Receivers {
+			r, ok := c.Receivers[k]
+			if !ok {
+				continue
+			}
+			if err := checkVolume(ir.Volume, maxVolume); err != nil {
+				log.Warning("skipping volume of receiver %s: %s", k, err)
+				continue
+			}
+			r.Volume = r.limitVolume(ir.Volume)
+		}
+	}
+	return res, nil
+}
+
+// HTTP --------------------------------------------
+
+// GET /api/export?format=[json,m3u,opml]&scope=[radios,config]
+func serveApiExport(w http.ResponseWriter, req *http.Request) *ServeError {
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = formatJson
+	}
+	scope := req.URL.Query().Get("scope")
+	if scope == "" {
+		scope = scopeRadios
+	}
+	log.Debug("/api/export format: %s, scope: %s", format, scope)
+
+	var b bytes.Buffer
+	if err := config.exportRadios(&b, format, scope); err != nil {
+		return NewError(err.Error(), http.StatusBadRequest)
+	}
+	w.Header().Add("Content-Type", contentType(format))
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"rtp-%s.%s\"", scope, format))
+	w.Write(b.Bytes())
+	return nil
+}
+
+// POST /api/import?format=[json,m3u,opml]&mode=[merge,replace]
+func serveApiImport(w http.ResponseWriter, req *http.Request) *ServeError {
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = formatJson
+	}
+	mode := req.URL.Query().Get("mode")
+	if mode == "" {
+		mode = importMerge
+	}
+	log.Debug("/api/import format: %s, mode: %s", format, mode)
+
+	d, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return NewInternalError(fmt.Sprintf("somthing went wrong reading body: %s", err))
+	}
+	res, err := config.importRadios(d, format, mode)
+	if err != nil {
+		return NewError(err.Error(), http.StatusBadRequest)
+	}
+	notifyNewConfig()
+	return serveJson(w, req, res)
+}
+
+// CLI ---------------------------------------------
+
+func exportFile(file, format, scope string) error {
+	if format == "" {
+		format = formatFromFile(file)
+	}
+	var b bytes.Buffer
+	if err := config.exportRadios(&b, format, scope); err != nil {
+		return err
+	}
+	log.Info("exporting %s as %s to %s", scope, format, file)
+	return ioutil.WriteFile(file, b.Bytes(), 0644)
+}
+
+func importFile(file, format, mode string) error {
+	if format == "" {
+		format = formatFromFile(file)
+	}
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	res, err := config.importRadios(d, format, mode)
+	if err != nil {
+		return err
+	}
+	log.Info("imported %s from %s: %d added, %d updated, %d removed, %d invalid",
+		format, file, res.Added, res.Updated, res.Removed, len(res.Invalid))
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func radioNames(radios []*Radio) []string {
+	names := make([]string, 0, len(radios))
+	for _, r := range radios {
+		names = append(names, r.Name+" "+r.Uri)
+	}
+	return names
+}
+
+func TestReadM3u(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   string
+		want []*Radio
+	}{
+		{"plain", "#EXTM3U\n#EXTINF:-1,One\nhttp://example.com/one\n", []*Radio{
+			{Name: "One", Uri: "http://example.com/one"},
+		}},
+		{"attributes", "#EXTINF:-1 tvg-logo=\"http://example.com/one.png\" group-title=\"news;talk\",One\nhttp://example.com/one", []*Radio{
+			{Name: "One", Uri: "http://example.com/one", Logo: "http://example.com/one.png", Tags: []string{"news", "talk"}},
+		}},
+		{"comma in attribute and title", "#EXTINF:-1 group-title=\"a,b\",One, Two\nhttp://example.com/one", []*Radio{
+			{Name: "One, Two", Uri: "http://example.com/one", Tags: []string{"a,b"}},
+		}},
+		{"uri without info", "http://example.com/one\r\n\r\nhttp://example.com/two", []*Radio{
+			{Name: "http://example.com/one", Uri: "http://example.com/one"},
+			{Name: "http://example.com/two", Uri: "http://example.com/two"},
+		}},
+		{"info without title", "#EXTINF:-1\nhttp://example.com/one", []*Radio{
+			{Name: "http://example.com/one", Uri: "http://example.com/one"},
+		}},
+		{"comments and dangling info", "#EXTM3U\n#EXTVLCOPT:foo\n#EXTINF:-1,One\n# comment\nhttp://example.com/one\n#EXTINF:-1,Dangling\n", []*Radio{
+			{Name: "One", Uri: "http://example.com/one"},
+		}},
+		{"unterminated quote", "#EXTINF:-1 tvg-logo=\"broken,One\nhttp://example.com/one", []*Radio{
+			{Name: "http://example.com/one", Uri: "http://example.com/one"},
+		}},
+		{"empty", "", []*Radio{}},
+	} {
+		radios, err := readM3u([]byte(tt.in))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(radios, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, radioNames(radios), radioNames(tt.want))
+		}
+	}
+}
+
+func TestWriteM3uSanitized(t *testing.T) {
+	radios := []*Radio{{Name: "One\n#EXTINF:-1,Evil", Uri: "http://example.com/one", Logo: "http://example.com/\"x\".png", Tags: []string{"a", "b"}}}
+	var b bytes.Buffer
+	if err := writeM3u(&b, radios); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readM3u(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 1 {
+		t.Fatalf("read %v", radioNames(read))
+	}
+	want := &Radio{Name: "One #EXTINF:-1,Evil", Uri: "http://example.com/one", Logo: "http://example.com/'x'.png", Tags: []string{"a", "b"}}
+	if !reflect.DeepEqual(read[0], want) {
+		t.Errorf("read %+v, want %+v", read[0], want)
+	}
+}
+
+func TestReadOpml(t *testing.T) {
+	radios, err := readOpml([]byte(`<?xml version="1.0"?>
+<opml version="2.0">
+  <head><title>radios</title></head>
+  <body>
+    <outline text="News">
+      <outline text="One" type="audio" URL="http://example.com/one" image="http://example.com/one.png" category="news,talk"/>
+      <outline title="Two" xmlUrl="http://example.com/two"/>
+    </outline>
+    <outline text="No uri"/>
+  </body>
+</opml>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Radio{
+		{Name: "One", Uri: "http://example.com/one", Logo: "http://example.com/one.png", Tags: []string{"news", "talk"}},
+		{Name: "Two", Uri: "http://example.com/two"},
+	}
+	if !reflect.DeepEqual(radios, want) {
+		t.Errorf("got %v, want %v", radioNames(radios), radioNames(want))
+	}
+
+	for _, in := range []string{"", "<opml><body><outline text=\"One\"", "not xml", "<rss/>"} {
+		if _, err := readOpml([]byte(in)); err == nil {
+			t.Errorf("malformed opml %q accepted", in)
+		}
+	}
+}
+
+func TestReadJson(t *testing.T) {
+	radios, c, err := readJson([]byte(` [{"Name": "One", "Uri": "http://example.com/one"}]`))
+	if err != nil || c != nil || len(radios) != 1 || radios[0].Name != "One" {
+		t.Errorf("list: %v, %v, %v", radioNames(radios), c, err)
+	}
+
+	radios, c, err = readJson([]byte(`{"Radios": {"radio-1": {"Uid": "radio-1", "Name": "One", "Uri": "http://example.com/one"}},
+		"Receivers": {"receiver-kitchen": {"Name": "kitchen", "Volume": 30}}}`))
+	if err != nil || c == nil || len(radios) != 1 || radios[0].Uid != "radio-1" {
+		t.Fatalf("config: %v, %v, %v", radioNames(radios), c, err)
+	}
+	if c.Receivers["receiver-kitchen"].Volume != 30 {
+		t.Errorf("receivers not read: %+v", c.Receivers)
+	}
+
+	for _, in := range []string{"", "[", "{", `[{"Name": 1}]`, "radios"} {
+		if _, _, err := readJson([]byte(in)); err == nil {
+			t.Errorf("malformed json %q accepted", in)
+		}
+	}
+}
+
+// config with radio-1 on a server, played by the kitchen
+func newImportTest(t *testing.T) *Receiver {
+	dir := t.TempDir()
+	logoDir = &dir
+	config = NewConfig()
+	config.Radios["radio-1"] = &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one", Logo: logoPath + "radio-1.png"}
+	config.Radios["radio-2"] = &Radio{Uid: "radio-2", Name: "Two", Uri: "http://example.com/two"}
+	os.WriteFile(filepath.Join(dir, "radio-1.png"), []byte("png"), 0644)
+	s := &Server{Name: "sender", Host: "example.com", Port: 48100, RadioId: "radio-1"}
+	config.Servers[s.Id()] = s
+	r := &Receiver{Name: "kitchen", Volume: 50, MaxVolume: 80, ServerId: s.Id()}
+	config.Receivers[r.Id()] = r
+	return r
+}
+
+func TestImportMerge(t *testing.T) {
+	r := newImportTest(t)
+	res, err := config.importRadios([]byte(`[
+		{"Name": "One renamed", "Uri": "http://example.com/one"},
+		{"Uid": "radio-2", "Name": "Two renamed", "Uri": "http://example.com/two-new"},
+		{"Name": "Three", "Uri": "http://example.com/three"},
+		{"Name": "", "Uri": "http://example.com/nameless"},
+		{"Name": "Bad", "Uri": "ftp://example.com/bad"}
+	]`), formatJson, importMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Added != 1 || res.Updated != 2 || res.Removed != 0 || len(res.Invalid) != 2 {
+		t.Errorf("result %+v", res)
+	}
+	// ids are kept by uid or uri
+	if config.Radios["radio-1"].Name != "One renamed" || config.Radios["radio-2"].Uri != "http://example.com/two-new" {
+		t.Errorf("radios not updated: %v", radioNames(sortedRadios(config.Radios)))
+	}
+	if len(config.Radios) != 3 || r.ServerId == "off" {
+		t.Errorf("merge removed radios or stopped receivers: %v, %s", radioNames(sortedRadios(config.Radios)), r.ServerId)
+	}
+}
+
+func TestImportReplace(t *testing.T) {
+	r := newImportTest(t)
+	res, err := config.importRadios([]byte("#EXTM3U\n#EXTINF:-1,Two\nhttp://example.com/two\n#EXTINF:-1,Three\nhttp://example.com/three\n"), formatM3u, importReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Added != 1 || res.Updated != 1 || res.Removed != 1 {
+		t.Errorf("result %+v", res)
+	}
+	if config.hasRadio("radio-1") || !config.hasRadio("radio-2") || len(config.Radios) != 2 {
+		t.Errorf("radios %v", radioNames(sortedRadios(config.Radios)))
+	}
+	if r.ServerId != "off" {
+		t.Errorf("receiver still playing removed radio on %s", r.ServerId)
+	}
+	if _, err := os.Stat(filepath.Join(*logoDir, "radio-1.png")); !os.IsNotExist(err) {
+		t.Error("logo of removed radio left behind")
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	newImportTest(t)
+	for _, tt := range []struct{ format, mode, in string }{
+		{"xml", importMerge, "[]"},
+		{formatJson, "append", "[]"},
+		{formatJson, importMerge, "{"},
+		{formatOpml, importReplace, "<opml"},
+	} {
+		if _, err := config.importRadios([]byte(tt.in), tt.format, tt.mode); err == nil {
+			t.Errorf("%s %s %q accepted", tt.format, tt.mode, tt.in)
+		}
+	}
+	// nothing changed by failed imports
+	if len(config.Radios) != 2 {
+		t.Errorf("radios %v", radioNames(sortedRadios(config.Radios)))
+	}
+}
+
+func TestImportConfigVolumes(t *testing.T) {
+	r := newImportTest(t)
+	config.Receivers["receiver-hall"] = &Receiver{Name: "hall", Volume: 20}
+	_, err := config.importRadios([]byte(`{"Radios": {}, "Receivers": {
+		"receiver-kitchen": {"Name": "kitchen", "Volume": 120},
+		"receiver-hall": {"Name": "hall", "Volume": -5},
+		"receiver-unknown": {"Name": "unknown", "Volume": 10}}}`), formatJson, importMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// limited to the receiver's max volume
+	if r.Volume != 80 {
+		t.Errorf("kitchen volume %d, want 80", r.Volume)
+	}
+	// invalid volumes are skipped
+	if v := config.Receivers["receiver-hall"].Volume; v != 20 {
+		t.Errorf("hall volume %d, want 20", v)
+	}
+	if _, ok := config.Receivers["receiver-unknown"]; ok {
+		t.Error("unknown receiver imported")
+	}
+	if len(config.Radios) != 2 {
+		t.Errorf("merge of empty config changed radios: %v", radioNames(sortedRadios(config.Radios)))
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed templates
+var templateFiles embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).ParseFS(templateFiles, "templates/*.html"))
+
+// receiver as shown in the ui
+type uiReceiver struct {
+	Id       string
+	Receiver *Receiver
+	ServerId string
+	RadioId  string
+	// errors of receiver or its server
+	Warning *Status
+	// selected and available outputs
+	Output  string
+	Outputs []string
+	// audio settings with defaults filled in
+	Channels    string
+	Eq          string
+	VolumeLimit int
+}
+
+type uiPage struct {
+	Receivers    []*uiReceiver
+	Servers      []*Server
+	Radios       []*Radio
+	ChannelModes []string
+}
+
+// Rendering ---------------------------------------
+
+func newUiPage(c *Config) *uiPage {
+	p := &uiPage{
+		Receivers:    make([]*uiReceiver, 0, len(c.Receivers)),
+		Servers:      make([]*Server, 0),
+		Radios:       sortedRadios(c.Radios),
+		ChannelModes: []string{channelsStereo, channelsLeft, channelsRight, channelsMono},
+	}
+	for k, r := range c.Receivers {
+		ur := &uiReceiver{Id: k, Receiver: r, ServerId: r.ServerId, RadioId: "off"}
+		if ur.ServerId == "" {
+			ur.ServerId = "off"
+		}
+		if s, ok := c.Servers[r.ServerId]; ok && s.RadioId != "" {
+			ur.RadioId = s.RadioId
+		}
+		ur.Output, ur.Outputs = receiverOutputs(r)
+		ur.Channels, ur.Eq = receiverAudio(r)
+		ur.VolumeLimit = r.volumeLimit()
+		ur.Warning = statusWarning(r.Status)
+		if s, ok := c.Servers[r.ServerId]; ok && ur.Warning == nil {
+			ur.Warning = statusWarning(s.Status)
+		}
+		p.Receivers = append(p.Receivers, ur)
+	}
+	sort.Slice(p.Receivers, func(i, j int) bool {
+		return strings.ToLower(p.Receivers[i].Receiver.Name) < strings.ToLower(p.Receivers[j].Receiver.Name)
+	})
+	// internal servers and senders on agents are selected by radio
+	for _, s := range c.Servers {
+		if !s.managed() {
+			p.Servers = append(p.Servers, s)
+		}
+	}
+	sort.Slice(p.Servers, func(i, j int) bool {
+		return strings.ToLower(p.Servers[i].Name) < strings.ToLower(p.Servers[j].Name)
+	})
+	return p
+}
+
+// outputs reported by the receiver, including the selected one
+func receiverOutputs(r *Receiver) (string, []string) {
+	output := r.Output
+	if output == "" {
+		output = outputAuto
+	}
+	outputs := append([]string{}, r.Outputs...)
+	for _, o := range outputs {
+		if o == output {
+			return output, outputs
+		}
+	}
+	return output, append(outputs, output)
+}
+
+func receiverAudio(r *Receiver) (string, string) {
+	channels := r.Channels
+	if channels == "" {
+		channels = channelsStereo
+	}
+	if len(r.Eq) == 0 {
+		return channels, "flat"
+	}
+	gains := make([]string, len(r.Eq))
+	for i, g := range r.Eq {
+		gains[i] = strconv.FormatFloat(g, 'g', -1, 64)
+	}
+	return channels, strings.Join(gains, ",")
+}
+
+func statusWarning(s *Status) *Status {
+	if s != nil && (s.Failed || s.ErrorCount > 0) {
+		return s
+	}
+	return nil
+}
+
+// GET /
+func serveIndex(w http.ResponseWriter, req *http.Request) *ServeError {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := templates.ExecuteTemplate(w, "index.html", newUiPage(&config)); err != nil {
+		return NewInternalError(fmt.Sprintf("error rendering page: %s", err))
+	}
+	return nil
+}
+
+// Forms -------------------------------------------
+
+// POST /ui/receiver id=${receiver-id}&[server,radio,volume]=${value}
+func serveUiReceiver(w http.ResponseWriter, req *http.Request) *ServeError {
+	if err := serveApiReceiver(w, req); err != nil {
+		return err
+	}
+	http.Redirect(w, req, "/#receivers", http.StatusSeeOther)
+	return nil
+}
+
+// POST /ui/radio Name=${name}&Uri=${uri}&Tags=${tags}&Gain=${db}
+func serveUiRadio(w http.ResponseWriter, req *http.Request) *ServeError {
+	o := &Radio{
+		Name: strings.TrimSpace(req.FormValue("Name")),
+		Uri:  strings.TrimSpace(req.FormValue("Uri")),
+	}
+	for _, t := range strings.Split(req.FormValue("Tags"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			o.Tags = append(o.Tags, t)
+		}
+	}
+	if o.Name == "" {
+		return NewError("name must not be empty", http.StatusBadRequest)
+	}
+	if err := checkRadioUri(o.Uri); err != nil {
+		return NewError(err.Error(), http.StatusBadRequest)
+	}
+	if g := strings.TrimSpace(req.FormValue("Gain")); g != "" {
+		var err error
+		if o.Gain, err = strconv.ParseFloat(g, 64); err != nil {
+			return NewError(fmt.Sprintf("invalid gain '%s'", g), http.StatusBadRequest)
+		}
+		if err := checkRadioGain(o.Gain); err != nil {
+			return NewError(err.Error(), http.StatusBadRequest)
+		}
+	}
+	config.addRadio(o)
+	notifyNewConfig()
+	http.Redirect(w, req, "/#radios", http.StatusSeeOther)
+	return nil
+}
+
+// POST /ui/radio/delete id=${radio-id}
+func serveUiRadioDelete(w http.ResponseWriter, req *http.Request) *ServeError {
+	if !config.rmRadio(req.FormValue("id")) {
+		return NewError("radio not found", http.StatusNotFound)
+	}
+	notifyNewConfig()
+	http.Redirect(w, req, "/#radios", http.StatusSeeOther)
+	return nil
+}
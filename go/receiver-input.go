@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// local inputs of a receiver: keys, IR remotes and rotary encoders read from evdev devices
+// actions are sent to the config server, which stays authoritative for the receiver's state
+
+const (
+	actionNext       = "next"
+	actionPrev       = "prev"
+	actionVolumeUp   = "volume-up"
+	actionVolumeDown = "volume-down"
+	actionMute       = "mute"
+	// volume changes are sent as steps up or down
+	actionVolume = "volume"
+)
+
+// linux/input-event-codes.h
+const (
+	evKey = 0x01
+	evRel = 0x02
+
+	keyRelease = 0
+	keyRepeat  = 2
+)
+
+// struct input_event, the timeval's size depends on the architecture
+type inputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// key names usable in --input-keys
+var keyCodes = map[string]uint16{
+	"KEY_ENTER":         28,
+	"KEY_SPACE":         57,
+	"KEY_M":             50,
+	"KEY_N":             49,
+	"KEY_P":             25,
+	"KEY_UP":            103,
+	"KEY_LEFT":          105,
+	"KEY_RIGHT":         106,
+	"KEY_DOWN":          108,
+	"KEY_MUTE":          113,
+	"KEY_VOLUMEDOWN":    114,
+	"KEY_VOLUMEUP":      115,
+	"KEY_NEXTSONG":      163,
+	"KEY_PLAYPAUSE":     164,
+	"KEY_PREVIOUSSONG":  165,
+	"KEY_PLAY":          207,
+	"KEY_PAUSE":         119,
+	"BTN_0":             256,
+	"BTN_1":             257,
+	"BTN_2":             258,
+	"BTN_3":             259,
+	"KEY_CHANNELUP":     402,
+	"KEY_CHANNELDOWN":   403,
+	"KEY_NEXT":          407,
+	"KEY_PREVIOUS":      412,
+	"KEY_NUMERIC_STAR":  522,
+	"KEY_NUMERIC_POUND": 523,
+}
+
+// relative axes usable in --input-rotary
+var relCodes = map[string]uint16{
+	"REL_X":     0x00,
+	"REL_Y":     0x01,
+	"REL_DIAL":  0x07,
+	"REL_WHEEL": 0x08,
+}
+
+var (
+	inputDevices string
+	inputKeys    string
+	inputRotary  string
+	inputStep    int
+	// devices unplugged or not yet available, retried forever
+	inputBackoff = BackoffPolicy{
+		Initial:    time.Second,
+		Max:        time.Minute,
+		Multiplier: 2,
+		Jitter:     0.1,
+	}
+)
+
+// media keys and IR remotes work out of the box, push buttons of rotary encoders usually report BTN_0
+const defaultInputKeys = "KEY_NEXTSONG=next,KEY_PREVIOUSSONG=prev,KEY_CHANNELUP=next,KEY_CHANNELDOWN=prev," +
+	"KEY_NEXT=next,KEY_PREVIOUS=prev,KEY_VOLUMEUP=volume-up,KEY_VOLUMEDOWN=volume-down,KEY_MUTE=mute,BTN_0=mute"
+
+// an action triggered by an input, volume changes carry the number of steps, negative for down
+type inputAction struct {
+	action string
+	steps  int
+}
+
+// maps keys and axes of input devices to actions
+type InputMap struct {
+	keys map[uint16]string
+	axes map[uint16]bool
+}
+
+func isInputAction(a string) bool {
+	switch a {
+	case actionNext, actionPrev, actionVolumeUp, actionVolumeDown, actionMute:
+		return true
+	}
+	return false
+}
+
+// parse a key or axis given by name or numeric code
+func parseInputCode(name string, names map[string]uint16) (uint16, error) {
+	if c, ok := names[strings.ToUpper(name)]; ok {
+		return c, nil
+	}
+	c, err := strconv.ParseUint(name, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown key or axis '%s', use a name like KEY_MUTE or a numeric code", name)
+	}
+	return uint16(c), nil
+}
+
+// parse key bindings like "KEY_MUTE=mute,164=next" and comma separated axes
+func parseInputMap(keys, axes string) (*InputMap, error) {
+	m := &InputMap{make(map[uint16]string), make(map[uint16]bool)}
+	for _, b := range strings.Split(keys, ",") {
+		if b = strings.TrimSpace(b); b == "" {
+			continue
+		}
+		parts := strings.SplitN(b, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid key binding '%s', use KEY=action", b)
+		}
+		c, err := parseInputCode(strings.TrimSpace(parts[0]), keyCodes)
+		if err != nil {
+			return nil, err
+		}
+		a := strings.TrimSpace(parts[1])
+		if !isInputAction(a) {
+			return nil, fmt.Errorf("unknown action '%s', use next, prev, volume-up, volume-down or mute", a)
+		}
+		m.keys[c] = a
+	}
+	for _, a := range strings.Split(axes, ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+		c, err := parseInputCode(a, relCodes)
+		if err != nil {
+			return nil, err
+		}
+		m.axes[c] = true
+	}
+	return m, nil
+}
+
+func checkInputMap(keys, axes string) error {
+	_, err := parseInputMap(keys, axes)
+	return err
+}
+
+// translate an event to an action, ok is false for events without binding
+func (im *InputMap) translate(e *inputEvent) (inputAction, bool) {
+	switch e.Type {
+	case evKey:
+		a, ok := im.keys[e.Code]
+		if !ok || e.Value == keyRelease {
+			return inputAction{}, false
+		}
+		switch a {
+		case actionVolumeUp:
+			return inputAction{actionVolume, 1}, true
+		case actionVolumeDown:
+			return inputAction{actionVolume, -1}, true
+		}
+		// holding a key repeats volume changes only
+		if e.Value == keyRepeat {
+			return inputAction{}, false
+		}
+		return inputAction{a, 1}, true
+	case evRel:
+		if !im.axes[e.Code] || e.Value == 0 {
+			return inputAction{}, false
+		}
+		return inputAction{actionVolume, int(e.Value)}, true
+	}
+	return inputAction{}, false
+}
+
+// read events from a device until it fails, e.g. when unplugged
+func readInput(r io.Reader, im *InputMap, actions chan<- inputAction) error {
+	for {
+		var e inputEvent
+		// evdev uses the host's byte order, all supported platforms are little endian
+		if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+			return err
+		}
+		if a, ok := im.translate(&e); ok {
+			log.Debug("input event type %d, code %d, value %d: %s", e.Type, e.Code, e.Value, a.action)
+			actions <- a
+		}
+	}
+}
+
+// read a device, reopening it after errors
+func watchInput(device string, im *InputMap, actions chan<- inputAction) {
+	retry := inputBackoff.NewBackoff(realClock{})
+	for {
+		f, err := os.Open(device)
+		if err != nil {
+			log.Error("unable to open input device %s: %s", device, err)
+		} else {
+			log.Info("reading input device: %s", device)
+			retry.Reset()
+			err = readInput(f, im, actions)
+			f.Close()
+			log.Error("error reading input device %s: %s", device, err)
+		}
+		retry.Wait()
+	}
+}
+
+// send an action to the config server's receiver api
+func (m *Manager) sendAction(a inputAction) error {
+	params := url.Values{}
+	params.Set("id", m.Receiver().Id())
+	switch a.action {
+	case actionNext, actionPrev:
+		params.Set("radio", a.action)
+	case actionVolume:
+		step := a.steps * inputStep
+		if step > 0 {
+			params.Set("volume", "up")
+		} else {
+			params.Set("volume", "down")
+			step = -step
+		}
+		if step > maxVolume {
+			step = maxVolume
+		}
+		params.Set("step", strconv.Itoa(step))
+	case actionMute:
+		params.Set("mute", "toggle")
+	}
+	uri := m.ConfigUri
+	resp, err := http.Get(uri + "/api/receiver?" + params.Encode())
+	if err != nil {
+		m.failover(uri)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("config server returned %s", resp.Status)
+	}
+	return nil
+}
+
+// send actions one by one, merging queued volume changes, e.g. from fast turns of a rotary encoder
+func (m *Manager) inputLoop(actions chan inputAction) {
+	var pending *inputAction
+	for {
+		var a inputAction
+		if pending != nil {
+			a, pending = *pending, nil
+		} else {
+			a = <-actions
+		}
+	merge:
+		for a.action == actionVolume {
+			select {
+			case next := <-actions:
+				if next.action != actionVolume {
+					pending = &next
+					break merge
+				}
+				a.steps += next.steps
+			default:
+				break merge
+			}
+		}
+		if a.action == actionVolume && a.steps == 0 {
+			continue
+		}
+		log.Info("input action: %s %d", a.action, a.steps)
+		if err := m.sendAction(a); err != nil {
+			log.Error("error sending input action %s: %s", a.action, err)
+		}
+	}
+}
+
+// start reading the comma separated input devices
+func (m *Manager) startInputs(devices string, im *InputMap) {
+	actions := make(chan inputAction, 16)
+	for _, d := range strings.Split(devices, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			go watchInput(d, im, actions)
+		}
+	}
+	go m.inputLoop(actions)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseInputMap(t *testing.T) {
+	im, err := parseInputMap(" KEY_MUTE=mute, 164 = next,key_up=volume-up,", "REL_DIAL, 0x08")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for code, want := range map[uint16]string{113: actionMute, 164: actionNext, 103: actionVolumeUp} {
+		if im.keys[code] != want {
+			t.Errorf("key %d: %q, want %q", code, im.keys[code], want)
+		}
+	}
+	if len(im.keys) != 3 || !im.axes[0x07] || !im.axes[0x08] || len(im.axes) != 2 {
+		t.Errorf("keys %v, axes %v", im.keys, im.axes)
+	}
+	if _, err := parseInputMap(defaultInputKeys, ""); err != nil {
+		t.Errorf("default keys: %s", err)
+	}
+
+	for _, tt := range []struct{ keys, axes string }{
+		{"KEY_MUTE", ""},
+		{"KEY_MUTE=", ""},
+		{"KEY_MUTE=play", ""},
+		{"KEY_FOO=mute", ""},
+		{"70000=mute", ""},
+		{"=mute", ""},
+		{"", "REL_FOO"},
+		{"", "-1"},
+	} {
+		if _, err := parseInputMap(tt.keys, tt.axes); err == nil {
+			t.Errorf("invalid binding %q, %q accepted", tt.keys, tt.axes)
+		}
+	}
+}
+
+func TestInputMapTranslate(t *testing.T) {
+	im, err := parseInputMap("KEY_MUTE=mute,KEY_NEXTSONG=next,KEY_VOLUMEUP=volume-up,KEY_VOLUMEDOWN=volume-down", "REL_DIAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		event inputEvent
+		want  inputAction
+		ok    bool
+	}{
+		{"press", inputEvent{Type: evKey, Code: 163, Value: 1}, inputAction{actionNext, 1}, true},
+		{"release", inputEvent{Type: evKey, Code: 163, Value: keyRelease}, inputAction{}, false},
+		{"repeat", inputEvent{Type: evKey, Code: 163, Value: keyRepeat}, inputAction{}, false},
+		{"mute repeat", inputEvent{Type: evKey, Code: 113, Value: keyRepeat}, inputAction{}, false},
+		{"volume up", inputEvent{Type: evKey, Code: 115, Value: 1}, inputAction{actionVolume, 1}, true},
+		{"volume up repeat", inputEvent{Type: evKey, Code: 115, Value: keyRepeat}, inputAction{actionVolume, 1}, true},
+		{"volume down release", inputEvent{Type: evKey, Code: 114, Value: keyRelease}, inputAction{}, false},
+		{"volume down repeat", inputEvent{Type: evKey, Code: 114, Value: keyRepeat}, inputAction{actionVolume, -1}, true},
+		{"unbound key", inputEvent{Type: evKey, Code: 28, Value: 1}, inputAction{}, false},
+		{"rotary up", inputEvent{Type: evRel, Code: 0x07, Value: 3}, inputAction{actionVolume, 3}, true},
+		{"rotary down", inputEvent{Type: evRel, Code: 0x07, Value: -2}, inputAction{actionVolume, -2}, true},
+		{"rotary still", inputEvent{Type: evRel, Code: 0x07, Value: 0}, inputAction{}, false},
+		{"unbound axis", inputEvent{Type: evRel, Code: 0x08, Value: 1}, inputAction{}, false},
+		{"other type", inputEvent{Type: 0x04, Code: 163, Value: 1}, inputAction{}, false},
+	} {
+		a, ok := im.translate(&tt.event)
+		if a != tt.want || ok != tt.ok {
+			t.Errorf("%s: %v %t, want %v %t", tt.name, a, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestInputLoop(t *testing.T) {
+	requests := make(chan string, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- req.URL.RawQuery
+	}))
+	defer srv.Close()
+	step := inputStep
+	inputStep = 5
+	defer func() { inputStep = step }()
+
+	for _, tt := range []struct {
+		name    string
+		actions []inputAction
+		want    []string
+	}{
+		{"rotary steps merge", []inputAction{{actionVolume, 1}, {actionVolume, 2}, {actionVolume, -1}},
+			[]string{"id=receiver-kitchen&step=10&volume=up"}},
+		{"pending action kept", []inputAction{{actionVolume, -1}, {actionVolume, -2}, {actionNext, 1}, {actionVolume, 1}},
+			[]string{"id=receiver-kitchen&step=15&volume=down", "id=receiver-kitchen&radio=next", "id=receiver-kitchen&step=5&volume=up"}},
+		{"steps cancel out", []inputAction{{actionVolume, 2}, {actionVolume, -2}, {actionMute, 1}},
+			[]string{"id=receiver-kitchen&mute=toggle"}},
+		{"step limited", []inputAction{{actionVolume, 50}},
+			[]string{"id=receiver-kitchen&step=150&volume=up"}},
+	} {
+		m := NewReceiver()
+		m.Receiver().Name = "kitchen"
+		m.ConfigUri = srv.URL
+		// queued before the loop runs, as if sent by a fast rotary encoder
+		actions := make(chan inputAction, len(tt.actions))
+		for _, a := range tt.actions {
+			actions <- a
+		}
+		go m.inputLoop(actions)
+		for _, want := range tt.want {
+			select {
+			case got := <-requests:
+				if got != want {
+					t.Errorf("%s: sent %s, want %s", tt.name, got, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s: %s not sent", tt.name, want)
+			}
+		}
+		select {
+		case got := <-requests:
+			t.Errorf("%s: unexpected %s", tt.name, got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -17,30 +19,30 @@ import (
 
 const (
 	configCacheFile = "/tmp/rtp-config.json"
-	serverTimeout   = 30 * time.Second
 )
 
 var (
 	config Config
-	managers       = make(map[string]*Manager)
-	configCond *sync.Cond
+	// guards config against concurrent changes of requests and background loops
+	configLock     = sync.Mutex{}
+	senderPorts    *PortRange
+	managers       = make(map[string]InternalSender)
+	configBroker   = NewConfigBroker()
 	saveConfigLock = sync.Mutex{}
-	staticDir *string
-	port *int
-	complexity *int
+	staticDir      *string
+	staticFiles    *StaticFiles
+	port           *int
+	complexity     *int
+	directoryUri   *string
+	logoDir        *string
+	scheduler      *Scheduler
 )
 
 // Locking -----------------------------------------
 
-func waitForNewConfig() {
-	log.Debug("Wait for configCond: %s", *configCond)
-	configCond.L.Lock()
-	configCond.Wait()
-	configCond.L.Unlock()
-}
-
 func notifyNewConfig() {
-	configCond.Broadcast()
+	config.Revision += 1
+	configBroker.Publish()
 }
 
 // Errors ------------------------------------------
@@ -69,12 +71,16 @@ func NewConfig() Config {
 	c.Radios = make(map[string]*Radio)
 	c.Servers = make(map[string]*Server)
 	c.Receivers = make(map[string]*Receiver)
+	c.Schedules = make(map[string]*Schedule)
+	c.Agents = make(map[string]*Agent)
 	return c
 }
 
 func (c *Config) pingReceiver(o *Receiver) {
 	id := o.Id()
 	if r, ok := c.Receivers[id]; ok {
+		r.Status = o.Status
+		r.Outputs = o.Outputs
 		r.Ping()
 	} else {
 		c.Receivers[id] = o
@@ -85,6 +91,7 @@ func (c *Config) pingReceiver(o *Receiver) {
 func (c *Config) pingServer(o *Server) {
 	id := o.Id()
 	if s, ok := c.Servers[id]; ok {
+		s.Status = o.Status
 		s.Ping()
 	} else {
 		c.Servers[id] = o
@@ -92,13 +99,41 @@ func (c *Config) pingServer(o *Server) {
 	}
 }
 
+// add a radio, radios without id replace the radio with same uri if any
 func (c *Config) addRadio(o *Radio) {
+	if o.Uid == "" {
+		if id, ok := c.findRadioByUri(o.Uri); ok {
+			o.Uid = id
+		} else {
+			o.Uid = newRadioId()
+		}
+	}
 	c.Radios[o.Id()] = o
 }
 
+func (c *Config) findRadioByUri(uri string) (string, bool) {
+	for k, r := range c.Radios {
+		if r.Uri == uri {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// set radio id for radios persisted before ids were decoupled from uris
+func (c *Config) migrateRadioIds() {
+	for k, r := range c.Radios {
+		if r.Uid == "" {
+			r.Uid = k
+		}
+	}
+}
+
 func (c *Config) rmRadio(id string) bool {
-	if _, ok := c.Radios[id]; ok {
+	if r, ok := c.Radios[id]; ok {
+		removeLogo(r)
 		delete(c.Radios, id)
+		c.disableSchedulesWithRadio(id)
 		return true
 	} else {
 		return false
@@ -117,22 +152,6 @@ func (c *Config) hasRadio(id string) bool {
 
 // HTTP --------------------------------------------
 
-// WebSocket /ws/config
-func serveWsConfig(ws *websocket.Conn) {
-	log.Debug("serve: /ws/config")
-
-	for {
-		waitForNewConfig()
-		b, err := json.Marshal(config)
-		if err != nil {
-			msg := fmt.Sprintf("error writing json: %v", err)
-			log.Error(msg)
-		} else {
-			ws.Write(b)
-		}
-	}
-}
-
 func unmarshalReceiver(req *http.Request) (*Receiver, error) {
 	var o Receiver
 	decoder := json.NewDecoder(req.Body)
@@ -147,6 +166,13 @@ func unmarshalServer(req *http.Request) (*Server, error) {
 	return &o, err
 }
 
+func unmarshalAgent(req *http.Request) (*Agent, error) {
+	var o Agent
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&o)
+	return &o, err
+}
+
 func unmarshalRadio(req *http.Request) (*Radio, error) {
 	var o Radio
 	decoder := json.NewDecoder(req.Body)
@@ -154,6 +180,24 @@ func unmarshalRadio(req *http.Request) (*Radio, error) {
 	return &o, err
 }
 
+// fields of a radio changed by PATCH /api/radio
+type RadioPatch struct {
+	Name     *string
+	Uri      *string
+	Logo     *string
+	Tags     *[]string
+	Favorite *bool
+	Order    *int
+	Gain     *float64
+}
+
+func unmarshalRadioPatch(req *http.Request) (*RadioPatch, error) {
+	var o RadioPatch
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&o)
+	return &o, err
+}
+
 // POST /api/ping
 func serveApiPing(w http.ResponseWriter, req *http.Request) *ServeError {
 	if req.URL.Path == "/api/ping/receiver" {
@@ -172,12 +216,73 @@ func serveApiPing(w http.ResponseWriter, req *http.Request) *ServeError {
 		} else {
 			return NewInternalError(fmt.Sprintf("somthing went wrong parsing body: %s", err))
 		}
+	} else if req.URL.Path == "/api/ping/agent" {
+		o, err := unmarshalAgent(req)
+		if err == nil {
+			config.pingAgent(o)
+			return nil
+		} else {
+			return NewInternalError(fmt.Sprintf("somthing went wrong parsing body: %s", err))
+		}
 	} else {
 		return NewInternalError(fmt.Sprintf("unknown path: %s", req.URL.Path))
 	}
 }
 
+// apply changes to an existing radio and restart its internal servers if the uri changed
+func updateRadio(r *Radio, p *RadioPatch) *ServeError {
+	if p.Name != nil && *p.Name == "" {
+		return NewError("name must not be empty", http.StatusBadRequest)
+	}
+	if p.Order != nil && *p.Order < 0 {
+		return NewError("order must not be negative", http.StatusBadRequest)
+	}
+	if p.Gain != nil {
+		if err := checkRadioGain(*p.Gain); err != nil {
+			return NewError(err.Error(), http.StatusBadRequest)
+		}
+	}
+	if p.Uri != nil {
+		if err := checkRadioUri(*p.Uri); err != nil {
+			return NewError(err.Error(), http.StatusBadRequest)
+		}
+	}
+	if p.Logo != nil {
+		if err := checkLogo(r, *p.Logo); err != nil {
+			return NewError(err.Error(), http.StatusBadRequest)
+		}
+	}
+
+	if p.Name != nil {
+		r.Name = *p.Name
+	}
+	if p.Logo != nil {
+		r.Logo = *p.Logo
+	}
+	if p.Tags != nil {
+		r.Tags = *p.Tags
+	}
+	if p.Favorite != nil {
+		r.Favorite = *p.Favorite
+	}
+	if p.Order != nil {
+		r.Order = *p.Order
+	}
+	if p.Gain != nil {
+		r.Gain = *p.Gain
+	}
+	if p.Uri != nil && *p.Uri != r.Uri {
+		log.Info("changing uri of radio %s: %s -> %s", r.Id(), r.Uri, *p.Uri)
+		r.Uri = *p.Uri
+		restartServersWithRadio(r)
+	}
+	return nil
+}
+
 // POST /api/radio
+// PUT /api/radio?id=${radio-id}
+// PATCH /api/radio?id=${radio-id}
+// DELETE /api/radio?id=${radio-id}
 func serveApiRadio(w http.ResponseWriter, req *http.Request) *ServeError {
 	id := req.URL.Query().Get("id")
 	log.Debug("/api/radio id: %s", id)
@@ -186,9 +291,53 @@ func serveApiRadio(w http.ResponseWriter, req *http.Request) *ServeError {
 		if err != nil {
 			return NewInternalError(fmt.Sprintf("somthing went wrong parsing body: %s", err))
 		}
+		if err := checkRadioUri(o.Uri); err != nil {
+			return NewError(err.Error(), http.StatusBadRequest)
+		}
+		if err := checkRadioGain(o.Gain); err != nil {
+			return NewError(err.Error(), http.StatusBadRequest)
+		}
+		// new radios have no uploaded logo yet
+		if strings.HasPrefix(o.Logo, logoPath) {
+			return NewError(fmt.Sprintf("logo of another radio: %s", o.Logo), http.StatusBadRequest)
+		}
+		// ids are assigned by the config server
+		o.Uid = ""
 		config.addRadio(o)
 		notifyNewConfig()
 		serveJson(w, req, o)
+	} else if req.Method == "PUT" || req.Method == "PATCH" {
+		r, ok := config.Radios[id]
+		if !ok {
+			return NewError("radio not found", http.StatusNotFound)
+		}
+		var p *RadioPatch
+		if req.Method == "PUT" {
+			o, err := unmarshalRadio(req)
+			if err != nil {
+				return NewError(fmt.Sprintf("somthing went wrong parsing body: %s", err), http.StatusBadRequest)
+			}
+			p = &RadioPatch{
+				Name:     &o.Name,
+				Uri:      &o.Uri,
+				Logo:     &o.Logo,
+				Tags:     &o.Tags,
+				Favorite: &o.Favorite,
+				Order:    &o.Order,
+				Gain:     &o.Gain,
+			}
+		} else {
+			var err error
+			p, err = unmarshalRadioPatch(req)
+			if err != nil {
+				return NewError(fmt.Sprintf("somthing went wrong parsing body: %s", err), http.StatusBadRequest)
+			}
+		}
+		if err := updateRadio(r, p); err != nil {
+			return err
+		}
+		notifyNewConfig()
+		serveJson(w, req, r)
 	} else if req.Method == "DELETE" {
 		if config.rmRadio(id) {
 			notifyNewConfig()
@@ -202,82 +351,260 @@ func serveApiRadio(w http.ResponseWriter, req *http.Request) *ServeError {
 	return nil
 }
 
+// draining servers are reused
 func findServerWithRadio(radio_id string) (string, bool) {
 	for k, s := range config.Servers {
-		if s.RadioId == radio_id {
+		if s.RadioId == radio_id && !s.failed() && s.Lifecycle != senderStopped {
 			return k, true
 		}
 	}
 	return "", false
 }
 
-func findFreePort() int {
-	port := 48110
-	ok := false
-	for !ok {
-		ok = true
-		// loop through servers until free port is found
-		for _, s := range config.Servers {
-			if s.Internal && s.Port == port {
-				ok = false
-				port += 1
-				break
+// restart internal servers playing the given radio with its current uri
+// receivers stay connected to the same host and port and reconnect
+// senders on agents are replaced, moving their receivers to the new ones
+func restartServersWithRadio(r *Radio) {
+	replaced := make([]string, 0)
+	for k, s := range config.Servers {
+		if s.Internal && s.RadioId == r.Id() {
+			log.Info("restarting server %s with new uri: %s", k, r.Uri)
+			s.RadioUri = r.Uri
+			if m, ok := managers[k]; ok {
+				m.restartSender()
 			}
+		} else if s.Agent != "" && s.RadioId == r.Id() {
+			replaced = append(replaced, k)
 		}
 	}
-	return port
+	// all are gone before spawning, spawning may stop failed ones
+	for _, k := range replaced {
+		log.Info("replacing server %s with new uri: %s", k, r.Uri)
+		stopOnAgent(config.Servers[k])
+		delete(config.Servers, k)
+	}
+	for _, k := range replaced {
+		replaceReceivers(k, r.Id())
+	}
 }
 
-func spawnServer(radio_id string) string {
-	r := config.Radios[radio_id]
-	log.Info("spawning new sender for radio: %s", r.Uri)
+// stop senders spawned for a removed radio and turn off receivers playing it
+func stopServersWithRadio(radio_id string) {
+	for k, s := range config.Servers {
+		if s.RadioId != radio_id {
+			continue
+		}
+		for _, r := range config.Receivers {
+			if r.ServerId == k {
+				log.Info("turning off receiver %s playing removed radio %s", r.Id(), radio_id)
+				r.ServerId = "off"
+			}
+		}
+		if s.managed() {
+			stopServer(k)
+		}
+	}
+}
+
+// ports of internal senders, inclusive
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// ${first}-${last} or a single port
+func parsePortRange(v string) (*PortRange, error) {
+	parts := strings.SplitN(v, "-", 2)
+	first, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range '%s', use first-last", v)
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return nil, fmt.Errorf("invalid port range '%s', use first-last", v)
+		}
+	}
+	if first < 1 || last > 65535 || first > last {
+		return nil, fmt.Errorf("invalid port range '%s', ports must be between 1 and 65535, first not above last", v)
+	}
+	return &PortRange{first, last}, nil
+}
+
+func checkPortRange(v string) error {
+	_, err := parsePortRange(v)
+	return err
+}
+
+func (p *PortRange) String() string {
+	return fmt.Sprintf("%d-%d", p.First, p.Last)
+}
+
+// lowest port of the range not used by a known server on the host and free to bind
+// ports of stopped senders are free again
+func findFreePort(host string) (int, error) {
+	used := make(map[int]bool)
+	for _, s := range config.Servers {
+		if s.Host == host {
+			used[s.Port] = true
+		}
+	}
+	for port := senderPorts.First; port <= senderPorts.Last; port++ {
+		if used[port] {
+			continue
+		}
+		if !portFree(port) {
+			log.Debug("port %d in use by another process", port)
+			continue
+		}
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port for senders in %s", senderPorts)
+}
+
+// place the sender on an agent if the placement policy picks one
+func spawnServer(radio_id string, near *Receiver) (string, error) {
+	if a := config.placeServer(near); a != nil {
+		server_id, err := spawnOnAgent(a, radio_id)
+		if err == nil {
+			return server_id, nil
+		}
+		log.Warning("unable to spawn sender on agent %s, spawning internal sender: %s", a.Id(), err)
+	}
+	return spawnInternalServer(radio_id)
+}
+
+func spawnInternalServer(radio_id string) (string, error) {
+	r, ok := config.Radios[radio_id]
+	if !ok {
+		return "", fmt.Errorf("radio not found: %s", radio_id)
+	}
 	hostname, _ := os.Hostname()
-	m := NewServer(true)
-	s := m.Server()
+	port, err := findFreePort(hostname)
+	if err != nil {
+		log.Error("unable to spawn sender for radio %s: %s", r.Uri, err)
+		return "", err
+	}
+	log.Info("spawning new sender for radio: %s", r.Uri)
+	s := &Server{Internal: true, Lifecycle: senderStarting, LifecycleSince: time.Now().Unix()}
 	s.Name = hostname
 	s.Host = hostname
-	s.Port = findFreePort()
-	m.ConfigUri = fmt.Sprintf("http://localhost:%d", *port)
-	m.Complexity = *complexity
+	s.Port = port
 	s.RadioId = radio_id
 	s.RadioUri = r.Uri
+	m := newInternalSender(s)
 	server_id := s.Id()
 	config.Servers[server_id] = s
 	managers[server_id] = m
 	go m.startSender()
-	return server_id
+	return server_id, nil
 }
 
-func findOrSpawnServer(radio_id string) string {
+func findOrSpawnServer(radio_id string, near *Receiver) (string, error) {
+	// selecting a radio again retries failed servers
+	stopFailedServers(radio_id)
+
 	// check if some server is already playing this stream
 	if server_id, ok := findServerWithRadio(radio_id); ok {
 		log.Debug("found running server for radio: %s, %s", radio_id, server_id)
-		return server_id
+		return server_id, nil
 	}
 
 	// spawn new server
-	return spawnServer(radio_id)
+	return spawnServer(radio_id, near)
+}
+
+func stopFailedServers(radio_id string) {
+	for k, s := range config.Servers {
+		if s.managed() && s.RadioId == radio_id && s.failed() {
+			log.Info("stopping failed server %s", k)
+			stopServer(k)
+		}
+	}
 }
 
 func stopServer(server_id string) {
-	m := managers[server_id]
-	m.stopSender()
+	s, ok := config.Servers[server_id]
+	if ok {
+		s.setLifecycle(senderStopped)
+	}
+	if ok && s.Agent != "" {
+		stopOnAgent(s)
+	} else if m, ok := managers[server_id]; ok {
+		m.stopSender()
+	}
 	delete(config.Servers, server_id)
 	delete(managers, server_id)
 }
 
+// radio before or after the one played by the receiver in preference order
+func stepRadio(receiver *Receiver, next bool) (string, bool) {
+	radios := sortedRadios(config.Radios)
+	if len(radios) == 0 {
+		return "", false
+	}
+	current := -1
+	if s, ok := config.Servers[receiver.ServerId]; ok {
+		for i, r := range radios {
+			if r.Id() == s.RadioId {
+				current = i
+				break
+			}
+		}
+	}
+	var i int
+	if current < 0 {
+		// start with the first or last radio when switched off
+		if next {
+			i = 0
+		} else {
+			i = len(radios) - 1
+		}
+	} else if next {
+		i = (current + 1) % len(radios)
+	} else {
+		i = (current + len(radios) - 1) % len(radios)
+	}
+	return radios[i].Id(), true
+}
+
 // GET /api/receiver?id=${receiver-id}&radio=${radio-id}
+// GET /api/receiver?id=${receiver-id}&radio=[next,prev,last,off]
 func serveApiReceiverRadio(w http.ResponseWriter, req *http.Request, receiver *Receiver, radio_id string) *ServeError {
 	log.Debug("/api/receiver receiver: %s, radio: %s", receiver.Id(), radio_id)
 
-	if radio_id != "off" {
-		if !config.hasRadio(radio_id) {
-			return NewInternalError(fmt.Sprintf("server not found: %s", radio_id))
+	if radio_id == "off" {
+		log.Debug("turning off %s", receiver.Id())
+		receiver.ServerId = "off"
+		notifyNewConfig()
+		return nil
+	}
+
+	if radio_id == "last" {
+		// play the last radio again, the first one if it was removed meanwhile
+		if config.hasRadio(receiver.LastRadioId) {
+			radio_id = receiver.LastRadioId
+		} else {
+			radio_id = "next"
+		}
+	}
+	if radio_id == "next" || radio_id == "prev" {
+		id, ok := stepRadio(receiver, radio_id == "next")
+		if !ok {
+			return NewError("no radios configured", http.StatusNotFound)
 		}
+		radio_id = id
+	} else if !config.hasRadio(radio_id) {
+		return NewInternalError(fmt.Sprintf("server not found: %s", radio_id))
 	}
 
 	log.Debug("setting new radio for %s: %s", receiver.Id(), radio_id)
-	receiver.ServerId = findOrSpawnServer(radio_id)
+	server_id, err := findOrSpawnServer(radio_id, receiver)
+	if err != nil {
+		return NewError(err.Error(), http.StatusServiceUnavailable)
+	}
+	receiver.ServerId = server_id
+	receiver.LastRadioId = radio_id
 	notifyNewConfig()
 	return nil
 }
@@ -294,6 +621,34 @@ func serveApiReceiverServer(w http.ResponseWriter, req *http.Request, receiver *
 
 	log.Debug("setting new server for %s: %s", receiver.Id(), server_id)
 	receiver.ServerId = server_id
+	if s, ok := config.Servers[server_id]; ok && s.RadioId != "" {
+		receiver.LastRadioId = s.RadioId
+	}
+	notifyNewConfig()
+	return nil
+}
+
+// GET /api/receiver?id=${receiver-id}&volume=[up,down][&step=${percent}]
+func serveApiReceiverVolumeStep(w http.ResponseWriter, req *http.Request, receiver *Receiver, up bool) *ServeError {
+	step := defaultVolumeStep
+	if s := req.FormValue("step"); s != "" {
+		var err error
+		if step, err = strconv.Atoi(s); err != nil || step < 1 || step > maxVolume {
+			return NewError(fmt.Sprintf("invalid step '%s', must be between 1 and %d", s, maxVolume), http.StatusBadRequest)
+		}
+	}
+	if !up {
+		step = -step
+	}
+
+	v := receiver.Volume + step
+	if v < 0 {
+		v = 0
+	}
+	log.Debug("stepping volume for %s: %d -> %d", receiver.Id(), receiver.Volume, v)
+	receiver.Volume = receiver.limitVolume(v)
+	// changing the volume unmutes
+	receiver.Muted = false
 	notifyNewConfig()
 	return nil
 }
@@ -302,13 +657,17 @@ func serveApiReceiverServer(w http.ResponseWriter, req *http.Request, receiver *
 func serveApiReceiverVolume(w http.ResponseWriter, req *http.Request, receiver *Receiver, volume string) *ServeError {
 	log.Debug("/api/receiver receiver: %s, volume: %s", receiver.Id(), volume)
 
+	if volume == "up" || volume == "down" {
+		return serveApiReceiverVolumeStep(w, req, receiver, volume == "up")
+	}
+
 	v, err := strconv.Atoi(volume)
 	if err != nil {
-		return NewInternalError(fmt.Sprintf("invalid volume '%s': %s", volume, err))
+		return NewError(fmt.Sprintf("invalid volume '%s': %s", volume, err), http.StatusBadRequest)
 	}
 
-	if v < 0 || v > 1000 {
-		return NewInternalError(fmt.Sprintf("invalid volume '%d'", v))
+	if err := checkVolume(v, receiver.volumeLimit()); err != nil {
+		return NewError(err.Error(), http.StatusBadRequest)
 	}
 
 	log.Debug("setting new volume for %s: %d", receiver.Id(), v)
@@ -317,14 +676,136 @@ func serveApiReceiverVolume(w http.ResponseWriter, req *http.Request, receiver *
 	return nil
 }
 
+// GET /api/receiver?id=${receiver-id}&mute=[true,false,toggle]
+func serveApiReceiverMute(w http.ResponseWriter, req *http.Request, receiver *Receiver, mute string) *ServeError {
+	log.Debug("/api/receiver receiver: %s, mute: %s", receiver.Id(), mute)
+
+	if mute == "toggle" {
+		receiver.Muted = !receiver.Muted
+	} else if m, err := strconv.ParseBool(mute); err == nil {
+		receiver.Muted = m
+	} else {
+		return NewError(fmt.Sprintf("invalid mute '%s', use true, false or toggle", mute), http.StatusBadRequest)
+	}
+	notifyNewConfig()
+	return nil
+}
+
+// GET /api/receiver?id=${receiver-id}&maxvolume=[0,150]
+func serveApiReceiverMaxVolume(w http.ResponseWriter, req *http.Request, receiver *Receiver, max string) *ServeError {
+	log.Debug("/api/receiver receiver: %s, max volume: %s", receiver.Id(), max)
+
+	v, err := strconv.Atoi(max)
+	if err != nil {
+		return NewError(fmt.Sprintf("invalid max volume '%s': %s", max, err), http.StatusBadRequest)
+	}
+	if err := checkVolume(v, maxVolume); err != nil {
+		return NewError(err.Error(), http.StatusBadRequest)
+	}
+	// 0 removes the limit
+	receiver.MaxVolume = v
+	receiver.Volume = receiver.limitVolume(receiver.Volume)
+	notifyNewConfig()
+	return nil
+}
+
+// GET /api/receiver?id=${receiver-id}&group=${group}
+func serveApiReceiverGroup(w http.ResponseWriter, req *http.Request, receiver *Receiver, group string) *ServeError {
+	log.Debug("/api/receiver receiver: %s, group: %s", receiver.Id(), group)
+
+	// "-" removes the receiver from its group
+	if group == "-" {
+		group = ""
+	}
+	receiver.Group = group
+	notifyNewConfig()
+	return nil
+}
+
+// GET /api/receiver?id=${receiver-id}&output=${output-uri}
+func serveApiReceiverOutput(w http.ResponseWriter, req *http.Request, receiver *Receiver, output string) *ServeError {
+	log.Debug("/api/receiver receiver: %s, output: %s", receiver.Id(), output)
+
+	if err := checkOutputUri(output); err != nil {
+		return NewError(err.Error(), http.StatusBadRequest)
+	}
+	receiver.Output = output
+	notifyNewConfig()
+	return nil
+}
+
+// GET /api/receiver?id=${receiver-id}[&channels=${channels}][&delay=${ms}][&eq=${gains}][&loudness=${bool}]
+func serveApiReceiverAudio(w http.ResponseWriter, req *http.Request, receiver *Receiver) *ServeError {
+	log.Debug("/api/receiver receiver: %s, audio settings", receiver.Id())
+
+	channels := req.FormValue("channels")
+	if err := checkChannels(channels); err != nil {
+		return NewError(err.Error(), http.StatusBadRequest)
+	}
+	delay := receiver.Delay
+	if v := req.FormValue("delay"); v != "" {
+		var err error
+		if delay, err = strconv.Atoi(v); err != nil {
+			return NewError(fmt.Sprintf("invalid delay: %s", v), http.StatusBadRequest)
+		}
+		if err := checkDelay(delay); err != nil {
+			return NewError(err.Error(), http.StatusBadRequest)
+		}
+	}
+	eq := receiver.Eq
+	if v := req.FormValue("eq"); v != "" {
+		var err error
+		if eq, err = parseEq(v); err != nil {
+			return NewError(err.Error(), http.StatusBadRequest)
+		}
+	}
+	loudness := receiver.Loudness
+	if v := req.FormValue("loudness"); v != "" {
+		var err error
+		if loudness, err = strconv.ParseBool(v); err != nil {
+			return NewError(fmt.Sprintf("invalid loudness: %s", v), http.StatusBadRequest)
+		}
+	}
+
+	if channels != "" {
+		receiver.Channels = channels
+	}
+	receiver.Delay = delay
+	receiver.Eq = eq
+	receiver.Loudness = loudness
+	notifyNewConfig()
+	return nil
+}
+
+func hasAudioParams(req *http.Request) bool {
+	for _, k := range []string{"channels", "delay", "eq", "loudness"} {
+		if req.FormValue(k) != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // GET /api/receiver?id=${receiver-id}&server=${server-id}
 // GET /api/receiver?id=${receiver-id}&radio=${radio-id}
+// GET /api/receiver?id=${receiver-id}&radio=[next,prev,last,off]
 // GET /api/receiver?id=${receiver-id}&volume=[0,100]
+// GET /api/receiver?id=${receiver-id}&volume=[up,down][&step=${percent}]
+// GET /api/receiver?id=${receiver-id}&group=${group}
+// GET /api/receiver?id=${receiver-id}&output=${output-uri}
+// GET /api/receiver?id=${receiver-id}&mute=[true,false,toggle]
+// GET /api/receiver?id=${receiver-id}&maxvolume=[0,150]
+// GET /api/receiver?id=${receiver-id}&channels=${channels}&delay=${ms}&eq=${gains}&loudness=${bool}
 func serveApiReceiver(w http.ResponseWriter, req *http.Request) *ServeError {
-	receiver_id := req.URL.Query().Get("id")
-	server_id := req.URL.Query().Get("server")
-	radio_id := req.URL.Query().Get("radio")
-	volume := req.URL.Query().Get("volume")
+	// query for api calls, form values for ui forms
+	receiver_id := req.FormValue("id")
+	server_id := req.FormValue("server")
+	radio_id := req.FormValue("radio")
+	volume := req.FormValue("volume")
+	group := req.FormValue("group")
+	output := req.FormValue("output")
+	mute := req.FormValue("mute")
+	max_volume := req.FormValue("maxvolume")
 
 	r, ok := config.Receivers[receiver_id]
 	if !ok {
@@ -337,11 +818,30 @@ func serveApiReceiver(w http.ResponseWriter, req *http.Request) *ServeError {
 		return serveApiReceiverRadio(w, req, r, radio_id)
 	} else if volume != "" && radio_id == "" && server_id == "" {
 		return serveApiReceiverVolume(w, req, r, volume)
+	} else if group != "" && volume == "" && radio_id == "" && server_id == "" {
+		return serveApiReceiverGroup(w, req, r, group)
+	} else if output != "" && volume == "" && radio_id == "" && server_id == "" {
+		return serveApiReceiverOutput(w, req, r, output)
+	} else if mute != "" && volume == "" && radio_id == "" && server_id == "" {
+		return serveApiReceiverMute(w, req, r, mute)
+	} else if max_volume != "" && volume == "" && radio_id == "" && server_id == "" {
+		return serveApiReceiverMaxVolume(w, req, r, max_volume)
+	} else if hasAudioParams(req) && volume == "" && radio_id == "" && server_id == "" {
+		return serveApiReceiverAudio(w, req, r)
 	} else {
 		return NewInternalError("server or radio is mandatory")
 	}
 }
 
+// call the receiver api on behalf of other interfaces, validating like http requests
+func receiverCommand(receiver_id, param, value string) *ServeError {
+	params := url.Values{}
+	params.Set("id", receiver_id)
+	params.Set(param, value)
+	req, _ := http.NewRequest("GET", "/api/receiver?"+params.Encode(), nil)
+	return serveApiReceiver(nil, req)
+}
+
 func serveJson(w http.ResponseWriter, req *http.Request, obj interface{}) *ServeError {
 	b, err := json.Marshal(obj)
 	if err != nil {
@@ -353,37 +853,145 @@ func serveJson(w http.ResponseWriter, req *http.Request, obj interface{}) *Serve
 	}
 }
 
+// response kept in memory until the config lock is released
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	if b.code != 0 {
+		w.WriteHeader(b.code)
+	}
+	w.Write(b.body.Bytes())
+}
+
+// handlers locking on their own, streams and slow i/o must not block other requests
+func locksOnItsOwn(req *http.Request) bool {
+	switch req.URL.Path {
+	case "/api/media_player/events", "/api/server/logs":
+		return req.Method == "GET"
+	case "/api/directory", "/api/radio/logo":
+		return true
+	}
+	return false
+}
+
 func serve(w http.ResponseWriter, req *http.Request) {
 	log.Debug("serve: %s %s", req.Method, req.URL.Path)
 
+	if cluster != nil && forwardToLeader(req) {
+		cluster.forward(w, req)
+		return
+	}
+	if locksOnItsOwn(req) {
+		route(w, req)
+		return
+	}
+
+	// hold the lock while handling the request only, not while talking to the client
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading body: %s", err), http.StatusBadRequest)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res := newBufferedResponse()
+	func() {
+		configLock.Lock()
+		defer configLock.Unlock()
+		route(res, req)
+	}()
+	res.writeTo(w)
+}
+
+func route(w http.ResponseWriter, req *http.Request) {
 	var err *ServeError
-	if req.URL.Path == "/" {
-		localPath := *staticDir + "/index.html"
-		http.ServeFile(w, req, localPath)
+	if strings.HasPrefix(req.URL.Path, "/api/cluster") {
+		err = serveApiCluster(w, req)
+	} else if req.URL.Path == "/" {
+		err = serveIndex(w, req)
+	} else if req.Method == "POST" && req.URL.Path == "/ui/receiver" {
+		err = serveUiReceiver(w, req)
+	} else if req.Method == "POST" && req.URL.Path == "/ui/radio" {
+		err = serveUiRadio(w, req)
+	} else if req.Method == "POST" && req.URL.Path == "/ui/radio/delete" {
+		err = serveUiRadioDelete(w, req)
 	} else if req.Method == "POST" && strings.HasPrefix(req.URL.Path, "/api/ping") {
 		err = serveApiPing(w, req)
-	} else if (req.Method == "POST" || req.Method == "DELETE") && req.URL.Path == "/api/radio" {
+	} else if req.URL.Path == "/api/radio/logo" {
+		err = serveApiRadioLogo(w, req)
+	} else if req.Method == "GET" && req.URL.Path == "/api/radios" {
+		err = serveApiRadios(w, req)
+	} else if req.Method == "POST" && req.URL.Path == "/api/radios/order" {
+		err = serveApiRadiosOrder(w, req)
+	} else if req.Method != "GET" && req.URL.Path == "/api/radio" {
 		err = serveApiRadio(w, req)
 	} else if req.URL.Path == "/api/config" {
 		err = serveJson(w, req, config)
 	} else if req.URL.Path == "/api/receiver" {
 		err = serveApiReceiver(w, req)
+	} else if req.URL.Path == "/api/directory" {
+		err = serveApiDirectory(w, req)
+	} else if req.URL.Path == "/api/schedule" {
+		err = serveApiSchedule(w, req)
+	} else if (req.Method == "POST" || req.Method == "DELETE") && req.URL.Path == "/api/sleep" {
+		err = serveApiSleep(w, req)
+	} else if req.Method == "GET" && req.URL.Path == "/api/media_player/events" {
+		err = serveApiMediaPlayerEvents(w, req)
+	} else if req.URL.Path == "/api/media_player" || (req.Method == "POST" && strings.HasPrefix(req.URL.Path, "/api/media_player/")) {
+		err = serveApiMediaPlayer(w, req)
+	} else if req.Method == "GET" && req.URL.Path == "/api/server/logs" {
+		err = serveApiServerLogs(w, req)
+	} else if req.Method == "GET" && req.URL.Path == "/api/status" {
+		err = serveApiStatus(w, req)
+	} else if req.Method == "GET" && req.URL.Path == "/api/export" {
+		err = serveApiExport(w, req)
+	} else if req.Method == "POST" && req.URL.Path == "/api/import" {
+		err = serveApiImport(w, req)
 	} else {
 		http.NotFound(w, req)
 	}
 
 	if err != nil {
 		log.Error(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), err.ResponseCode)
 	}
 }
 
 func httpd(port int) {
 	log.Info("starting httpd on port %d", port)
 	addr := fmt.Sprintf(":%d", port)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(*staticDir))))
+	http.Handle(logoPath, serveLogos())
+	http.Handle("/static/", http.StripPrefix("/static/", staticFiles))
 	http.Handle("/ws/config", websocket.Handler(serveWsConfig))
-	http.Handle("/", http.HandlerFunc(serve))
+	http.HandleFunc("/events/config", serveEventsConfig)
+	http.HandleFunc("/metrics", serveMetrics)
+	http.HandleFunc("/healthz", serveHealth)
+	http.HandleFunc("/readyz", serveHealth)
+	http.Handle("/", instrument(serve))
 	err := http.ListenAndServe(addr, nil)
 	if err != nil {
 		log.Error("error starting httpd: %v", err)
@@ -401,6 +1009,17 @@ func loadConfigCache(configFile *string) {
 			return
 		}
 		json.Unmarshal(d, &config)
+		config.migrateRadioIds()
+		if config.Schedules == nil {
+			config.Schedules = make(map[string]*Schedule)
+		}
+		if config.Agents == nil {
+			config.Agents = make(map[string]*Agent)
+		}
+		// give agents time to ping before re-placing their senders
+		for _, a := range config.Agents {
+			a.Ping()
+		}
 		// delete internal servers
 		for k, s := range config.Servers {
 			if s.Internal {
@@ -417,12 +1036,14 @@ func loadConfigCache(configFile *string) {
 	} else {
 		log.Info("create initial config")
 		config = NewConfig()
-		config.addRadio(&Radio{"Test", "test"})
+		config.addRadio(&Radio{Name: "Test", Uri: "test"})
 	}
 }
 
 func saveConfigCache(configFile *string) {
+	configLock.Lock()
 	d, err := json.Marshal(&config)
+	configLock.Unlock()
 	if err != nil {
 		log.Error("error writing config: %v", err)
 	}
@@ -437,17 +1058,21 @@ func saveConfigCache(configFile *string) {
 }
 
 func scheduleSaveConfigCache(configFile *string) {
-	for {
-		waitForNewConfig()
+	changes := configBroker.Subscribe()
+	for range changes {
 		saveConfigCache(configFile)
 	}
 }
 
 func scheduleBackendTimeout(c <-chan time.Time) {
 	for t := range c {
+		if !isLeader() {
+			continue
+		}
 		now := t.Unix()
-		threshold := now - int64(backendTimeout / time.Second)
+		threshold := now - int64(backendTimeout/time.Second)
 
+		configLock.Lock()
 		for k, o := range config.Servers {
 			if !o.Internal && o.LastPing < threshold {
 				log.Info("remove possibly dead server: %s", k)
@@ -463,29 +1088,7 @@ func scheduleBackendTimeout(c <-chan time.Time) {
 				o.ServerId = "off"
 			}
 		}
-	}
-}
-
-func scheduleServerTimeout(c <-chan time.Time) {
-	for _ = range c {
-		for _, s := range config.Servers {
-			if !s.Internal {
-				continue
-			}
-
-			// search for receivers listening to current server
-			server_id := s.Id()
-			found := false
-			for _, r := range config.Receivers {
-				if r.ServerId == server_id {
-					found = true
-					break
-				}
-			}
-			if !found {
-				stopServer(server_id)
-			}
-		}
+		configLock.Unlock()
 	}
 }
 
@@ -494,25 +1097,113 @@ func scheduleServerTimeout(c <-chan time.Time) {
 func main() {
 	configFile := flag.String("config-cache", configCacheFile, "File for persisting config state")
 	port = flag.Int("http", 8080, "Port for binding the config server")
-	staticDir = flag.String("webroot", "static", "Directory for serving static content")
+	staticDir = flag.String("webroot", "", "Directory for serving static content instead of the embedded web ui")
+	logoDir = flag.String("logos", "/tmp/rtp-logos", "Directory for storing uploaded radio logos")
 	complexity = flag.Int("complexity", 10, "opusenc: complexity [0-10]")
+	pipelineBackoff.registerFlags("retry", "max-errors", "internal senders")
+	ports := flag.String("sender-ports", "48110-48199", "Port range of internal senders")
+	senderGrace = flag.Duration("sender-grace", 10*time.Second, "Keep senders without receivers running this long for receivers switching back")
+	senderMode = flag.String("sender-mode", senderModeProcess, "Run internal senders as supervised rtp-sender processes (process) or inside the config server (inprocess)")
+	senderBinary = flag.String("sender-binary", defaultSenderBinary(), "rtp-sender binary run for internal senders in process mode")
+	processBackoff.registerFlags("restart", "max-restarts", "crashed sender processes")
+	directoryUri = flag.String("radio-directory", "https://de1.api.radio-browser.info", "Radio-Browser compatible directory base uri or local json file")
+	exportTo := flag.String("export", "", "Export radios from config cache to file and exit")
+	importFrom := flag.String("import", "", "Import radios from file into config cache and exit")
+	format := flag.String("format", "", "Format for --export/--import: json, m3u or opml (default: guessed from file name)")
+	scope := flag.String("export-scope", scopeRadios, "Scope for --export: radios or config")
+	importMode := flag.String("import-mode", importMerge, "Mode for --import: merge or replace")
+	hostname, _ := os.Hostname()
+	mqttUri := flag.String("mqtt", "", "MQTT broker uri for publishing state and receiving commands, e.g. tcp://localhost:1883, empty disables the bridge")
+	mqttPrefix := flag.String("mqtt-prefix", "ub0r", "Prefix of MQTT topics")
+	mqttClientId := flag.String("mqtt-client-id", "rtp-config-"+hostname, "MQTT client id")
+	mqttUser := flag.String("mqtt-user", "", "MQTT user name")
+	mqttPassword := flag.String("mqtt-password", "", "MQTT password, better set by environment variable "+envName("mqtt-password"))
+	mqttKeepAlive := flag.Duration("mqtt-keepalive", time.Minute, "MQTT keep alive interval")
+	peers := flag.String("peers", "", "Comma separated uris of other config servers replicating the config, empty runs a single config server")
+	placement = flag.String("placement", placementLeastLoaded, "Placement of new senders: local for internal senders, least-loaded or closest agent")
+	advertise := flag.String("advertise-uri", "", "Uri of this config server as reached by its peers (default: http://${hostname}:${http})")
 	verbose := flag.Bool("verbose", false, "verbose logging")
-	flag.Parse()
+	parseOptions(func(e *OptionErrors) {
+		e.check("http", checkRange(*port, 1, 65535))
+		e.check("complexity", checkRange(*complexity, 0, 10))
+		e.check("retry", pipelineBackoff.validate())
+		e.check("sender-mode", checkSenderMode(*senderMode))
+		e.check("sender-ports", checkPortRange(*ports))
+		e.check("sender-grace", checkRange(int(*senderGrace/time.Second), 0, 86400))
+		e.check("restart", processBackoff.validate())
+		if *senderMode == senderModeProcess {
+			e.check("sender-binary", checkRequired(*senderBinary))
+		}
+		if *format != "" {
+			e.check("format", checkFormat(*format))
+		}
+		e.check("export-scope", checkOneOf(*scope, scopeRadios, scopeConfig))
+		e.check("import-mode", checkOneOf(*importMode, importMerge, importReplace))
+		e.check("peers", checkUris(*peers))
+		e.check("advertise-uri", checkUris(*advertise))
+		e.check("placement", checkPlacement(*placement))
+		if *mqttUri != "" {
+			e.check("mqtt", checkMqttUri(*mqttUri))
+			e.check("mqtt-prefix", checkRequired(*mqttPrefix))
+			e.check("mqtt-keepalive", checkRange(int(*mqttKeepAlive/time.Second), 1, 65535))
+		}
+	})
 	initLogger(*verbose)
-
-	if *complexity < 0 || *complexity > 10 {
-		log.Error("--complexity must be between 0 and 10")
-		os.Exit(1)
+	senderPorts, _ = parsePortRange(*ports)
+
+	if *exportTo != "" || *importFrom != "" {
+		loadConfigCache(configFile)
+		if *importFrom != "" {
+			if err := importFile(*importFrom, *format, *importMode); err != nil {
+				log.Error("error importing %s: %s", *importFrom, err)
+				os.Exit(1)
+			}
+			saveConfigCache(configFile)
+		}
+		if *exportTo != "" {
+			if err := exportFile(*exportTo, *format, *scope); err != nil {
+				log.Error("error exporting %s: %s", *exportTo, err)
+				os.Exit(1)
+			}
+		}
+		return
 	}
 
 	log.Info("starting")
-	locker := &sync.Mutex{}
-	configCond = sync.NewCond(locker)
-
+	if *staticDir != "" {
+		log.Info("serving static content from %s", *staticDir)
+		staticFiles = NewDiskFiles(*staticDir)
+	} else {
+		staticFiles = NewEmbeddedFiles()
+	}
 	loadConfigCache(configFile)
 	go scheduleSaveConfigCache(configFile)
 	go scheduleBackendTimeout(time.Tick(backendTimeout))
-	go scheduleServerTimeout(time.Tick(serverTimeout))
+	go scheduleSenderLifecycle(time.Tick(lifecycleInterval))
+	go scheduleAgentTimeout(time.Tick(agentHeartbeat))
+	registerConfigMetrics()
+	if *peers != "" {
+		if *advertise == "" {
+			*advertise = fmt.Sprintf("http://%s:%d", hostname, *port)
+		}
+		self, _ := parseUris(*advertise)
+		others, _ := parseUris(*peers)
+		cluster = NewCluster(self[0], others)
+		cluster.start()
+	}
+	scheduler = NewScheduler(realClock{})
+	go scheduler.loop()
+	if *mqttUri != "" {
+		u, _ := url.Parse(*mqttUri)
+		client := &MqttClient{
+			Uri:       u,
+			ClientId:  *mqttClientId,
+			User:      *mqttUser,
+			Password:  *mqttPassword,
+			KeepAlive: *mqttKeepAlive,
+		}
+		NewMqttBridge(client, *mqttPrefix).start()
+	}
 
 	httpd(*port)
 
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fails the test unless the config lock is released within a second
+func assertUnlocked(t *testing.T, what string) {
+	t.Helper()
+	locked := make(chan bool)
+	go func() {
+		configLock.Lock()
+		configLock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("config locked while %s", what)
+	}
+}
+
+func TestServeReadsBodyWithoutLock(t *testing.T) {
+	config = NewConfig()
+	config.Radios["radio-1"] = &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one"}
+	body, upload := io.Pipe()
+	req := httptest.NewRequest("POST", "/api/radios/order", body)
+	w := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		serve(w, req)
+		close(done)
+	}()
+
+	// a slow client
+	io.WriteString(upload, `["radio-1"`)
+	assertUnlocked(t, "reading the body")
+	io.WriteString(upload, `]`)
+	upload.Close()
+	<-done
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Uid":"radio-1"`) {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("content type %s", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestServeErrorBuffered(t *testing.T) {
+	config = NewConfig()
+	w := httptest.NewRecorder()
+	serve(w, httptest.NewRequest("POST", "/api/radios/order", strings.NewReader("[")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestServeRadioLogo(t *testing.T) {
+	dir := t.TempDir()
+	logoDir = &dir
+	config = NewConfig()
+	r := &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one"}
+	config.Radios[r.Id()] = r
+
+	upload := func(mimeType string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/radio/logo?id=radio-1", body)
+		req.Header.Set("Content-Type", mimeType)
+		w := httptest.NewRecorder()
+		serve(w, req)
+		return w
+	}
+
+	// written while the lock is released
+	body, slow := io.Pipe()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- upload("image/png", body) }()
+	io.WriteString(slow, "png")
+	assertUnlocked(t, "uploading a logo")
+	slow.Close()
+	if w := <-done; w.Code != http.StatusOK {
+		t.Fatalf("upload failed %d: %s", w.Code, w.Body)
+	}
+	if r.Logo != logoPath+"radio-1.png" {
+		t.Errorf("logo %s", r.Logo)
+	}
+
+	// replacing with another type removes the old file
+	if w := upload("image/jpeg", strings.NewReader("jpg")); w.Code != http.StatusOK {
+		t.Fatalf("upload failed %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "radio-1.png")); !os.IsNotExist(err) {
+		t.Error("replaced logo not removed")
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "radio-1.jpg")); string(b) != "jpg" {
+		t.Errorf("logo content %q", b)
+	}
+
+	if w := upload("image/svg+xml", strings.NewReader("<svg/>")); w.Code != http.StatusBadRequest {
+		t.Errorf("svg upload status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w := httptest.NewRecorder()
+	serve(w, httptest.NewRequest("DELETE", "/api/radio/logo?id=radio-1", nil))
+	if w.Code != http.StatusOK || r.Logo != "" {
+		t.Errorf("delete status %d, logo %q", w.Code, r.Logo)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "radio-1.jpg")); !os.IsNotExist(err) {
+		t.Error("deleted logo not removed")
+	}
+}
+
+func TestServeRadioForeignLogo(t *testing.T) {
+	dir := t.TempDir()
+	logoDir = &dir
+	config = NewConfig()
+	config.Radios["radio-1"] = &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one", Logo: logoPath + "radio-1.png"}
+	config.Radios["radio-2"] = &Radio{Uid: "radio-2", Name: "Two", Uri: "http://example.com/two"}
+	os.WriteFile(filepath.Join(dir, "radio-1.png"), []byte("png"), 0644)
+
+	for _, tt := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"PATCH", "/api/radio?id=radio-2", `{"Logo": "/static/logos/radio-1.png"}`, http.StatusBadRequest},
+		{"PATCH", "/api/radio?id=radio-2", `{"Logo": "/static/logos/../radio-1.png"}`, http.StatusBadRequest},
+		{"PUT", "/api/radio?id=radio-2", `{"Name": "Two", "Uri": "http://example.com/two", "Logo": "/static/logos/radio-1.png"}`, http.StatusBadRequest},
+		{"POST", "/api/radio", `{"Name": "Three", "Uri": "http://example.com/three", "Logo": "/static/logos/radio-1.png"}`, http.StatusBadRequest},
+		{"PATCH", "/api/radio?id=radio-2", `{"Logo": "http://example.com/two.png"}`, http.StatusOK},
+		{"PATCH", "/api/radio?id=radio-1", `{"Logo": "/static/logos/radio-1.png"}`, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		serve(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%s %s %s: status %d, want %d", tt.method, tt.path, tt.body, w.Code, tt.code)
+		}
+	}
+
+	// removing a radio referring to another one's logo keeps that file
+	config.Radios["radio-2"].Logo = logoPath + "radio-1.png"
+	w := httptest.NewRecorder()
+	serve(w, httptest.NewRequest("DELETE", "/api/radio?id=radio-2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete status %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "radio-1.png")); err != nil {
+		t.Errorf("logo of another radio removed: %s", err)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want *PortRange
+	}{
+		{"48110-48199", &PortRange{48110, 48199}},
+		{" 5000 - 5001 ", &PortRange{5000, 5001}},
+		{"5000", &PortRange{5000, 5000}},
+		{"1-65535", &PortRange{1, 65535}},
+		{"", nil},
+		{"a-b", nil},
+		{"5000-", nil},
+		{"-5000", nil},
+		{"1-2-3", nil},
+		{"0-10", nil},
+		{"10-5", nil},
+		{"65535-65536", nil},
+	} {
+		got, err := parsePortRange(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("malformed range %q accepted as %s", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || *got != *tt.want {
+			t.Errorf("%q: %v, %v, want %s", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestFindFreePort(t *testing.T) {
+	// the first port of the range is bound by another process
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	first := ln.Addr().(*net.TCPAddr).Port
+	if first == 65535 || !portFree(first+1) {
+		t.Skipf("port after %d not free", first)
+	}
+	senderPorts = &PortRange{first, first + 1}
+	setPlacement(t, placementLocal)
+	config = NewConfig()
+	hostname, _ := os.Hostname()
+
+	if port, err := findFreePort(hostname); err != nil || port != first+1 {
+		t.Fatalf("got port %d, %v, want %d", port, err, first+1)
+	}
+	// ports of servers on other hosts don't count
+	other := &Server{Host: "other", Port: first + 1}
+	config.Servers[other.Id()] = other
+	if port, err := findFreePort(hostname); err != nil || port != first+1 {
+		t.Errorf("got port %d, %v, want %d", port, err, first+1)
+	}
+
+	// exhausted
+	s := &Server{Internal: true, Host: hostname, Port: first + 1, RadioId: "radio-2"}
+	config.Servers[s.Id()] = s
+	if port, err := findFreePort(hostname); err == nil {
+		t.Errorf("got port %d from exhausted range", port)
+	}
+	config.Radios["radio-1"] = &Radio{Uid: "radio-1", Name: "One", Uri: "http://example.com/one"}
+	r := &Receiver{Name: "kitchen", ServerId: "off"}
+	config.Receivers[r.Id()] = r
+	w := httptest.NewRecorder()
+	serve(w, httptest.NewRequest("GET", "/api/receiver?id=receiver-kitchen&radio=radio-1", nil))
+	if w.Code != http.StatusServiceUnavailable || r.ServerId != "off" {
+		t.Errorf("status %d, receiver on %s, want %d", w.Code, r.ServerId, http.StatusServiceUnavailable)
+	}
+
+	// ports are reused once freed
+	delete(config.Servers, s.Id())
+	if port, err := findFreePort(hostname); err != nil || port != first+1 {
+		t.Errorf("port of stopped server: got %d, %v, want %d", port, err, first+1)
+	}
+	ln.Close()
+	if port, err := findFreePort(hostname); err != nil || port != first {
+		t.Errorf("port closed by another process: got %d, %v, want %d", port, err, first)
+	}
+}
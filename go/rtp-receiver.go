@@ -3,10 +3,13 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"strconv"
 	"strings"
 	"time"
@@ -16,9 +19,36 @@ import (
 	"github.com/ziutek/gst"
 )
 
+var (
+	receiverReconnects = metrics.NewCounter("ub0r_receiver_reconnects_total", "Reconnects to a server after errors or the end of the stream")
+	configReconnects   = metrics.NewCounter("ub0r_config_reconnects_total", "Attempts to connect to the config server")
+)
+
+// volume changes are faded in steps
+const volumeStep = 50 * time.Millisecond
+
+var volumeRamp time.Duration
+
+// last config received, used while the config server is unreachable
+var stateFile string
+
+// don't hang on config servers accepting connections without answering
+var configClient = &http.Client{Timeout: 10 * time.Second}
+
+// wait before stopping a pipeline switched off repeatedly, independent of config retries
+const settleDelay = 5 * time.Second
+
+// web socket to the config server
+var configBackoff = BackoffPolicy{
+	Initial:    time.Second,
+	Max:        time.Hour,
+	Multiplier: 2,
+	Jitter:     0.1,
+}
+
 func fetchObject(uri string, obj interface{}) (interface{}, error) {
 	log.Debug("fetch object: %s", uri)
-	resp, err := http.Get(uri)
+	resp, err := configClient.Get(uri)
 	if err != nil {
 		return nil, err
 	}
@@ -43,6 +73,69 @@ func fetchConfig(base string) (*Config, error) {
 	return &config, err
 }
 
+// write config to the state file, replacing it atomically
+func cacheConfig(config *Config) {
+	if stateFile == "" {
+		return
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		log.Error("error writing state: %s", err)
+		return
+	}
+	tmp := stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		log.Error("error writing state: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, stateFile); err != nil {
+		log.Error("error writing state: %s", err)
+	}
+}
+
+func loadCachedConfig() (*Config, error) {
+	var config Config
+	b, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &config)
+	return &config, err
+}
+
+// fetch config, falling back to the last known or cached one while the config server is unreachable
+func (m *Manager) currentConfig(last *Config) *Config {
+	for {
+		uri := m.ConfigUri
+		config, err := fetchConfig(uri)
+		if err == nil {
+			m.setConfigRevision(config.Revision)
+			cacheConfig(config)
+			return config
+		}
+		log.Error("error fetching config: %s", err)
+		m.failover(uri)
+		if last != nil {
+			log.Info("config server unreachable, keep using last known config")
+			return last
+		}
+		if stateFile != "" {
+			cached, err := loadCachedConfig()
+			if err == nil {
+				log.Info("config server unreachable, using cached config from %s", stateFile)
+				m.setConfigRevision(cached.Revision)
+				return cached
+			}
+			log.Error("error reading cached config: %s", err)
+		}
+		// watchConfig sends the config once the config server is reachable
+		log.Info("waiting for config server")
+		if config := m.WaitForNewConfig(); config != nil {
+			return config
+		}
+	}
+}
+
 func readBlob(ws *websocket.Conn) ([]byte, error) {
 	buf := make([]byte, 0)
 
@@ -79,6 +172,8 @@ func (m *Manager) readConfig(ws *websocket.Conn) error {
 
 	// send new config to pipeline
 	log.Debug("got new config: %s", config)
+	m.setConfigRevision(config.Revision)
+	cacheConfig(&config)
 	m.NewConfig(&config)
 	return nil
 }
@@ -96,24 +191,30 @@ func (m *Manager) readConfigs(ws *websocket.Conn) {
 }
 
 func (m *Manager) watchConfig() {
-	backOff := time.Second
+	retry := configBackoff.NewBackoff(realClock{})
 
 	for {
 		origin := m.ConfigUri
-		url := strings.Replace(m.ConfigUri, "http", "ws", 1) + "/ws/config"
+		url := strings.Replace(origin, "http", "ws", 1) + "/ws/config"
+		configReconnects.Inc()
 		ws, err := websocket.Dial(url, "", origin)
 		if err != nil {
 			log.Error("unable to reach config server: %s", err)
-			time.Sleep(backOff)
-			// exponential back off, max = 1h
-			if backOff < time.Hour {
-				backOff *= 2
-			} else {
-				backOff = time.Hour
+			m.failover(origin)
+			if !retry.Wait() {
+				// keep playing the last known config, the config server may come back any time
+				log.Error("unable to reach config server after %d retries, retrying every %s", retry.Attempts(), configBackoff.Max)
+				time.Sleep(configBackoff.Max)
 			}
 		} else {
-			// reset back off
-			backOff = time.Second
+			retry.Reset()
+			// the config server is authoritative, catch up on changes missed while disconnected
+			if config, err := fetchConfig(origin); err == nil {
+				log.Info("connected to config server, revision %d", config.Revision)
+				m.setConfigRevision(config.Revision)
+				cacheConfig(config)
+				m.NewConfig(config)
+			}
 			m.readConfigs(ws)
 		}
 	}
@@ -138,90 +239,287 @@ func (m *Manager) checkServer(server *Server) bool {
 	return err == nil
 }
 
-func (m *Manager) setVolume() {
+func (m *Manager) setVolume(ramp bool) {
 	if m.Pipeline == nil {
 		return
 	}
-	volume := m.Pipeline.GetByName("volume")
-	if volume == nil {
-		log.Error("unable to find pipeline element 'volume'")
+	r := m.Receiver()
+	// rtp volume [0,maxVolume] plus radio gain
+	// gst volume [0,10]
+	v := volumeFactor(r.Volume, r.Muted, m.gain)
+	log.Debug("set new volume: %f", v)
+	m.volumeChanges <- volumeChange{v, ramp}
+	m.setEq()
+}
+
+// called by the volume loop, stopping the pipeline waits for it
+func (m *Manager) applyVolume(v float64) {
+	m.withPipeline(func(pl *gst.Pipeline) {
+		volume := pl.GetByName("volume")
+		if volume == nil {
+			log.Error("unable to find pipeline element 'volume'")
+			return
+		}
+		volume.SetProperty("volume", v)
+	})
+}
+
+// apply volume changes to the pipeline, fading in steps if requested
+func (m *Manager) volumeLoop() {
+	var current, target, step float64
+	var tick <-chan time.Time
+	for {
+		select {
+		case c := <-m.volumeChanges:
+			target = c.volume
+			if !c.ramp || volumeRamp < volumeStep {
+				current = target
+				m.applyVolume(current)
+				tick = nil
+				continue
+			}
+			step = math.Abs(target-current) / float64(volumeRamp/volumeStep)
+			tick = time.After(volumeStep)
+		case <-tick:
+			if math.Abs(target-current) <= step {
+				current = target
+				tick = nil
+			} else {
+				if target > current {
+					current += step
+				} else {
+					current -= step
+				}
+				tick = time.After(volumeStep)
+			}
+			m.applyVolume(current)
+		}
+	}
+}
+
+// normalization of the radio played by the given receiver
+func radioGain(config *Config, id string) float64 {
+	r, ok := config.Receivers[id]
+	if !ok {
+		return 0
+	}
+	if s, ok := config.Servers[r.ServerId]; ok {
+		if radio, ok := config.Radios[s.RadioId]; ok {
+			return radio.Gain
+		}
+	}
+	return 0
+}
+
+// update equalizer, loudness compensation depends on volume
+func (m *Manager) setEq() {
+	eq := m.Pipeline.GetByName("eq")
+	if eq == nil {
+		log.Error("unable to find pipeline element 'eq'")
 		return
 	}
-	// rtp volume [0,100]
-	// gst volume [0,1]
-	v := float64(m.Receiver().Volume) / 100
-	log.Debug("set new volume: %d", v)
-	volume.SetProperty("volume", v)
+	r := m.Receiver()
+	for i, g := range eqGains(r.Eq, r.Loudness, r.Volume) {
+		eq.SetProperty(fmt.Sprintf("band%d", i), g)
+	}
+}
+
+// element of a chain, linked to its predecessor with the given caps if any
+type stage struct {
+	elem *gst.Element
+	caps string
+}
+
+// elements between decoder and volume: channel mapping and equalizer
+func (m *Manager) buildFilters(channels string) []stage {
+	stages := []stage{{makeNamedElem("audioconvert", "convert"), ""}}
+	switch channels {
+	case channelsLeft, channelsRight:
+		pan := makeElem("audiopanorama")
+		// simple panning silences the other channel instead of mixing it in
+		pan.SetProperty("method", 1)
+		if channels == channelsLeft {
+			pan.SetProperty("panorama", -1.0)
+		} else {
+			pan.SetProperty("panorama", 1.0)
+		}
+		stages = append(stages, stage{pan, "audio/x-raw,channels=2"})
+	case channelsMono:
+		// downmix and play on all speakers
+		stages = append(stages, stage{makeNamedElem("audioconvert", "downmix"), "audio/x-raw,channels=1"})
+	}
+	return append(stages, stage{makeNamedElem("equalizer-10bands", "eq"), ""})
+}
+
+// hold back audio to align receivers with different output latency
+func buildDelay(ms int) *gst.Element {
+	ns := uint64(ms) * uint64(time.Millisecond)
+	delay := makeNamedElem("queue", "delay")
+	delay.SetProperty("min-threshold-time", ns)
+	delay.SetProperty("max-size-time", ns+uint64(time.Second))
+	delay.SetProperty("max-size-buffers", 0)
+	delay.SetProperty("max-size-bytes", 0)
+	return delay
+}
+
+// build elements playing audio on the given output, to be linked in order
+func (m *Manager) buildSink(uri string) []*gst.Element {
+	parts := strings.SplitN(uri, ":", 2)
+	var elems []*gst.Element
+	switch parts[0] {
+	case "alsa":
+		sink := makeElem("alsasink")
+		if len(parts) == 2 {
+			sink.SetProperty("device", parts[1])
+		}
+		elems = []*gst.Element{sink}
+	case "pulse":
+		sink := makeElem("pulsesink")
+		if len(parts) == 2 {
+			sink.SetProperty("device", parts[1])
+		}
+		elems = []*gst.Element{sink}
+	case "file":
+		sink := makeElem("filesink")
+		sink.SetProperty("location", strings.TrimPrefix(parts[1], "//"))
+		elems = []*gst.Element{makeElem("audioconvert"), makeElem("wavenc"), sink}
+	case outputFake:
+		elems = []*gst.Element{makeElem("fakesink")}
+	default:
+		elems = []*gst.Element{makeElem("autoaudiosink")}
+	}
+	elems[len(elems)-1].SetProperty("sync", false)
+	return elems
+}
+
+// outputs available on this host: alsa playback devices and pulse sinks
+func listOutputs() []string {
+	outputs := []string{outputAuto}
+	if b, err := ioutil.ReadFile("/proc/asound/pcm"); err == nil {
+		for _, l := range strings.Split(string(b), "\n") {
+			// 01-00: USB Audio : USB Audio : playback 1 : capture 1
+			var card, dev int
+			if !strings.Contains(l, "playback") {
+				continue
+			}
+			if _, err := fmt.Sscanf(l, "%d-%d:", &card, &dev); err == nil {
+				outputs = append(outputs, fmt.Sprintf("alsa:hw:%d,%d", card, dev))
+			}
+		}
+	}
+	if b, err := exec.Command("pactl", "list", "short", "sinks").Output(); err == nil {
+		for _, l := range strings.Split(string(b), "\n") {
+			if f := strings.Fields(l); len(f) > 1 {
+				outputs = append(outputs, "pulse:"+f[1])
+			}
+		}
+	}
+	return append(outputs, outputFake)
 }
 
 func (m *Manager) buildPipeline(server *Server) {
 	src := makeElem("tcpclientsrc")
 	src.SetProperty("host", server.Host)
 	src.SetProperty("port", server.Port)
+	// decouples network and decoding, its level is exported as metric
+	buffer := makeNamedElem("queue", "buffer")
 	dec := makeElem("decodebin")
+	r := m.Receiver()
+	stages := m.buildFilters(r.Channels)
 	volume := makeElem("volume")
-	volume.SetProperty("volume", 1.0)
-	sink := makeElem("autoaudiosink")
-	sink.SetProperty("sync", false)
+	volume.SetProperty("volume", 0.0)
+	stages = append(stages, stage{volume, ""})
+	if r.Delay > 0 {
+		stages = append(stages, stage{buildDelay(r.Delay), ""})
+	}
+	for _, e := range m.buildSink(r.Output) {
+		stages = append(stages, stage{e, ""})
+	}
 
-	m.Pipeline = gst.NewPipeline("pipeline")
+	m.setPipeline(gst.NewPipeline("pipeline"))
 	bus := m.Pipeline.GetBus()
 	bus.AddSignalWatch()
 	bus.Connect("message", m.onMessage, nil)
-	dec.ConnectNoi("pad-added", onPadAdded, volume.GetStaticPad("sink"))
+	dec.ConnectNoi("pad-added", onPadAdded, stages[0].elem.GetStaticPad("sink"))
 
 	addElem(m.Pipeline, src)
+	addElem(m.Pipeline, buffer)
 	addElem(m.Pipeline, dec)
-	addElem(m.Pipeline, volume)
-	addElem(m.Pipeline, sink)
-	linkElems(src, dec)
-	linkElems(dec, volume)
-	linkElems(volume, sink)
-	m.setVolume()
+	for _, s := range stages {
+		addElem(m.Pipeline, s.elem)
+	}
+	linkElems(src, buffer)
+	linkElems(buffer, dec)
+	linkElems(dec, stages[0].elem)
+	for i := 1; i < len(stages); i++ {
+		if stages[i].caps != "" {
+			linkFiltered(stages[i-1].elem, stages[i].elem, stages[i].caps)
+		} else {
+			linkElems(stages[i-1].elem, stages[i].elem)
+		}
+	}
+	// fade in
+	m.volumeChanges <- volumeChange{0, false}
+	m.setVolume(true)
 }
 
 func (m *Manager) playPipeline(server *Server) {
-	m.Pipeline = nil
+	m.setPipeline(nil)
+	addr := fmt.Sprintf("%s:%d", server.Host, server.Port)
+	m.setConnected(addr)
 	if m.checkServer(server) {
-		m.RetryCount = 0
 		m.buildPipeline(server)
 		m.StartPipeline()
-	} else if m.RetryCount >= maxRetry {
-		log.Warning("max retries reached, wait for new config")
-	} else {
+	} else if m.retry.Wait() {
 		// schedule recheck
-		m.RetryCount += 1
-		time.Sleep(retryInterval)
 		m.NewConfig(nil)
-		m.RetryCount = 0
+	} else {
+		log.Warning("max retries reached, wait for new config")
+		m.setFailed()
+		m.reportStatus()
+	}
+}
+
+// own settings from the config, kept if not registered yet, e.g. after a restart of the config server
+func (m *Manager) ownReceiver(config *Config) Pinger {
+	if r, ok := config.Receivers[m.Backend.Id()]; ok {
+		return r
 	}
+	return m.Backend
 }
 
 func (m *Manager) updateReceiver(config *Config) {
 	// update m.Backend from config.Backends.Receivers
-	m.Backend = config.Receivers[m.Backend.Id()]
+	m.Backend = m.ownReceiver(config)
+	m.gain = radioGain(config, m.Backend.Id())
 	// update volume of playing pipeline
-	m.setVolume()
+	m.setVolume(true)
 }
 
 func (m *Manager) loop() {
-	var config *Config
-	var err error
+	var config, last *Config
 	for {
 		log.Debug("starting new pipeline")
+		// the pipeline failed or the stream ended
+		restart := config == nil && last != nil
 		if config == nil {
-			config, err = fetchConfig(m.ConfigUri)
-			if err != nil {
-				log.Error("error fetching config: %s", err)
-				os.Exit(1)
-			}
+			config = m.currentConfig(last)
 		}
+		last = config
+		// settings of the receiver may have changed while not running
+		m.Backend = m.ownReceiver(config)
 
 		server := m.getServer(config)
+		m.gain = radioGain(config, m.Receiver().Id())
+		key := m.Receiver().pipelineKey()
 		if server != nil {
 			log.Info("connecting to server: %s:%d", server.Host, server.Port)
+			if restart {
+				receiverReconnects.Inc()
+			}
 			m.playPipeline(server)
 		} else {
+			m.setConnected("")
 			log.Info("unable to find suitable server for myself (%s), waiting for new config", m.Receiver().Host)
 		}
 		// watch state/config changes and restart pipeline
@@ -238,15 +536,22 @@ func (m *Manager) loop() {
 			}
 			m.updateReceiver(config)
 			newServer = m.getServer(config)
+			// rebuild pipeline for new output, channels or delay
+			if newServer != nil && m.Receiver().pipelineKey() != key {
+				log.Info("audio settings changed: %s -> %s", key, m.Receiver().pipelineKey())
+				break
+			}
 			// exit loop if server == off
 			if newServer == nil {
 				if !first {
-					time.Sleep(retryInterval)
+					time.Sleep(settleDelay)
 				}
 				break
 			}
 			first = false
 		}
+		// cancel fades before the pipeline goes away
+		m.volumeChanges <- volumeChange{0, false}
 		m.StopPipeline()
 	}
 }
@@ -254,16 +559,19 @@ func (m *Manager) loop() {
 func (m *Manager) scheduleBackendTimeout(c <-chan time.Time) {
 	for {
 		log.Debug("ping config server")
-		uri := m.ConfigUri + "/api/ping/"
-		pingConfig(uri+"receiver", m.Backend)
+		m.Receiver().Outputs = listOutputs()
+		m.Backend.SetStatus(m.Status())
+		m.ping()
 		<-c
 	}
 }
 
 func (m *Manager) startReceiver() {
 	log.Debug("starting receiver")
+	go m.volumeLoop()
 	go m.loop()
 	go m.watchConfig()
+	m.StatusPath = "/api/ping/receiver"
 	go m.scheduleBackendTimeout(time.Tick(backendTimeout / 2))
 	log.Debug("start gst loop")
 	glib.NewMainLoop(nil).Run()
@@ -274,12 +582,49 @@ func main() {
 	hostname, _ := os.Hostname()
 	m := NewReceiver()
 	r := m.Receiver()
-	flag.StringVar(&m.ConfigUri, "config-server", "http://localhost:8080", "config server base uri")
+	flag.StringVar(&m.ConfigUri, "config-server", "http://localhost:8080", "config server base uri, comma separated uris to fail over between several config servers")
 	flag.StringVar(&r.Name, "name", hostname, "receiver name")
 	flag.StringVar(&r.Host, "host", hostname, "receiver host name")
+	flag.DurationVar(&volumeRamp, "volume-ramp", 500*time.Millisecond, "Duration of fading volume changes, 0 changes volume at once")
+	flag.StringVar(&stateFile, "state-file", "/tmp/rtp-receiver.json", "File for caching the last config, used while the config server is unreachable, empty disables it")
+	flag.StringVar(&r.Output, "output", outputAuto, "audio output: auto, alsa[:device], pulse[:sink], file:path or fake, set by the config server once registered")
+	flag.StringVar(&inputDevices, "input", "", "Comma separated evdev devices for keys, IR remotes and rotary encoders, e.g. /dev/input/event0")
+	flag.StringVar(&inputKeys, "input-keys", defaultInputKeys, "Comma separated key bindings KEY=action, actions: next, prev, volume-up, volume-down, mute")
+	flag.StringVar(&inputRotary, "input-rotary", "REL_X,REL_DIAL", "Comma separated relative axes of rotary encoders changing the volume")
+	flag.IntVar(&inputStep, "input-step", defaultVolumeStep, "Volume change in percent per key press or encoder step")
+	pipelineBackoff.registerFlags("retry", "max-errors", "pipelines")
+	configBackoff.registerFlags("config-retry", "config-retry-attempts", "config server connections")
+	httpPort := flag.Int("http", 0, "Port for serving metrics and health checks, 0 disables it")
 	verbose := flag.Bool("verbose", false, "verbose logging")
-	flag.Parse()
+	parseOptions(func(e *OptionErrors) {
+		e.check("config-server", checkRequired(m.ConfigUri))
+		e.check("config-server", checkUris(m.ConfigUri))
+		e.check("name", checkRequired(r.Name))
+		e.check("host", checkRequired(r.Host))
+		e.check("output", checkOutputUri(r.Output))
+		e.check("input-keys", checkInputMap(inputKeys, inputRotary))
+		e.check("input-step", checkRange(inputStep, 1, maxVolume))
+		e.check("http", checkRange(*httpPort, 0, 65535))
+		e.check("retry", pipelineBackoff.validate())
+		e.check("config-retry", configBackoff.validate())
+	})
 	initLogger(*verbose)
+	m.setConfigServers(m.ConfigUri)
+
+	if *httpPort > 0 {
+		metrics.NewCollector("ub0r_receiver_buffer_bytes", "Bytes buffered before decoding", kindGauge, nil,
+			func(emit func(float64, ...string)) {
+				if v, ok := m.elemProperty("buffer", "current-level-bytes"); ok {
+					emit(v)
+				}
+			})
+		go m.serveLocal(*httpPort)
+	}
+
+	if inputDevices != "" {
+		im, _ := parseInputMap(inputKeys, inputRotary)
+		m.startInputs(inputDevices, im)
+	}
 
 	m.startReceiver()
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 )
 
@@ -9,25 +10,67 @@ func main() {
 	hostname, _ := os.Hostname()
 	m := NewServer(false)
 	s := m.Server()
-	flag.StringVar(&m.ConfigUri, "config-server", "http://localhost:8080", "config server base uri")
+	flag.StringVar(&m.ConfigUri, "config-server", "http://localhost:8080", "config server base uri, comma separated uris to fail over between several config servers")
 	flag.StringVar(&s.Name, "name", hostname, "server name")
 	flag.StringVar(&s.Host, "host", hostname, "server host name")
-	flag.IntVar(&s.Port, "port", 48100, "server port")
+	flag.IntVar(&s.Port, "port", 48100, "server port, first port of spawned senders with --agent")
 	flag.StringVar(&s.RadioUri, "uri", "", "uri to stream into the network")
 	flag.IntVar(&m.Complexity, "complexity", 10, "opusenc: complexity [0-10]")
+	pipelineBackoff.registerFlags("retry", "max-errors", "pipelines")
+	httpPort := flag.Int("http", 0, "Port for serving metrics and health checks, 0 disables it, serves the agent api with --agent")
+	agent := flag.Bool("agent", false, "Run senders spawned by the config server instead of streaming --uri")
+	agentUri := flag.String("agent-uri", "", "Uri of the agent api as reached by the config server (default: http://${host}:${http})")
+	zone := flag.String("zone", "", "Location of the agent, senders for receivers of the group with this name are placed here")
+	capacity := flag.Int("capacity", 0, "Maximum number of senders spawned on the agent, 0 for no limit")
+	flag.BoolVar(&s.Internal, "internal", false, "Run as internal sender supervised by the config server, reporting status on --http only")
 	verbose := flag.Bool("verbose", false, "verbose logging")
-	flag.Parse()
+	parseOptions(func(e *OptionErrors) {
+		if !s.Internal {
+			e.check("config-server", checkRequired(m.ConfigUri))
+		}
+		e.check("config-server", checkUris(m.ConfigUri))
+		e.check("host", checkRequired(s.Host))
+		e.check("port", checkRange(s.Port, 1, 65535))
+		e.check("http", checkRange(*httpPort, 0, 65535))
+		if *agent && s.Internal {
+			e.check("internal", fmt.Errorf("not supported with --agent"))
+		}
+		if *agent || s.Internal {
+			e.check("http", checkRange(*httpPort, 1, 65535))
+		}
+		if *agent {
+			e.check("agent-uri", checkUris(*agentUri))
+			e.check("capacity", checkRange(*capacity, 0, 65535))
+		} else if s.RadioUri == "" {
+			e.check("uri", checkRequired(s.RadioUri))
+		} else {
+			e.check("uri", checkRadioUri(s.RadioUri))
+		}
+		e.check("complexity", checkRange(m.Complexity, 0, 10))
+		e.check("retry", pipelineBackoff.validate())
+	})
 	initLogger(*verbose)
+	configServers := m.ConfigUri
+	m.setConfigServers(configServers)
 
-	s.RadioId = "static"
-	if s.RadioUri == "" {
-		log.Error("--uri is mandatory")
-		os.Exit(1)
+	if *agent {
+		if *agentUri == "" {
+			*agentUri = fmt.Sprintf("http://%s:%d", s.Host, *httpPort)
+		}
+		uris, _ := parseUris(*agentUri)
+		a := &Agent{Name: s.Name, Host: s.Host, Uri: uris[0], Zone: *zone, Capacity: *capacity}
+		sa := NewSenderAgent(a, configServers, s.Port, m.Complexity)
+		registerSenderMetrics(sa.managers)
+		go sa.loop()
+		sa.serve(*httpPort)
+		return
 	}
 
-	if m.Complexity < 0 || m.Complexity > 10 {
-		log.Error("--complexity must be between 0 and 10")
-		os.Exit(1)
+	s.RadioId = "static"
+
+	registerSenderMetrics(func() []*Manager { return []*Manager{m} })
+	if *httpPort > 0 {
+		go m.serveLocal(*httpPort)
 	}
 
 	m.startSender()
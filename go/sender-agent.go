@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rtp-sender running senders spawned by the config server instead of a single static stream
+// the agent pings the config server with its senders, the senders ping on their own like static ones
+
+type SenderAgent struct {
+	// pings the agent to the config server
+	client     *Manager
+	senders    map[string]*Manager
+	lock       sync.Mutex
+	configUris string
+	// first port handed out to senders
+	port       int
+	complexity int
+}
+
+func NewSenderAgent(a *Agent, configUris string, port, complexity int) *SenderAgent {
+	client := newManager()
+	client.Backend = a
+	client.StatusPath = "/api/ping/agent"
+	client.setConfigServers(configUris)
+	return &SenderAgent{
+		client:     client,
+		senders:    make(map[string]*Manager),
+		configUris: configUris,
+		port:       port,
+		complexity: complexity,
+	}
+}
+
+func (sa *SenderAgent) agent() *Agent {
+	return sa.client.Backend.(*Agent)
+}
+
+func (sa *SenderAgent) managers() []*Manager {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	l := make([]*Manager, 0, len(sa.senders))
+	for _, m := range sa.senders {
+		l = append(l, m)
+	}
+	return l
+}
+
+func (sa *SenderAgent) servers() []*Server {
+	l := make([]*Server, 0)
+	for _, m := range sa.managers() {
+		l = append(l, m.Server())
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Port < l[j].Port
+	})
+	return l
+}
+
+// report running senders, call with lock held
+func (sa *SenderAgent) update() {
+	ids := make([]string, 0, len(sa.senders))
+	for k := range sa.senders {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+	sa.agent().Senders = ids
+}
+
+// lowest port not used by own senders and free to bind, call with lock held
+func (sa *SenderAgent) freePort() (int, error) {
+	used := make(map[int]bool)
+	for _, m := range sa.senders {
+		used[m.Server().Port] = true
+	}
+	for p := sa.port; p <= 65535; p++ {
+		if !used[p] && portFree(p) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port above %d", sa.port)
+}
+
+func (sa *SenderAgent) spawn(r *SpawnRequest) (*Server, int, error) {
+	if err := checkRadioUri(r.RadioUri); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	a := sa.agent()
+	if a.Capacity > 0 && len(sa.senders) >= a.Capacity {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("agent full, running %d senders", len(sa.senders))
+	}
+	port, err := sa.freePort()
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+
+	log.Info("spawning new sender for radio: %s", r.RadioUri)
+	m := NewServer(false)
+	s := m.Server()
+	s.Name = a.Name
+	s.Host = a.Host
+	s.Port = port
+	s.RadioId = r.RadioId
+	s.RadioUri = r.RadioUri
+	s.Agent = a.Id()
+	m.Complexity = sa.complexity
+	m.setConfigServers(sa.configUris)
+	sa.senders[s.Id()] = m
+	sa.update()
+	go m.startSender()
+	return s, http.StatusCreated, nil
+}
+
+func (sa *SenderAgent) stop(server_id string) bool {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	m, ok := sa.senders[server_id]
+	if !ok {
+		return false
+	}
+	m.stopSender()
+	delete(sa.senders, server_id)
+	sa.update()
+	return true
+}
+
+func (sa *SenderAgent) loop() {
+	for {
+		sa.lock.Lock()
+		sa.update()
+		sa.lock.Unlock()
+		log.Debug("ping config server")
+		sa.client.ping()
+		time.Sleep(agentHeartbeat)
+	}
+}
+
+// GET /api/senders
+// POST /api/senders
+// DELETE /api/senders?id=${server-id}
+func (sa *SenderAgent) serveSenders(w http.ResponseWriter, req *http.Request) {
+	var obj interface{}
+	code := http.StatusOK
+	switch req.Method {
+	case "GET":
+		obj = sa.servers()
+	case "POST":
+		var r SpawnRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			http.Error(w, fmt.Sprintf("invalid spawn request: %s", err), http.StatusBadRequest)
+			return
+		}
+		s, rc, err := sa.spawn(&r)
+		if err != nil {
+			log.Warning("unable to spawn sender: %s", err)
+			http.Error(w, err.Error(), rc)
+			return
+		}
+		obj, code = s, rc
+	case "DELETE":
+		id := req.URL.Query().Get("id")
+		if !sa.stop(id) {
+			http.Error(w, fmt.Sprintf("sender not found: %s", id), http.StatusNotFound)
+		}
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func (sa *SenderAgent) serve(port int) {
+	log.Info("starting agent httpd on port %d", port)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealth)
+	mux.HandleFunc("/readyz", serveHealth)
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/api/senders", sa.serveSenders)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	if err != nil {
+		log.Error("error starting agent httpd: %v", err)
+	}
+}
@@ -0,0 +1,576 @@
+// progressive enhancement: show parts of the ui depending on java script
+document.documentElement.className = document.documentElement.className.replace('no-js', 'js');
+
+var config = {};
+var deviceStatus = {};
+var pollInterval = 10000;
+
+var defaultServer = {'Host': 'off', 'Port': 0};
+var defaultRadio = {'Uri': 'off', 'Name': 'off'};
+var offId = 'off';
+var maxVolume = 150;
+
+var deleteEditId = null;
+var deleteRadioId = null;
+
+// escape text and attribute values inserted into html
+function escapeHtml(s) {
+    return String(s === undefined || s === null ? '' : s)
+        .replace(/&/g, '&amp;')
+        .replace(/</g, '&lt;')
+        .replace(/>/g, '&gt;')
+        .replace(/"/g, '&quot;')
+        .replace(/'/g, '&#39;');
+}
+
+// build receiver api call
+function receiverApi(id, param, value) {
+    return escapeHtml('/api/receiver?id=' + encodeURIComponent(id) + '&' + param + '=' + encodeURIComponent(value));
+}
+
+function isNotEmpty(o) {
+    return o && Object.keys(o).length > 0
+}
+
+function sortNames(a, b) {
+    var an = a.Name.toLowerCase();
+    var bn = b.Name.toLowerCase();
+    if (an < bn) return -1;
+    if (an > bn) return 1;
+    return 0
+}
+
+// favorites first, then user defined order, then name
+function sortRadios(a, b) {
+    if (a.Favorite != b.Favorite) return a.Favorite ? -1 : 1;
+    if (a.Order != b.Order) {
+        // radios without order go last
+        if (!a.Order) return 1;
+        if (!b.Order) return -1;
+        return a.Order - b.Order;
+    }
+    return sortNames(a, b);
+}
+
+function eachSorted(obj, s, f) {
+    var keys = Object.keys(obj);
+    keys.sort(function(a, b){return s(obj[a], obj[b])});
+    $.each(keys, function(i, k) {f(k, obj[k])})
+}
+
+// get active radio for a given server
+// result is never undefined
+function getActiveRadioId(serverId) {
+    try {
+        var s = config.Servers[serverId]
+        return s && s.RadioId != '' ? s.RadioId : offId;
+    } catch (err) {
+        console.log(err);
+        return offId;
+    }
+}
+
+// get active server for a given receiver
+// result is never undefined
+function getActiveServerId(receiverId) {
+    try {
+        var r = config.Receivers[receiverId];
+        return r && r.ServerId != '' ? r.ServerId : offId;
+    } catch (err) {
+        console.log(err);
+        return offId;
+    }
+}
+
+// get data-icon value
+function getIcon(active, off) {
+    if (active) {
+        return off ? 'power' : 'audio';
+    } else {
+        return 'false';
+    }
+}
+
+// create list of servers for a single receiver
+function injectReceiver(id, r) {
+    var servers = '<ul class="receiver-list-ul" data-role="listview" data-inset="true">';
+    var activeServerId = getActiveServerId(id);
+    var activeRadioId = getActiveRadioId(activeServerId);
+    // inject 'off' server
+    servers += '<li data-icon="' + getIcon(offId == activeServerId, true) + '"><a class="api-call" href="' + receiverApi(id, 'server', offId) + '">Off</a></li>';
+    // add servers
+    if (config.Servers) {
+        eachSorted(config.Servers, sortNames, function(k, e) {
+            if (!e.Internal && !e.Agent) {
+                servers += '<li data-icon="' + getIcon(k == activeServerId, false) + '"><a class="api-call" href="' + receiverApi(id, 'server', k) + '">' + escapeHtml(e.Name) + '</a></li>';
+            }
+        });
+    }
+    // add radios
+    if (config.Radios) {
+        eachSorted(config.Radios, sortRadios, function(k, e) {
+            servers += '<li data-icon="' + getIcon(k == activeRadioId, false) + '"><a class="api-call" href="' + receiverApi(id, 'radio', k) + '">' + escapeHtml(e.Name) + '</a></li>';
+        });
+    }
+    servers += '</ul>';
+    volume = '<label for="volume-' + escapeHtml(id) + '" class="ui-hidden-accessible">Volume</label>';
+    volume += '<input class="volume-slider api-base" rel="' + escapeHtml(id) + '" type="range" name="volume" id="volume-' + escapeHtml(id) + '" value="' + escapeHtml(r.Volume) + '" min="0" max="' + escapeHtml(r.MaxVolume || maxVolume) + '" data-highlight="true" data-mini="true">';
+    volume += '<a class="api-call ui-btn ui-mini ui-btn-inline' + (r.Muted ? ' ui-btn-active' : '') + '" aria-pressed="' + (r.Muted ? 'true' : 'false') + '" href="' + receiverApi(id, 'mute', 'toggle') + '">' + (r.Muted ? 'Unmute' : 'Mute') + '</a>';
+    sleep = '<select class="sleep-timer" rel="' + escapeHtml(id) + '" data-mini="true" aria-label="Sleep timer">';
+    sleep += '<option value="">Sleep timer</option>';
+    $.each([15, 30, 60, 90], function(i, m) {
+        sleep += '<option value="' + m + '">Off in ' + m + ' minutes</option>';
+    });
+    sleep += '<option value="0">Cancel sleep timer</option>';
+    sleep += '</select>';
+    var current = r.Output || 'auto';
+    var outputs = $.merge([], r.Outputs || []);
+    if ($.inArray(current, outputs) < 0) {
+        outputs.push(current);
+    }
+    var output = '<select class="receiver-output" rel="' + escapeHtml(id) + '" data-mini="true" aria-label="Audio output">';
+    $.each(outputs, function(i, o) {
+        output += '<option value="' + escapeHtml(o) + '"' + (o == current ? ' selected' : '') + '>Output: ' + escapeHtml(o) + '</option>';
+    });
+    output += '</select>';
+    var audio = '<div data-role="collapsible" data-mini="true"><h4>Audio settings</h4>';
+    audio += '<form class="audio-form"><input type="hidden" name="id" value="' + escapeHtml(id) + '">';
+    audio += '<select name="channels" data-mini="true" aria-label="Channels">';
+    $.each(['stereo', 'left', 'right', 'mono'], function(i, c) {
+        audio += '<option value="' + c + '"' + (c == (r.Channels || 'stereo') ? ' selected' : '') + '>Channels: ' + c + '</option>';
+    });
+    audio += '</select>';
+    audio += '<label>Delay in ms<input type="number" name="delay" min="0" max="5000" data-mini="true" value="' + escapeHtml(r.Delay || 0) + '"></label>';
+    audio += '<label>Equalizer: gains in dB for 29 Hz to 15 kHz, or flat<input type="text" name="eq" data-mini="true" value="' + escapeHtml(r.Eq && r.Eq.length ? r.Eq.join(',') : 'flat') + '"></label>';
+    audio += '<select name="loudness" data-mini="true" aria-label="Loudness"><option value="false">Loudness: off</option><option value="true"' + (r.Loudness ? ' selected' : '') + '>Loudness: on</option></select>';
+    audio += '<input type="submit" value="Set audio" data-mini="true"></form></div>';
+    var badge = '<span class="receiver-status" rel="' + escapeHtml(id) + '"></span>';
+    $('#receiver-list').append('<div id="' + escapeHtml(id) + '"><h4>' + escapeHtml(r.Name) + ' ' + badge + '</h4>' + volume + servers + sleep + output + audio + '</div>');
+}
+
+// create list radios
+function injectRadio(id, r) {
+    var rel = escapeHtml(id);
+    radio = '<li id="' + rel + '"><div class="ui-grid-a">';
+    radio += '<div class="ui-block-a">';
+    if (r.Logo) {
+        radio += '<img src="' + escapeHtml(r.Logo) + '" class="radio-logo" alt="">';
+    }
+    radio += '<h2>' + escapeHtml(r.Name) + '</h2>';
+    radio += '<p>' + escapeHtml(r.Uri) + '</p>';
+    if (r.Tags && r.Tags.length > 0) {
+        radio += '<p class="radio-tags">' + escapeHtml(r.Tags.join(', ')) + '</p>';
+    }
+    radio += '</div>';
+    radio += '<div class="ui-block-b" style="text-align: right;">';
+    radio += '<a href="#" rel="' + rel + '" class="ui-btn ui-btn-inline ui-icon-star   ui-btn-icon-notext ui-corner-all ui-shadow toggle-favorite-radio' + (r.Favorite ? ' ui-btn-active' : '') + '" data-icon="star">Favorite</a>';
+    radio += '<a href="#" rel="' + rel + '" class="ui-btn ui-btn-inline ui-icon-arrow-u ui-btn-icon-notext ui-corner-all ui-shadow move-up-radio" data-icon="arrow-u">Up</a>';
+    radio += '<a href="#" rel="' + rel + '" class="ui-btn ui-btn-inline ui-icon-arrow-d ui-btn-icon-notext ui-corner-all ui-shadow move-down-radio" data-icon="arrow-d">Down</a>';
+    radio += '<a href="#" rel="' + rel + '" class="ui-btn ui-btn-inline ui-icon-edit   ui-btn-icon-notext ui-corner-all ui-shadow dialog-edit-radio" data-icon="edit">Edit</a>';
+    radio += '<a href="#" rel="' + rel + '" class="ui-btn ui-btn-inline ui-icon-delete ui-btn-icon-notext ui-corner-all ui-shadow dialog-delete-radio" data-icon="delete">Delete</a>';
+    radio += '</div>';
+    radio += '</div></li>';
+    $('#radios-list').append(radio);
+}
+
+// create html elements representing the backends
+function injectBackends() {
+    // create list of receivers
+    $('#receiver-list').empty();
+    if (isNotEmpty(config.Receivers)) {
+        eachSorted(config.Receivers, sortNames, function(k, e) {
+            injectReceiver(k, e);
+        });
+    } else {
+      $('#receiver-list').append("no active receiver found");
+    }
+
+    // create list of radios
+    $('#radios-list').empty();
+    if (isNotEmpty(config.Radios)) {
+        eachSorted(config.Radios, sortRadios, function(k, e) {
+            injectRadio(k, e);
+        });
+    } else {
+      $('#radio-list').append("no radio defined");
+    }
+
+    // init dynamically added views to make them look beautiful
+    $('html').trigger('create');
+    $('.radio-list-ul').listview().listview('refresh');
+
+    // replace api-calls with ajax requests
+    $('.api-call').unbind('click', onApiCallClick);
+    $('.api-call').click(onApiCallClick);
+    $('.dialog-edit-radio').unbind('click', onEditRadioClick);
+    $('.dialog-edit-radio').click(onEditRadioClick);
+    $('.dialog-delete-radio').unbind('click', onDeleteRadioClick);
+    $('.dialog-delete-radio').click(onDeleteRadioClick);
+    $('.toggle-favorite-radio').unbind('click', onFavoriteRadioClick);
+    $('.toggle-favorite-radio').click(onFavoriteRadioClick);
+    $('.move-up-radio').unbind('click', onMoveUpRadioClick);
+    $('.move-up-radio').click(onMoveUpRadioClick);
+    $('.move-down-radio').unbind('click', onMoveDownRadioClick);
+    $('.move-down-radio').click(onMoveDownRadioClick);
+    $('.volume-slider').unbind('change', onVolumeChange);
+    $('.volume-slider').change(onVolumeChange);
+    $('.sleep-timer').unbind('change', onSleepTimerChange);
+    $('.sleep-timer').change(onSleepTimerChange);
+    $('.receiver-output').unbind('change', onOutputChange);
+    $('.receiver-output').change(onOutputChange);
+    $('form.audio-form').unbind('submit', onAudioSubmit);
+    $('form.audio-form').submit(onAudioSubmit);
+}
+
+function onApiCallClick(e) {
+   e.preventDefault();
+   $.get(e.target.href);
+}
+
+function onAddRadioClick(e) {
+    e.preventDefault();
+    showEditRadioDialog(null);
+}
+
+function onEditRadioClick(e) {
+   e.preventDefault();
+   showEditRadioDialog(e.target.rel);
+}
+
+function onDeleteRadioClick(e) {
+   e.preventDefault();
+   showDeleteRadioDialog(e.target.rel);
+}
+
+function onSearchRadioClick(e) {
+    e.preventDefault();
+    showSearchRadioDialog();
+}
+
+function onSearchRadioSubmit(e) {
+    e.preventDefault();
+    searchRadio();
+}
+
+function onImportRadioClick(e) {
+    e.preventDefault();
+    importRadio($(e.target).closest('a').attr('rel'));
+}
+
+function onFavoriteRadioClick(e) {
+   e.preventDefault();
+   var id = e.target.rel;
+   patchRadio(id, {"Favorite": !config.Radios[id].Favorite});
+}
+
+function onMoveUpRadioClick(e) {
+   e.preventDefault();
+   moveRadio(e.target.rel, -1);
+}
+
+function onMoveDownRadioClick(e) {
+   e.preventDefault();
+   moveRadio(e.target.rel, 1);
+}
+
+function onAddRadioSubmit(e) {
+    e.preventDefault();
+    addRadio();
+}
+
+function onDeleteRadioSubmit(e) {
+    e.preventDefault();
+    deleteRadio();
+}
+
+function onVolumeChange(e) {
+    var id = $(e.target).attr('rel');
+    $.get('/api/receiver', {'id': id, 'volume': $(e.target).val()});
+}
+
+function onAudioSubmit(e) {
+    e.preventDefault();
+    var form = $(e.target);
+    form.find('input').toggleClass('error', false);
+    $.get('/api/receiver', form.serialize()).fail(function(xhr) {
+        // mark the offending field, the error names it
+        var text = xhr.responseText;
+        form.find('input[name=delay]').toggleClass('error', text.indexOf('delay') >= 0);
+        form.find('input[name=eq]').toggleClass('error', text.indexOf('delay') < 0);
+    });
+}
+
+function onOutputChange(e) {
+    var id = $(e.target).attr('rel');
+    $.get('/api/receiver', {'id': id, 'output': $(e.target).val()});
+}
+
+function onSleepTimerChange(e) {
+    var id = $(e.target).attr('rel');
+    var m = $(e.target).val();
+    if (m == '') {
+        return;
+    }
+    $.ajax({url: '/api/sleep?id=' + encodeURIComponent(id) + (m > 0 ? '&minutes=' + m : ''),
+        type: m > 0 ? 'post' : 'delete'});
+}
+
+// callback to update config
+function updateConfig(data) {
+    config = data;
+    injectBackends();
+    injectStatus();
+}
+
+// show state of receivers next to their names
+function injectStatus() {
+    $('.receiver-status').each(function(i, e) {
+        var id = $(e).attr('rel');
+        var d = deviceStatus[id];
+        if (!d) {
+            $(e).text('').removeClass('stale not-ready warning');
+            return;
+        }
+        var state = d.Stale ? 'offline' : (d.Status ? d.Status.State : 'unknown');
+        var title = d.Status && d.Status.Connected ? d.Status.Connected : '';
+        // errors of the receiver itself or of the server it listens to
+        var warning = null;
+        var r = config.Receivers ? config.Receivers[id] : null;
+        $.each([d, r ? deviceStatus[r.ServerId] : null], function(i, s) {
+            if (!warning && s && s.Status && (s.Status.Failed || s.Status.ErrorCount > 0)) {
+                warning = s;
+            }
+        });
+        if (warning) {
+            state = warning.Status.Failed ? 'failed' : state + ', ' + warning.Status.ErrorCount + ' errors';
+            title = warning.Name + ': ' + warning.Status.LastError;
+        }
+        $(e).text(state);
+        $(e).toggleClass('stale', d.Stale);
+        $(e).toggleClass('not-ready', !d.Stale && !(d.Status && d.Status.Ready));
+        $(e).toggleClass('warning', warning != null);
+        $(e).attr('title', title);
+    });
+}
+
+// poll status of receivers and servers, they are not pushed with the config
+function pollStatus() {
+    $.get('/api/status', function(data) {
+        deviceStatus = {};
+        $.each(data.Devices, function(i, d) {
+            deviceStatus[d.Id] = d;
+        });
+        injectStatus();
+    });
+    setTimeout(pollStatus, pollInterval);
+}
+
+// fetch config in background
+function fetchConfig() {
+    $.get('/api/config', updateConfig);
+}
+
+// poll config if web sockets are not available
+function pollConfig() {
+    fetchConfig();
+    setTimeout(pollConfig, pollInterval);
+}
+
+// watch for config changes with server-sent events if web sockets are not available
+function streamConfig() {
+    var events = new EventSource(window.location.pathname + 'events/config');
+    events.addEventListener('config', function(msg) {
+        updateConfig($.parseJSON(msg.data));
+    });
+    // EventSource reconnects by itself
+}
+
+// watch for config changes with web sockets
+function watchConfig() {
+    if(typeof(WebSocket) === 'undefined') {
+        if(typeof(EventSource) !== 'undefined') {
+            console.log('WebSocket not supported, streaming config');
+            streamConfig();
+            return
+        }
+        console.log('WebSocket not supported, polling config');
+        setTimeout(pollConfig, pollInterval);
+        return
+    }
+
+    var wsProto = window.location.protocol == 'https:' ? 'wss://' : 'ws://';
+    var wsUrl = wsProto + window.location.host + window.location.pathname + 'ws/config';
+    var ws = new WebSocket(wsUrl);
+    ws.onmessage = function(msg) {
+        updateConfig($.parseJSON(msg.data));
+    };
+    ws.onclose = function() {
+        // reconnect and catch up on missed changes
+        setTimeout(function() {
+            fetchConfig();
+            watchConfig();
+        }, pollInterval);
+    };
+}
+
+function showEditRadioDialog(id) {
+    editRadioId = id;
+    if (id) {
+        $("#add-radio-name").val(config.Radios[id].Name);
+        $("#add-radio-uri").val(config.Radios[id].Uri);
+        $("#add-radio-tags").val((config.Radios[id].Tags || []).join(', '));
+        $("#add-radio-gain").val(config.Radios[id].Gain || 0);
+    } else {
+        $("#add-radio-name").val("");
+        $("#add-radio-uri").val("");
+        $("#add-radio-tags").val("");
+        $("#add-radio-gain").val(0);
+    }
+    $("#add-radio-logo").val("");
+    $('#add-radio-name').toggleClass('error', false);
+    $('#add-radio-uri').toggleClass('error', false);
+    $.mobile.changePage('#add-radio');
+    setTimeout(function(){
+        $('#add-radio-name').focus();
+    },200);
+}
+
+function showDeleteRadioDialog(id) {
+    deleteRadioId = id;
+    $.mobile.changePage('#delete-radio');
+    setTimeout(function(){
+        $('#delete-radio-button').focus();
+    },200);
+}
+
+function showSearchRadioDialog() {
+    $('#search-radio-list').empty();
+    $.mobile.changePage('#search-radio');
+    setTimeout(function(){
+        $('#search-radio-name').focus();
+    },200);
+}
+
+// create list of directory search results
+function injectCandidates(candidates) {
+    $('#search-radio-list').empty();
+    if (!candidates || candidates.length == 0) {
+        $('#search-radio-list').append('<li>no radio found</li>');
+    }
+    $.each(candidates, function(i, c) {
+        var details = [c.Codec, c.Bitrate > 0 ? c.Bitrate + ' kbps' : '', c.Country].filter(function(d) {return d}).join(', ');
+        var candidate = '<li data-icon="plus"><a href="#" rel="' + escapeHtml(c.Id) + '" class="import-radio">';
+        if (c.Favicon) {
+            candidate += '<img src="' + escapeHtml(c.Favicon) + '" class="ui-li-icon" alt="">';
+        }
+        candidate += escapeHtml(c.Name) + '<p>' + escapeHtml(details) + '</p></a></li>';
+        $('#search-radio-list').append(candidate);
+    });
+    $('#search-radio-list').listview('refresh');
+    $('.import-radio').unbind('click', onImportRadioClick);
+    $('.import-radio').click(onImportRadioClick);
+}
+
+function searchRadio() {
+    var name = $('#search-radio-name').val();
+    $.get('/api/directory', {'name': name}, injectCandidates);
+}
+
+function importRadio(id) {
+    $.ajax({url: '/api/directory',
+        data: JSON.stringify([id]),
+        type: 'post',
+        async: 'true',
+        dataType: 'json'});
+    $.mobile.back();
+}
+
+function patchRadio(id, data) {
+    $.ajax({url: '/api/radio?id=' + encodeURIComponent(id),
+        data: JSON.stringify(data),
+        type: 'patch',
+        async: 'true',
+        dataType: 'json'});
+}
+
+// move radio by offset within the sorted list of radios
+function moveRadio(id, offset) {
+    var ids = Object.keys(config.Radios);
+    ids.sort(function(a, b){return sortRadios(config.Radios[a], config.Radios[b])});
+    var i = ids.indexOf(id);
+    var j = i + offset;
+    if (i < 0 || j < 0 || j >= ids.length) {
+        return;
+    }
+    ids[i] = ids[j];
+    ids[j] = id;
+    $.ajax({url: '/api/radios/order',
+        data: JSON.stringify(ids),
+        type: 'post',
+        async: 'true',
+        dataType: 'json'});
+}
+
+function uploadLogo(id, file) {
+    $.ajax({url: '/api/radio/logo?id=' + encodeURIComponent(id),
+        data: file,
+        type: 'post',
+        contentType: file.type,
+        processData: false,
+        async: 'true',
+        dataType: 'json'});
+}
+
+function addRadio() {
+    var name = $('#add-radio-name').val();
+    var uri = $('#add-radio-uri').val();
+    var tags = $.map($('#add-radio-tags').val().split(','), function(t) {
+        t = $.trim(t);
+        return t.length > 0 ? t : null;
+    });
+    var gain = parseFloat($('#add-radio-gain').val()) || 0;
+    var logo = $('#add-radio-logo')[0].files[0];
+    if (name.length > 0 && uri.length > 0) {
+        // existing radios keep their id
+        $.ajax({url: editRadioId ? '/api/radio?id=' + encodeURIComponent(editRadioId) : '/api/radio',
+            data: JSON.stringify({"Uri": uri, "Name": name, "Tags": tags, "Gain": gain}),
+            type: editRadioId ? 'patch' : 'post',
+            async: 'true',
+            dataType: 'json',
+            success: function(r) {
+                if (logo) {
+                    uploadLogo(r.Uid, logo);
+                }
+            }});
+        $.mobile.back();
+    } else {
+        $('#add-radio-name').toggleClass('error', name.length == 0);
+        $('#add-radio-uri').toggleClass('error', uri.length == 0);
+    }
+}
+
+function deleteRadio() {
+    $.ajax({
+        url: "/api/radio?id=" + encodeURIComponent(deleteRadioId),
+        type: "delete"
+    });
+    $.mobile.back();
+}
+
+// init page
+$(document).ready(function() {
+    fetchConfig();
+    watchConfig();
+    pollStatus();
+
+    $('.dialog-add-radio').unbind('click', onAddRadioClick);
+    $('.dialog-add-radio').click(onAddRadioClick);
+    $('.dialog-search-radio').unbind('click', onSearchRadioClick);
+    $('.dialog-search-radio').click(onSearchRadioClick);
+    $('form#search-radio-form').unbind('submit', onSearchRadioSubmit);
+    $('form#search-radio-form').submit(onSearchRadioSubmit);
+    $('form#add-radio-form').unbind('submit', onAddRadioSubmit);
+    $('form#add-radio-form').submit(onAddRadioSubmit);
+    $('form#delete-radio-form').unbind('submit', onDeleteRadioSubmit);
+    $('form#delete-radio-form').submit(onDeleteRadioSubmit);
+});